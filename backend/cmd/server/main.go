@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -13,59 +15,47 @@ import (
 	"github.com/jzhang405/SmartChrome/backend/config"
 	"github.com/jzhang405/SmartChrome/backend/internal/handlers"
 	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/internal/tools"
 	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
 	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+	"github.com/jzhang405/SmartChrome/backend/pkg/vector"
 )
 
 func main() {
 	// Initialize configuration
 	config := config.Load()
 
-	// Initialize Redis client
-	redisClient, err := cache.NewRedisClient(config.Redis.URL, config.Redis.Password, config.Redis.DB)
+	// Initialize storage backend
+	store, db, err := newStore(config)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Failed to initialize storage: %v", err)
 	}
-	defer redisClient.Close()
+	defer store.Close()
 
 	// Initialize LLM client with multiple providers
 	llmClient := llm.NewLLMClient()
 	
-	// Register configured LLM providers
-	for _, llmConfig := range config.LLMs {
-		var provider llm.LLMProvider
-		var err error
-
-		switch llmConfig.Provider {
-		case "openai":
-			provider, err = llm.NewOpenAIProvider(
-				llmConfig.APIKey,
-				llmConfig.BaseURL,
-				llmConfig.Model,
-			)
-		case "deepseek":
-			provider, err = llm.NewDeepSeekProvider(
-				llmConfig.APIKey,
-				llmConfig.BaseURL,
-				llmConfig.Model,
-			)
-		case "douban":
-			provider, err = llm.NewDoubanProvider(
-				llmConfig.APIKey,
-				llmConfig.BaseURL,
-				llmConfig.Model,
-			)
-		default:
-			log.Printf("Unsupported LLM provider: %s", llmConfig.Provider)
-			continue
-		}
+	retryPolicy := llm.RetryPolicy{
+		MaxRetries: config.Resilience.MaxRetries,
+		BaseDelay:  time.Duration(config.Resilience.RetryBaseDelay) * time.Millisecond,
+		MaxDelay:   time.Duration(config.Resilience.RetryMaxDelay) * time.Millisecond,
+	}
 
+	// Register configured LLM providers, each behind its own circuit breaker
+	for _, llmConfig := range config.LLMs {
+		provider, err := newLLMProvider(llmConfig)
 		if err != nil {
 			log.Printf("Failed to initialize %s provider: %v", llmConfig.Provider, err)
 			continue
 		}
 
-		llmClient.RegisterProvider(llmConfig.Provider, provider)
+		breaker := llm.NewCircuitBreaker(config.Resilience.BreakerThreshold, time.Duration(config.Resilience.BreakerCooldown)*time.Second)
+		llmClient.RegisterProvider(llmConfig.Provider, llm.NewResilientProvider(provider, retryPolicy, breaker))
+		llmClient.SetFallbacks(llmConfig.Provider, llmConfig.Fallbacks)
+		llmClient.SetLimits(llmConfig.Provider, llm.Limits{ContextWindow: llmConfig.ContextWindow, MaxOutputTokens: llmConfig.MaxTokens})
+		llmClient.SetVision(llmConfig.Provider, llmConfig.Vision)
 		
 		// Set as default if this is the default provider
 		if llmConfig.IsDefault {
@@ -73,6 +63,9 @@ func main() {
 		}
 	}
 
+	llmClient.SetEmbeddingProvider(config.Retrieval.EmbeddingProvider)
+	llmClient.SetFirstTokenTimeout(time.Duration(config.Resilience.FirstTokenTimeout) * time.Second)
+
 	// Initialize JWT middleware
 	jwtMiddleware := middleware.NewJWTMiddleware(config.Auth.JWTSecret)
 
@@ -85,7 +78,30 @@ func main() {
 	router.Use(middleware.ErrorMiddleware())
 
 	// Initialize handlers with LLM client
-	h := handlers.NewHandlers(redisClient, jwtMiddleware, llmClient)
+	// Retrieval over long pages and saved pages needs a provider that can embed text
+	var retriever *retrieval.Retriever
+	if config.Retrieval.EmbeddingProvider != "" {
+		// Falling back to memory would lose every saved page on restart
+		index, err := newVectorIndex(config, db)
+		if err != nil {
+			log.Fatalf("Failed to initialize %s vector index: %v", config.Retrieval.VectorBackend, err)
+		}
+		defer index.Close()
+
+		retriever = retrieval.NewRetriever(llmClient, store, index, config.Retrieval)
+	}
+
+	// Tools the model may call while answering
+	toolRegistry := tools.NewRegistry()
+	tools.RegisterBuiltins(toolRegistry, store, retriever)
+
+	h := handlers.NewHandlers(store, jwtMiddleware, llmClient, config.Quota, config.Attachments, retriever, toolRegistry)
+	h.SetAllowedOrigins(config.Server.AllowedOrigins)
+
+	// Saved pages belong to sessions and are unreachable once their token expires
+	if retriever != nil {
+		go purgeKnowledgePeriodically(h, time.Hour)
+	}
 
 	// API routes
 	api := router.Group("/v1")
@@ -100,13 +116,31 @@ func main() {
 		api.GET("/conversations/:conversationId", jwtMiddleware.AuthMiddleware(), h.GetConversation)
 		api.GET("/conversations/:conversationId/messages", jwtMiddleware.AuthMiddleware(), h.GetConversationMessages)
 		api.POST("/conversations/:conversationId/messages", jwtMiddleware.AuthMiddleware(), h.SendMessage)
+		api.POST("/conversations/:conversationId/extract", jwtMiddleware.AuthMiddleware(), h.ExtractData)
+		api.POST("/conversations/:conversationId/attachments", jwtMiddleware.AuthMiddleware(), h.UploadAttachment)
+		api.GET("/conversations/:conversationId/attachments/:attachmentId", jwtMiddleware.AuthMiddleware(), h.GetAttachment)
+
+		// Usage
+		api.GET("/usage", jwtMiddleware.AuthMiddleware(), h.GetUsage)
+
+		// Embeddings
+		api.POST("/embeddings", jwtMiddleware.AuthMiddleware(), h.CreateEmbeddings)
+
+		// Knowledge base of saved pages
+		api.POST("/knowledge/pages", jwtMiddleware.AuthMiddleware(), h.SavePage)
+		api.GET("/knowledge/pages", jwtMiddleware.AuthMiddleware(), h.ListSavedPages)
+		api.DELETE("/knowledge/pages/:pageId", jwtMiddleware.AuthMiddleware(), h.DeleteSavedPage)
+		api.POST("/knowledge/search", jwtMiddleware.AuthMiddleware(), h.SearchKnowledge)
 
 		// Health check
 		api.GET("/health", h.HealthCheck)
 	}
 
-	// WebSocket endpoint
+	// Streaming endpoints, over WebSocket or Server-Sent Events
 	router.GET("/v1/stream", jwtMiddleware.AuthMiddleware(), h.StreamHandler)
+	router.GET("/v1/stream/events", jwtMiddleware.AuthMiddleware(), h.StreamEventsHandler)
+	// One socket per session to ask, cancel and follow several conversations
+	router.GET("/v1/ws", jwtMiddleware.AuthMiddleware(), h.SessionSocketHandler)
 
 	// Start server
 	srv := &http.Server{
@@ -137,4 +171,135 @@ func main() {
 	}
 
 	log.Println("Server exited")
-}
\ No newline at end of file
+}
+
+// purgeKnowledgePeriodically deletes the expired saved pages at every
+// interval until the server exits
+func purgeKnowledgePeriodically(h *handlers.Handlers, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := h.PurgeExpiredKnowledge(context.Background())
+		if err != nil {
+			log.Printf("Failed to purge expired saved pages: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("Purged %d expired saved pages", removed)
+		}
+	}
+}
+
+// newLLMProvider creates the provider for a configured endpoint according to
+// the protocol it speaks
+func newLLMProvider(cfg config.LLMConfig) (llm.LLMProvider, error) {
+	switch cfg.Type {
+	case "openai":
+		return llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{
+			Name:       cfg.Provider,
+			APIKey:     cfg.APIKey,
+			BaseURL:    cfg.BaseURL,
+			Model:      cfg.Model,
+			APIType:    cfg.APIType,
+			APIVersion: cfg.APIVersion,
+
+			EmbeddingModel: cfg.EmbeddingModel,
+			JSONMode:       cfg.JSONMode,
+			Tools:          cfg.Tools,
+			StreamUsage:    cfg.StreamUsage,
+			MaxTokens:      cfg.MaxTokens,
+			Temperature:    cfg.Temperature,
+		})
+	case "anthropic":
+		provider, err := llm.NewAnthropicProvider(cfg.APIKey, cfg.BaseURL, cfg.Model)
+		if err != nil {
+			return nil, err
+		}
+		provider.SetDefaults(cfg.MaxTokens, cfg.Temperature)
+		return provider, nil
+	case "ollama":
+		provider, err := llm.NewOllamaProvider(cfg.BaseURL, cfg.Model)
+		if err != nil {
+			return nil, err
+		}
+		provider.SetEmbeddingModel(cfg.EmbeddingModel)
+		provider.SetTools(cfg.Tools)
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("unsupported provider type: %s", cfg.Type)
+	}
+}
+
+// newStore creates the storage backend selected by the configuration. The
+// PostgreSQL store also returns its connection pool, which the pgvector
+// index shares.
+func newStore(cfg *config.Config) (storage.Store, *sql.DB, error) {
+	switch cfg.Storage.Backend {
+	case "memory":
+		log.Println("Using in-memory storage, data will be lost on restart")
+		return storage.NewMemoryStore(), nil, nil
+	case "postgres":
+		sqlStore, err := storage.NewPostgresStore(cfg.Database.URL, cfg.Database.MaxConnections, cfg.Database.MaxIdleConnections)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Redis is only a cache in front of PostgreSQL, so run without it if it is down
+		redisClient, err := cache.NewRedisClient(cfg.Redis.URL, cfg.Redis.Password, cfg.Redis.DB)
+		if err != nil {
+			log.Printf("Redis cache unavailable, using PostgreSQL directly: %v", err)
+			return sqlStore, sqlStore.DB(), nil
+		}
+		return storage.NewCachedStore(sqlStore, redisClient), sqlStore.DB(), nil
+	case "sqlite":
+		path := storage.SQLitePath(cfg.Database.URL)
+		if path == "" {
+			return nil, nil, fmt.Errorf("DATABASE_URL must point to an SQLite database file")
+		}
+		log.Printf("Using SQLite storage at %s", path)
+		store, err := storage.NewSQLiteStore(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, nil, nil
+	case "redis", "":
+		redisClient, err := cache.NewRedisClient(cfg.Redis.URL, cfg.Redis.Password, cfg.Redis.DB)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		}
+		return storage.NewRedisStore(redisClient), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported storage backend %q, DATABASE_URL must be a postgres:// URL or an SQLite file", cfg.Storage.Backend)
+	}
+}
+
+// newVectorIndex creates the index of saved pages selected by the
+// configuration. The pgvector index is kept in the database of the
+// PostgreSQL store, whose pool is passed as db.
+func newVectorIndex(cfg *config.Config, db *sql.DB) (vector.Index, error) {
+	switch cfg.Retrieval.VectorBackend {
+	case "memory", "":
+		log.Println("Using in-memory vector index, saved pages will be lost on restart")
+		return vector.NewFlatIndex(), nil
+	case "pgvector":
+		if db == nil {
+			return nil, fmt.Errorf("the pgvector index needs the postgres storage backend")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := storage.MigrateKnowledge(ctx, db); err != nil {
+			return nil, err
+		}
+		return vector.NewPgvectorIndex(db), nil
+	case "redis":
+		// The index closes its client, so it gets its own
+		redisClient, err := cache.NewRedisClient(cfg.Redis.URL, cfg.Redis.Password, cfg.Redis.DB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		}
+		return vector.NewRedisIndex(redisClient), nil
+	default:
+		return nil, fmt.Errorf("unsupported vector backend: %s", cfg.Retrieval.VectorBackend)
+	}
+}
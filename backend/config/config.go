@@ -3,14 +3,20 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Auth     AuthConfig
-	LLMs     []LLMConfig
-	Redis    RedisConfig
+	Server      ServerConfig
+	Database    DatabaseConfig
+	Storage     StorageConfig
+	Auth        AuthConfig
+	LLMs        []LLMConfig
+	Resilience  ResilienceConfig
+	Quota       QuotaConfig
+	Retrieval   RetrievalConfig
+	Attachments AttachmentConfig
+	Redis       RedisConfig
 }
 
 type ServerConfig struct {
@@ -18,6 +24,9 @@ type ServerConfig struct {
 	Host         string
 	ReadTimeout  int
 	WriteTimeout int
+	// AllowedOrigins are the browser origins other than the server's own
+	// that may open WebSockets, e.g. chrome-extension://<extension id>
+	AllowedOrigins []string
 }
 
 type DatabaseConfig struct {
@@ -26,19 +35,132 @@ type DatabaseConfig struct {
 	MaxIdleConnections int
 }
 
+// StorageConfig selects the persistence backend: "redis", "memory",
+// "postgres" or "sqlite". When unset it is derived from DatabaseConfig.URL.
+type StorageConfig struct {
+	Backend string
+}
+
 type AuthConfig struct {
 	JWTSecret     string
 	JWTExpiration int
 }
 
+// LLMConfig describes one named LLM endpoint. Type selects the wire
+// protocol: "openai" for any OpenAI-compatible API, "anthropic" or "ollama".
 type LLMConfig struct {
 	Provider    string
+	Type        string
 	APIKey      string
 	BaseURL     string
 	Model       string
 	MaxTokens   int
 	Temperature float64
 	IsDefault   bool
+	// APIType and APIVersion are only used by Azure OpenAI endpoints
+	APIType    string
+	APIVersion string
+	// Fallbacks names the providers tried in order when this one fails
+	// before answering, e.g. OPENAI_FALLBACKS=deepseek,ollama
+	Fallbacks []string
+	// ContextWindow is the number of tokens the model accepts, prompt and
+	// answer together
+	ContextWindow int
+	// EmbeddingModel enables embeddings on the endpoint, e.g.
+	// text-embedding-3-small or nomic-embed-text
+	EmbeddingModel string
+	// JSONMode is the response_format an OpenAI-compatible endpoint
+	// supports: "schema", "object" or empty for none
+	JSONMode string
+	// Tools enables tool calling on the endpoint, letting the model use
+	// backend tools while answering
+	Tools bool
+	// Vision declares that the model accepts images, such as screenshots
+	// attached to questions
+	Vision bool
+	// StreamUsage asks an OpenAI-compatible endpoint to report usage at the
+	// end of a stream, which some servers reject
+	StreamUsage bool
+}
+
+// ResilienceConfig controls retries, circuit breaking and fallback timeouts
+// for every LLM provider. Delays are in milliseconds, the cooldown and the
+// first token timeout in seconds.
+type ResilienceConfig struct {
+	MaxRetries       int
+	RetryBaseDelay   int
+	RetryMaxDelay    int
+	BreakerThreshold int
+	BreakerCooldown  int
+	// FirstTokenTimeout is how long a provider may take to send anything
+	// before its fallbacks are tried, 0 to wait for as long as the request
+	FirstTokenTimeout int
+}
+
+// ModelPrice is the cost of a model in USD per million tokens
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// Cost returns the price of a request in USD
+func (p ModelPrice) Cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*p.Input + float64(completionTokens)*p.Output) / 1e6
+}
+
+// QuotaConfig holds the price table and the token and cost budgets of
+// sessions and users. A zero budget is unlimited.
+type QuotaConfig struct {
+	// Prices is keyed by "provider/model", or by "provider" alone to price
+	// every model of a provider. Unlisted models, such as local ones, are free.
+	Prices map[string]ModelPrice
+
+	SessionDailyTokens   int
+	SessionMonthlyTokens int
+	UserDailyTokens      int
+	UserMonthlyTokens    int
+
+	SessionDailyCost   float64
+	SessionMonthlyCost float64
+	UserDailyCost      float64
+	UserMonthlyCost    float64
+
+	// DowngradeProvider answers requests over quota instead of rejecting
+	// them, typically a cheap or local model
+	DowngradeProvider string
+}
+
+// Price looks up the price of a provider's model
+func (q QuotaConfig) Price(provider, model string) ModelPrice {
+	if price, ok := q.Prices[provider+"/"+model]; ok {
+		return price
+	}
+	return q.Prices[provider]
+}
+
+// RetrievalConfig controls how long pages are split into overlapping chunks,
+// embedded and searched so that only the relevant chunks reach the prompt.
+// Retrieval is off when no provider has an embedding model.
+type RetrievalConfig struct {
+	EmbeddingProvider string
+	// MinPageTokens is the page size from which retrieval is used, shorter
+	// pages are sent whole
+	MinPageTokens int
+	ChunkTokens   int
+	ChunkOverlap  int
+	TopK          int
+	// VectorBackend stores the pages users save to their knowledge base:
+	// "memory", "redis" or "pgvector", which needs the postgres storage
+	// backend. It follows the storage backend when unset.
+	VectorBackend string
+	KnowledgeTopK int
+}
+
+// AttachmentConfig limits the images attached to questions. MaxBytes
+// applies to each decoded image.
+type AttachmentConfig struct {
+	MaxBytes      int
+	MaxPerMessage int
 }
 
 type RedisConfig struct {
@@ -48,66 +170,105 @@ type RedisConfig struct {
 }
 
 func Load() *Config {
-	// Load default OpenAI config for backward compatibility
-	openaiConfig := LLMConfig{
-		Provider:    "openai",
-		APIKey:      getEnv("OPENAI_API_KEY", ""),
-		BaseURL:     getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"),
-		Model:       getEnv("OPENAI_MODEL", "gpt-3.5-turbo"),
-		MaxTokens:   getEnvAsInt("OPENAI_MAX_TOKENS", 1000),
-		Temperature: getEnvAsFloat("OPENAI_TEMPERATURE", 0.7),
-		IsDefault:   true,
-	}
-
-	// Load additional LLM providers from environment variables
-	// This is a simplified approach - in production, you might want to load from a config file
-	llmConfigs := []LLMConfig{openaiConfig}
-
-	// Example for DeepSeek
-	if deepseekAPIKey := getEnv("DEEPSEEK_API_KEY", ""); deepseekAPIKey != "" {
-		deepseekConfig := LLMConfig{
-			Provider:    "deepseek",
-			APIKey:      deepseekAPIKey,
-			BaseURL:     getEnv("DEEPSEEK_BASE_URL", "https://api.deepseek.com/v1"),
-			Model:       getEnv("DEEPSEEK_MODEL", "deepseek-chat"),
-			MaxTokens:   getEnvAsInt("DEEPSEEK_MAX_TOKENS", 1000),
-			Temperature: getEnvAsFloat("DEEPSEEK_TEMPERATURE", 0.7),
-			IsDefault:   false,
+	// Built-in endpoints are enabled by their API key, or by their server URL
+	// for locally hosted models which need no key
+	builtins := []struct {
+		enabledBy string
+		defaults  LLMConfig
+	}{
+		{"OPENAI_API_KEY", LLMConfig{Provider: "openai", Type: "openai", BaseURL: "https://api.openai.com/v1", Model: "gpt-3.5-turbo", ContextWindow: 16385, EmbeddingModel: "text-embedding-3-small", JSONMode: "object", Tools: true, StreamUsage: true, IsDefault: true}},
+		{"DEEPSEEK_API_KEY", LLMConfig{Provider: "deepseek", Type: "openai", BaseURL: "https://api.deepseek.com/v1", Model: "deepseek-chat", ContextWindow: 65536, JSONMode: "object", Tools: true, StreamUsage: true}},
+		{"DOUBAN_API_KEY", LLMConfig{Provider: "douban", Type: "openai", BaseURL: "https://api.douban.com/v1", Model: "douban-chat", ContextWindow: 8192}},
+		{"ANTHROPIC_API_KEY", LLMConfig{Provider: "anthropic", Type: "anthropic", BaseURL: "https://api.anthropic.com", Model: "claude-3-5-sonnet-latest", ContextWindow: 200000, Vision: true}},
+		{"OLLAMA_BASE_URL", LLMConfig{Provider: "ollama", Type: "ollama", Model: "llama3.1", ContextWindow: 4096}},
+		{"LLAMACPP_BASE_URL", LLMConfig{Provider: "llamacpp", Type: "openai", Model: "local-model", ContextWindow: 4096, JSONMode: "schema"}},
+	}
+
+	var llmConfigs []LLMConfig
+	for _, builtin := range builtins {
+		if getEnv(builtin.enabledBy, "") != "" {
+			llmConfigs = append(llmConfigs, loadLLMConfig(builtin.defaults))
 		}
-		llmConfigs = append(llmConfigs, deepseekConfig)
-	}
-
-	// Example for Douban
-	if doubanAPIKey := getEnv("DOUBAN_API_KEY", ""); doubanAPIKey != "" {
-		doubanConfig := LLMConfig{
-			Provider:    "douban",
-			APIKey:      doubanAPIKey,
-			BaseURL:     getEnv("DOUBAN_BASE_URL", "https://api.douban.com/v1"),
-			Model:       getEnv("DOUBAN_MODEL", "douban-chat"),
-			MaxTokens:   getEnvAsInt("DOUBAN_MAX_TOKENS", 1000),
-			Temperature: getEnvAsFloat("DOUBAN_TEMPERATURE", 0.7),
-			IsDefault:   false,
+	}
+
+	// Any other endpoint is declared by name, e.g. LLM_PROVIDERS=groq,together
+	// with GROQ_BASE_URL, GROQ_API_KEY, GROQ_MODEL and so on
+	for _, name := range splitList(getEnv("LLM_PROVIDERS", "")) {
+		llmConfigs = append(llmConfigs, loadLLMConfig(LLMConfig{Provider: name, Type: "openai", ContextWindow: 8192}))
+	}
+
+	if defaultProvider := getEnv("LLM_DEFAULT_PROVIDER", ""); defaultProvider != "" {
+		for i := range llmConfigs {
+			llmConfigs[i].IsDefault = llmConfigs[i].Provider == defaultProvider
 		}
-		llmConfigs = append(llmConfigs, doubanConfig)
 	}
 
+	// Pages are embedded with the first endpoint that has an embedding model
+	// unless one is chosen explicitly
+	embeddingProvider := getEnv("RETRIEVAL_EMBEDDING_PROVIDER", "")
+	for _, llmConfig := range llmConfigs {
+		if embeddingProvider == "" && llmConfig.EmbeddingModel != "" {
+			embeddingProvider = llmConfig.Provider
+		}
+	}
+
+	databaseURL := getEnv("DATABASE_URL", "")
+	storageBackend := getEnv("STORAGE_BACKEND", defaultStorageBackend(databaseURL))
+
 	return &Config{
 		Server: ServerConfig{
-			Port:         getEnv("PORT", "8080"),
-			Host:         getEnv("HOST", "localhost"),
-			ReadTimeout:  getEnvAsInt("READ_TIMEOUT", 30),
-			WriteTimeout: getEnvAsInt("WRITE_TIMEOUT", 30),
+			Port:           getEnv("PORT", "8080"),
+			Host:           getEnv("HOST", "localhost"),
+			ReadTimeout:    getEnvAsInt("READ_TIMEOUT", 30),
+			WriteTimeout:   getEnvAsInt("WRITE_TIMEOUT", 30),
+			AllowedOrigins: splitList(getEnv("WS_ALLOWED_ORIGINS", "")),
 		},
 		Database: DatabaseConfig{
-			URL:                getEnv("DATABASE_URL", ""),
+			URL:                databaseURL,
 			MaxConnections:     getEnvAsInt("DB_MAX_CONNECTIONS", 25),
 			MaxIdleConnections: getEnvAsInt("DB_MAX_IDLE_CONNECTIONS", 5),
 		},
+		Storage: StorageConfig{
+			Backend: storageBackend,
+		},
 		Auth: AuthConfig{
 			JWTSecret:     getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
 			JWTExpiration: getEnvAsInt("JWT_EXPIRATION", 24),
 		},
 		LLMs: llmConfigs,
+		Resilience: ResilienceConfig{
+			MaxRetries:        getEnvAsInt("LLM_MAX_RETRIES", 2),
+			RetryBaseDelay:    getEnvAsInt("LLM_RETRY_BASE_DELAY_MS", 500),
+			RetryMaxDelay:     getEnvAsInt("LLM_RETRY_MAX_DELAY_MS", 10000),
+			BreakerThreshold:  getEnvAsInt("LLM_BREAKER_THRESHOLD", 5),
+			BreakerCooldown:   getEnvAsInt("LLM_BREAKER_COOLDOWN", 30),
+			FirstTokenTimeout: getEnvAsInt("LLM_FIRST_TOKEN_TIMEOUT", 60),
+		},
+		Quota: QuotaConfig{
+			Prices:               loadPrices(getEnv("LLM_PRICES", "")),
+			SessionDailyTokens:   getEnvAsInt("QUOTA_SESSION_DAILY_TOKENS", 0),
+			SessionMonthlyTokens: getEnvAsInt("QUOTA_SESSION_MONTHLY_TOKENS", 0),
+			UserDailyTokens:      getEnvAsInt("QUOTA_USER_DAILY_TOKENS", 0),
+			UserMonthlyTokens:    getEnvAsInt("QUOTA_USER_MONTHLY_TOKENS", 0),
+			SessionDailyCost:     getEnvAsFloat("QUOTA_SESSION_DAILY_COST", 0),
+			SessionMonthlyCost:   getEnvAsFloat("QUOTA_SESSION_MONTHLY_COST", 0),
+			UserDailyCost:        getEnvAsFloat("QUOTA_USER_DAILY_COST", 0),
+			UserMonthlyCost:      getEnvAsFloat("QUOTA_USER_MONTHLY_COST", 0),
+			DowngradeProvider:    getEnv("QUOTA_DOWNGRADE_PROVIDER", ""),
+		},
+		Retrieval: RetrievalConfig{
+			EmbeddingProvider: embeddingProvider,
+			MinPageTokens:     getEnvAsInt("RETRIEVAL_MIN_PAGE_TOKENS", 1500),
+			ChunkTokens:       getEnvAsInt("RETRIEVAL_CHUNK_TOKENS", 300),
+			ChunkOverlap:      getEnvAsInt("RETRIEVAL_CHUNK_OVERLAP", 50),
+			TopK:              getEnvAsInt("RETRIEVAL_TOP_K", 6),
+			VectorBackend:     getEnv("VECTOR_BACKEND", defaultVectorBackend(storageBackend)),
+			KnowledgeTopK:     getEnvAsInt("KNOWLEDGE_TOP_K", 8),
+		},
+		Attachments: AttachmentConfig{
+			MaxBytes:      getEnvAsInt("ATTACHMENT_MAX_BYTES", 5*1024*1024),
+			MaxPerMessage: getEnvAsInt("ATTACHMENT_MAX_PER_MESSAGE", 4),
+		},
 		Redis: RedisConfig{
 			URL:      getEnv("REDIS_URL", "localhost:6379"),
 			Password: getEnv("REDIS_PASSWORD", ""),
@@ -116,6 +277,117 @@ func Load() *Config {
 	}
 }
 
+// loadLLMConfig reads the settings of the named endpoint from variables
+// prefixed with its upper-cased name, falling back to defaults
+func loadLLMConfig(defaults LLMConfig) LLMConfig {
+	prefix := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(defaults.Provider)) + "_"
+
+	return LLMConfig{
+		Provider:    defaults.Provider,
+		Type:        strings.ToLower(getEnv(prefix+"TYPE", defaults.Type)),
+		APIKey:      getEnv(prefix+"API_KEY", defaults.APIKey),
+		BaseURL:     getEnv(prefix+"BASE_URL", defaults.BaseURL),
+		Model:       getEnv(prefix+"MODEL", defaults.Model),
+		MaxTokens:   getEnvAsInt(prefix+"MAX_TOKENS", 1000),
+		Temperature: getEnvAsFloat(prefix+"TEMPERATURE", 0.7),
+		IsDefault:   defaults.IsDefault,
+		APIType:     getEnv(prefix+"API_TYPE", defaults.APIType),
+		APIVersion:  getEnv(prefix+"API_VERSION", defaults.APIVersion),
+		Fallbacks:   splitList(getEnv(prefix+"FALLBACKS", "")),
+
+		ContextWindow:  getEnvAsInt(prefix+"CONTEXT_WINDOW", defaults.ContextWindow),
+		EmbeddingModel: getEnv(prefix+"EMBEDDING_MODEL", defaults.EmbeddingModel),
+		JSONMode:       strings.ToLower(getEnv(prefix+"JSON_MODE", defaults.JSONMode)),
+		Tools:          getEnvAsBool(prefix+"TOOLS", defaults.Tools),
+		Vision:         getEnvAsBool(prefix+"VISION", defaults.Vision),
+		StreamUsage:    getEnvAsBool(prefix+"STREAM_USAGE", defaults.StreamUsage),
+	}
+}
+
+// defaultPrices covers the default models of the built-in providers, in USD
+// per million input and output tokens
+var defaultPrices = map[string]ModelPrice{
+	"openai/gpt-3.5-turbo":               {Input: 0.5, Output: 1.5},
+	"openai/gpt-4o-mini":                 {Input: 0.15, Output: 0.6},
+	"openai/gpt-4o":                      {Input: 2.5, Output: 10},
+	"deepseek/deepseek-chat":             {Input: 0.27, Output: 1.1},
+	"anthropic/claude-3-5-sonnet-latest": {Input: 3, Output: 15},
+}
+
+// loadPrices merges entries such as "openai/gpt-4o=2.5:10,groq=0.59:0.79"
+// over the default price table, ignoring malformed entries
+func loadPrices(value string) map[string]ModelPrice {
+	prices := make(map[string]ModelPrice, len(defaultPrices))
+	for key, price := range defaultPrices {
+		prices[key] = price
+	}
+
+	for _, entry := range splitList(value) {
+		key, rates, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		input, output, ok := strings.Cut(rates, ":")
+		if !ok {
+			continue
+		}
+		inputPrice, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+		if err != nil {
+			continue
+		}
+		outputPrice, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+		if err != nil {
+			continue
+		}
+		prices[strings.TrimSpace(key)] = ModelPrice{Input: inputPrice, Output: outputPrice}
+	}
+	return prices
+}
+
+// splitList parses a comma separated list, ignoring blank entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// defaultStorageBackend picks the durable store when a database is configured
+// and falls back to Redis otherwise. SQLite databases are given as sqlite: or
+// file: URLs or plain paths. Other schemes are returned as the backend name,
+// which the server rejects as unsupported.
+func defaultStorageBackend(databaseURL string) string {
+	scheme, _, hasScheme := strings.Cut(databaseURL, "://")
+	switch {
+	case databaseURL == "":
+		return "redis"
+	case !hasScheme || scheme == "sqlite" || scheme == "file":
+		return "sqlite"
+	case scheme == "postgres" || scheme == "postgresql":
+		return "postgres"
+	case scheme == "redis" || scheme == "rediss":
+		return "redis"
+	default:
+		return scheme
+	}
+}
+
+// defaultVectorBackend keeps saved pages next to the rest of the data where
+// the storage backend can hold vectors, and in memory otherwise
+func defaultVectorBackend(storageBackend string) string {
+	switch storageBackend {
+	case "postgres":
+		return "pgvector"
+	case "redis":
+		return "redis"
+	default:
+		return "memory"
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -132,6 +404,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsFloat(key string, defaultValue float64) float64 {
 	if value := os.Getenv(key); value != "" {
 		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+// imageTypes are the image formats accepted as attachments, which every
+// vision model reads
+var imageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+	"image/gif":  true,
+}
+
+// requestOverhead is accepted on top of the encoded images of a request
+// body, for the message text and the JSON or multipart framing around them
+const requestOverhead = 1 << 20
+
+// attachmentInput is an image attached to a message, either uploaded
+// beforehand and referenced by ID or sent inline as base64 or a data: URL,
+// as returned by the extension's tab capture
+type attachmentInput struct {
+	ID   string `json:"id,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// UploadAttachment stores an image for a later question in a conversation of
+// the session, from a multipart "file" field or a JSON body with base64 "data"
+func (h *Handlers) UploadAttachment(c *gin.Context) {
+	conversationID := c.Param("conversationId")
+
+	ctx := context.Background()
+	if err := h.AuthorizeConversation(ctx, c.GetString("session_id"), conversationID); err != nil {
+		c.Error(err)
+		return
+	}
+
+	h.limitBody(c, 1)
+	var data []byte
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := c.FormFile("file")
+		if err != nil {
+			if bodyTooLarge(err) {
+				c.Error(attachmentTooLarge(h.attachments.MaxBytes))
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A multipart upload needs a file field"})
+			return
+		}
+		if file.Size > int64(h.attachments.MaxBytes) {
+			c.Error(attachmentTooLarge(h.attachments.MaxBytes))
+			return
+		}
+		opened, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the uploaded file"})
+			return
+		}
+		defer opened.Close()
+		if data, err = io.ReadAll(opened); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the uploaded file"})
+			return
+		}
+	} else {
+		var req struct {
+			Data string `json:"data" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			if bodyTooLarge(err) {
+				c.Error(attachmentTooLarge(h.attachments.MaxBytes))
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var err error
+		if data, err = decodeImageData(req.Data); err != nil {
+			c.Error(middleware.NewAppError(http.StatusBadRequest, "INVALID_ATTACHMENT", err.Error()))
+			return
+		}
+	}
+
+	attachment, appErr := h.newAttachment(conversationID, data)
+	if appErr != nil {
+		c.Error(appErr)
+		return
+	}
+	if err := h.store.StoreAttachment(ctx, attachment); err != nil {
+		log.Printf("Failed to store attachment for conversation %s: %v", conversationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+
+	attachment.Data = nil
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// GetAttachment returns an image attached in a conversation of the session
+func (h *Handlers) GetAttachment(c *gin.Context) {
+	conversationID := c.Param("conversationId")
+
+	ctx := context.Background()
+	if err := h.AuthorizeConversation(ctx, c.GetString("session_id"), conversationID); err != nil {
+		c.Error(err)
+		return
+	}
+
+	attachment, err := h.store.GetAttachment(ctx, c.Param("attachmentId"))
+	if err != nil || attachment.ConversationID != conversationID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, attachment.MediaType, attachment.Data)
+}
+
+// messageAttachments resolves the images attached to a message. Uploaded
+// images must belong to the conversation, and inline ones are stored once
+// every image is known to be valid.
+func (h *Handlers) messageAttachments(ctx context.Context, conversationID string, inputs []attachmentInput) ([]*models.Attachment, error) {
+	if len(inputs) > h.attachments.MaxPerMessage {
+		return nil, middleware.NewAppError(http.StatusBadRequest, "TOO_MANY_ATTACHMENTS",
+			fmt.Sprintf("At most %d images can be attached to a message", h.attachments.MaxPerMessage))
+	}
+
+	attachments := make([]*models.Attachment, 0, len(inputs))
+	var inline []*models.Attachment
+	for _, input := range inputs {
+		if input.ID != "" {
+			attachment, err := h.store.GetAttachment(ctx, input.ID)
+			if err != nil || attachment.ConversationID != conversationID {
+				return nil, middleware.NewAppError(http.StatusNotFound, "ATTACHMENT_NOT_FOUND", "Attachment not found: "+input.ID)
+			}
+			attachments = append(attachments, attachment)
+			continue
+		}
+
+		data, err := decodeImageData(input.Data)
+		if err != nil {
+			return nil, middleware.NewAppError(http.StatusBadRequest, "INVALID_ATTACHMENT", err.Error())
+		}
+		attachment, appErr := h.newAttachment(conversationID, data)
+		if appErr != nil {
+			return nil, appErr
+		}
+		attachments = append(attachments, attachment)
+		inline = append(inline, attachment)
+	}
+
+	for _, attachment := range inline {
+		if err := h.store.StoreAttachment(ctx, attachment); err != nil {
+			return nil, fmt.Errorf("failed to store attachment: %w", err)
+		}
+	}
+	return attachments, nil
+}
+
+// newAttachment checks the size and format of an image. The format is
+// sniffed from the data rather than trusted from the client.
+func (h *Handlers) newAttachment(conversationID string, data []byte) (*models.Attachment, *middleware.AppError) {
+	if len(data) == 0 {
+		return nil, middleware.NewAppError(http.StatusBadRequest, "INVALID_ATTACHMENT", "The image is empty")
+	}
+	if len(data) > h.attachments.MaxBytes {
+		return nil, attachmentTooLarge(h.attachments.MaxBytes)
+	}
+
+	mediaType := http.DetectContentType(data)
+	if !imageTypes[mediaType] {
+		return nil, middleware.NewAppError(http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE",
+			"Only PNG, JPEG, WebP and GIF images can be attached, got "+mediaType)
+	}
+	return models.NewAttachment(conversationID, mediaType, data), nil
+}
+
+func attachmentTooLarge(maxBytes int) *middleware.AppError {
+	return middleware.NewAppError(http.StatusRequestEntityTooLarge, "ATTACHMENT_TOO_LARGE",
+		fmt.Sprintf("Images are limited to %d bytes", maxBytes))
+}
+
+// limitBody caps the request body before it is read, so that a body too
+// large fails while reading instead of being buffered whole. images is the
+// number of images the body may carry in base64.
+func (h *Handlers) limitBody(c *gin.Context, images int) {
+	limit := int64(h.attachments.MaxBytes)*int64(images)*4/3 + requestOverhead
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+}
+
+// bodyTooLarge reports whether reading a body failed on its limit
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// decodeImageData decodes base64 image data, with or without a data: URL prefix
+func decodeImageData(data string) ([]byte, error) {
+	if strings.HasPrefix(data, "data:") {
+		comma := strings.Index(data, ",")
+		if comma < 0 || !strings.HasSuffix(data[:comma], ";base64") {
+			return nil, fmt.Errorf("the data URL is not base64 encoded")
+		}
+		data = data[comma+1:]
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("the image is not valid base64: %v", err)
+	}
+	return decoded, nil
+}
+
+// questionImages loads the images attached to a question for the prompt.
+// Images that are gone are left out.
+func (h *Handlers) questionImages(ctx context.Context, question *models.Message) []llm.Image {
+	var images []llm.Image
+	for _, id := range metadataStrings(question, "attachments") {
+		attachment, err := h.store.GetAttachment(ctx, id)
+		if err != nil {
+			log.Printf("Failed to load attachment %s of message %s: %v", id, question.ID, err)
+			continue
+		}
+		images = append(images, llm.Image{MediaType: attachment.MediaType, Data: attachment.Data})
+	}
+	return images
+}
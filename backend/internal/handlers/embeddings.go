@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+// maxEmbeddingInputs caps the texts of a single embeddings request
+const maxEmbeddingInputs = 256
+
+type embeddingData struct {
+	Object    string    `json:"object"`
+	Index     int       `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+type embeddingUsage struct {
+	PromptTokens int  `json:"prompt_tokens"`
+	TotalTokens  int  `json:"total_tokens"`
+	Estimated    bool `json:"estimated"`
+}
+
+// parseEmbeddingInput accepts a single string or an array of strings, like
+// the OpenAI embeddings API
+func parseEmbeddingInput(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, nil
+	}
+
+	var texts []string
+	if err := json.Unmarshal(raw, &texts); err != nil {
+		return nil, errors.New("input must be a string or an array of strings")
+	}
+	return texts, nil
+}
+
+// CreateEmbeddings embeds one or more texts, for semantic search over saved
+// pages. The response follows the shape of the OpenAI embeddings API.
+func (h *Handlers) CreateEmbeddings(c *gin.Context) {
+	var req struct {
+		Input      json.RawMessage `json:"input" binding:"required"`
+		Provider   string          `json:"provider,omitempty"`
+		Dimensions int             `json:"dimensions,omitempty"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	texts, err := parseEmbeddingInput(req.Input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(texts) == 0 || len(texts) > maxEmbeddingInputs {
+		c.Error(middleware.NewAppErrorWithDetails(http.StatusBadRequest, "INVALID_INPUT",
+			fmt.Sprintf("Input must contain between 1 and %d texts", maxEmbeddingInputs), gin.H{"max_inputs": maxEmbeddingInputs}))
+		return
+	}
+
+	sessionID := c.GetString("session_id")
+	userID := c.GetString("user_id")
+	ctx := context.Background()
+
+	if err := h.checkQuota(ctx, sessionID, userID); err != nil {
+		var appErr *middleware.AppError
+		if errors.As(err, &appErr) {
+			c.Error(appErr)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check quota"})
+		return
+	}
+
+	var options []llm.EmbedOption
+	if req.Dimensions > 0 {
+		options = append(options, llm.WithDimensions(req.Dimensions))
+	}
+
+	embeddings, err := h.llmClient.Embed(ctx, req.Provider, texts, options...)
+	if err != nil {
+		var notFound *llm.ProviderNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			c.Error(middleware.NewAppError(http.StatusBadRequest, "PROVIDER_NOT_FOUND", err.Error()))
+		case errors.Is(err, llm.ErrEmbeddingsNotSupported):
+			c.Error(middleware.NewAppError(http.StatusBadRequest, "EMBEDDINGS_NOT_SUPPORTED", "The provider does not support embeddings"))
+		default:
+			log.Printf("Failed to create embeddings: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create embeddings"})
+		}
+		return
+	}
+
+	h.recordEmbeddingUsage(ctx, sessionID, userID, "", embeddings)
+
+	data := make([]embeddingData, len(embeddings.Vectors))
+	for i, vector := range embeddings.Vectors {
+		data[i] = embeddingData{Object: "embedding", Index: i, Embedding: vector}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":     "list",
+		"data":       data,
+		"provider":   embeddings.Provider,
+		"model":      embeddings.Model,
+		"dimensions": embeddings.Dimensions,
+		"usage": embeddingUsage{
+			PromptTokens: embeddings.Usage.PromptTokens,
+			TotalTokens:  embeddings.Usage.TotalTokens,
+			Estimated:    embeddings.Usage.Estimated,
+		},
+	})
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/prompt"
+	"github.com/jzhang405/SmartChrome/backend/pkg/jsonschema"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+// extractInstructions describes the extraction task to the model.
+const extractInstructions = "You extract structured data from the web page the user is reading. " +
+	"Use only information found on the page and leave out what the page does not contain."
+
+// ExtractData extracts data matching a JSON schema from the page of a
+// conversation of the session, such as tables, contact details or product
+// specifications, and returns it parsed
+func (h *Handlers) ExtractData(c *gin.Context) {
+	conversationID := c.Param("conversationId")
+
+	var req struct {
+		Instructions string          `json:"instructions" binding:"required"`
+		Schema       json.RawMessage `json:"schema" binding:"required"`
+		Name         string          `json:"name,omitempty"`
+		Provider     string          `json:"provider,omitempty"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := jsonschema.Parse(req.Schema); err != nil {
+		c.Error(middleware.NewAppError(http.StatusBadRequest, "INVALID_SCHEMA", err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), generationTimeout)
+	defer cancel()
+	if err := h.AuthorizeConversation(ctx, c.GetString("session_id"), conversationID); err != nil {
+		c.Error(err)
+		return
+	}
+	conversation, err := h.store.GetConversation(ctx, conversationID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	webpage, err := h.store.GetWebpageContent(ctx, conversationID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webpage content not found"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	providerName, downgraded, err := h.quotaProvider(ctx, conversation.SessionID, userID, req.Provider)
+	if err != nil {
+		var appErr *middleware.AppError
+		if errors.As(err, &appErr) {
+			c.Error(appErr)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check quota"})
+		return
+	}
+
+	limits := h.llmClient.Limits(providerName)
+	page := prompt.Page{Title: webpage.Title, URL: webpage.URL, Text: webpage.ExtractedText}
+	if page.Title == "" {
+		page.Title = conversation.Title
+	}
+	if page.URL == "" {
+		page.URL = conversation.URL
+	}
+	messages, _ := prompt.Build(prompt.Request{
+		Instructions: extractInstructions,
+		Page:         page,
+		Question:     req.Instructions,
+		Budget:       prompt.Budget{ContextWindow: limits.ContextWindow, AnswerTokens: limits.MaxOutputTokens},
+		Uncited:      true,
+	})
+
+	var options []llm.GenerateOption
+	if limits.MaxOutputTokens > 0 {
+		options = append(options, llm.WithMaxTokens(limits.MaxOutputTokens))
+	}
+
+	result, err := h.llmClient.ChatJSON(ctx, providerName, messages, llm.ResponseFormat{Name: req.Name, Schema: req.Schema}, options...)
+	// Failed and timed out attempts may have been billed too, and the
+	// context may be done already
+	if result != nil && result.Usage.TotalTokens > 0 {
+		cost := h.quota.Price(result.Provider, result.Model).Cost(result.Usage.PromptTokens, result.Usage.CompletionTokens)
+		record := models.NewUsageRecord(conversation.SessionID, userID, conversationID, "", result.Provider, result.Model,
+			result.Usage.PromptTokens, result.Usage.CompletionTokens, cost)
+		record.Estimated = result.Usage.Estimated
+		if err := h.store.RecordUsage(context.Background(), record); err != nil {
+			log.Printf("Failed to record extraction usage for conversation %s: %v", conversationID, err)
+		}
+	}
+	if err != nil {
+		var invalid *llm.InvalidOutputError
+		var notFound *llm.ProviderNotFoundError
+		switch {
+		case errors.As(err, &invalid):
+			c.Error(middleware.NewAppErrorWithDetails(http.StatusUnprocessableEntity, "INVALID_OUTPUT",
+				"The model did not return data matching the schema", gin.H{"reason": invalid.Err.Error(), "output": invalid.Output}))
+		case errors.As(err, &notFound):
+			c.Error(middleware.NewAppError(http.StatusBadRequest, "PROVIDER_NOT_FOUND", err.Error()))
+		default:
+			log.Printf("Failed to extract data for conversation %s: %v", conversationID, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to extract data"})
+		}
+		return
+	}
+
+	response := gin.H{
+		"data":     result.Value,
+		"provider": result.Provider,
+		"model":    result.Model,
+		"attempts": result.Attempts,
+		"usage": gin.H{
+			"prompt_tokens":     result.Usage.PromptTokens,
+			"completion_tokens": result.Usage.CompletionTokens,
+			"total_tokens":      result.Usage.TotalTokens,
+			"estimated":         result.Usage.Estimated,
+		},
+	}
+	if downgraded {
+		response["downgraded_to"] = providerName
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/prompt"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/internal/tools"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+const (
+	// generationTimeout bounds a single answer generation, including streaming.
+	generationTimeout = 5 * time.Minute
+	// pageInstructions describes the assistant's task to the model.
+	pageInstructions = "You are a helpful assistant that answers questions about the web page the user is reading. " +
+		"Base your answers on the page content when it is relevant and say so when the page does not contain the answer."
+)
+
+// generateAnswer builds the chat context for a stored user question, streams the LLM
+// output to the client subscribed to the question and persists the reply.
+// The session owning the conversation may cancel it, which ends the stream
+// without storing a reply.
+func (h *Handlers) generateAnswer(conversation *models.Conversation, question *models.Message, providerName, userID string) {
+	ctx, done := h.startGeneration(conversation.SessionID, question.ID)
+	defer done()
+
+	conversationID := conversation.ID
+
+	provider, exists := h.resolveProvider(providerName)
+	if !exists {
+		log.Printf("No LLM provider available for conversation %s", conversationID)
+		h.streamManager.SendError(ctx, conversationID, question.ID, "No LLM provider available")
+		return
+	}
+
+	history, err := h.store.GetConversationMessages(ctx, conversationID, 0, 0)
+	if err != nil {
+		log.Printf("Failed to load history for conversation %s: %v", conversationID, err)
+		history = nil
+	}
+
+	// Room is left in the context window for the tools the model may call
+	limits := h.llmClient.Limits(providerName)
+	budget := prompt.Budget{
+		ContextWindow: limits.ContextWindow,
+		AnswerTokens:  limits.MaxOutputTokens,
+		ToolTokens:    h.toolRegistry.Reserve(limits.ContextWindow),
+	}
+	meter := h.usageMeter(conversation.SessionID, userID, conversationID)
+	images := h.questionImages(ctx, question)
+	var messages []llm.ChatMessage
+	var passages []prompt.Passage
+	if scope, _ := question.GetMetadata("scope"); scope == ScopeKnowledge {
+		excerpts := h.knowledgeExcerpts(ctx, meter, knowledgeOwner(conversation.SessionID), question)
+		messages, passages = buildKnowledgeMessages(excerpts, history, question, images, budget)
+	} else {
+		// Webpage content is optional, a conversation may have been created without it
+		webpage, err := h.store.GetWebpageContent(ctx, conversationID)
+		if err != nil {
+			webpage = nil
+		}
+		messages, passages = buildChatMessages(conversation, webpage, h.retrieveExcerpts(ctx, meter, webpage, question), history, question, images, budget)
+	}
+
+	var options []llm.GenerateOption
+	if limits.MaxOutputTokens > 0 {
+		options = append(options, llm.WithMaxTokens(limits.MaxOutputTokens))
+	}
+
+	response := models.NewLLMResponse(question.ID, conversationID+":"+question.ID, provider.GetModel())
+
+	// The model may call backend tools, such as reading another open tab,
+	// before it answers
+	invocation := tools.Invocation{
+		SessionID:      conversation.SessionID,
+		UserID:         userID,
+		ConversationID: conversationID,
+		Owner:          knowledgeOwner(conversation.SessionID),
+		OpenTabs:       metadataStrings(question, "open_tabs"),
+		Meter:          meter,
+	}
+	// Reasoning models think before they answer, which is streamed and
+	// stored apart from the answer
+	result, err := h.toolRegistry.Run(ctx, h.llmClient, providerName, messages, invocation, tools.Stream{
+		Content: func(content string) {
+			response.AddContent(content)
+			h.streamManager.SendStreamResponse(ctx, conversationID, question.ID, content, false)
+		},
+		Reasoning: func(reasoning string) {
+			response.AddReasoning(reasoning)
+			h.streamManager.SendThinking(ctx, conversationID, question.ID, reasoning)
+		},
+	}, options...)
+
+	// The provider that answers may differ from the requested one after a fallback
+	answeredBy := provider.GetProvider()
+	if result.Provider != "" {
+		answeredBy, response.ModelUsed = result.Provider, result.Model
+	}
+	response.SetUsage(result.Usage.PromptTokens, result.Usage.CompletionTokens)
+
+	cancelled := errors.Is(ctx.Err(), context.Canceled)
+	if cancelled || err != nil {
+		// The provider may have billed an interrupted answer, which counts
+		// against the quota. The generation context may be done already.
+		if result.Usage.TotalTokens > 0 {
+			h.recordUsage(context.Background(), conversation, userID, response, answeredBy, result.Usage.Estimated)
+		}
+		if cancelled {
+			log.Printf("LLM generation cancelled for conversation %s", conversationID)
+			h.streamManager.SendCancelled(ctx, conversationID, question.ID)
+			return
+		}
+		log.Printf("LLM generation failed for conversation %s: %v", conversationID, err)
+		h.streamManager.SendError(ctx, conversationID, question.ID, "Failed to generate response")
+		return
+	}
+
+	// The reply is stored before the stream completes, so a client that
+	// reloads the conversation on completion finds it
+	response.Complete()
+	if err := h.store.StoreLLMResponse(ctx, response); err != nil {
+		log.Printf("Failed to store LLM response %s: %v", response.ID, err)
+	}
+	h.recordUsage(ctx, conversation, userID, response, answeredBy, result.Usage.Estimated)
+
+	reply := models.NewMessage(conversationID, models.LLMReply, response.Content, 0)
+	reply.SetMetadata("llm_response_id", response.ID)
+	reply.SetMetadata("question_id", question.ID)
+	reply.SetMetadata("provider", answeredBy)
+	reply.SetMetadata("model", response.ModelUsed)
+	reply.SetMetadata("tokens_used", response.TokensUsed)
+	reply.SetMetadata("prompt_tokens", response.PromptTokens)
+	reply.SetMetadata("completion_tokens", response.CompletionTokens)
+	if result.Usage.Estimated {
+		reply.SetMetadata("usage_estimated", true)
+	}
+	citations := prompt.Citations(response.Content, passages)
+	if len(citations) > 0 {
+		reply.SetMetadata("citations", citations)
+	}
+	if len(result.Calls) > 0 {
+		reply.SetMetadata("tool_calls", result.Calls)
+	}
+	if response.Reasoning != "" {
+		reply.SetMetadata("reasoning", response.Reasoning)
+	}
+
+	if err := h.store.AppendMessage(ctx, reply); err != nil {
+		log.Printf("Failed to store reply for conversation %s: %v", conversationID, err)
+	}
+
+	final := map[string]interface{}{"reply_id": reply.ID}
+	if len(citations) > 0 {
+		final["citations"] = citations
+	}
+	h.streamManager.SendComplete(ctx, conversationID, question.ID, final)
+}
+
+// resolveProvider returns the named provider, or the default one when the
+// name is empty or unknown.
+func (h *Handlers) resolveProvider(name string) (llm.LLMProvider, bool) {
+	if name != "" {
+		if provider, exists := h.llmClient.GetProvider(name); exists {
+			return provider, true
+		}
+	}
+	return h.llmClient.GetDefaultProvider()
+}
+
+// retrieveExcerpts returns the chunks of a long page most relevant to the
+// question. Without a retriever, or when retrieval fails, it returns nothing
+// and the prompt falls back to the page text.
+func (h *Handlers) retrieveExcerpts(ctx context.Context, meter retrieval.Meter, webpage *models.WebpageContent, question *models.Message) []prompt.Excerpt {
+	if h.retriever == nil || webpage == nil {
+		return nil
+	}
+
+	chunks, err := h.retriever.Retrieve(ctx, meter, webpage, question.Content)
+	if err != nil {
+		log.Printf("Failed to retrieve page chunks for conversation %s: %v", question.ConversationID, err)
+		return nil
+	}
+
+	excerpts := make([]prompt.Excerpt, 0, len(chunks))
+	for _, chunk := range chunks {
+		excerpts = append(excerpts, prompt.Excerpt{Offset: retrieval.CharOffset(webpage.ExtractedText, chunk.Start), Text: chunk.Text})
+	}
+	return excerpts
+}
+
+// buildChatMessages fits the page context, the conversation history and the
+// new question with its images into the context window of the model that
+// will answer. It also returns the numbered page passages the answer may cite.
+func buildChatMessages(conversation *models.Conversation, webpage *models.WebpageContent, excerpts []prompt.Excerpt, history []*models.Message, question *models.Message, images []llm.Image, budget prompt.Budget) ([]llm.ChatMessage, []prompt.Passage) {
+	page := prompt.Page{Title: conversation.Title, URL: conversation.URL, Excerpts: excerpts}
+	if webpage != nil {
+		if webpage.Title != "" {
+			page.Title = webpage.Title
+		}
+		if webpage.URL != "" {
+			page.URL = webpage.URL
+		}
+		page.Text = webpage.ExtractedText
+	}
+
+	return prompt.Build(prompt.Request{
+		Instructions: pageInstructions,
+		Page:         page,
+		History:      previousTurns(history, question),
+		Question:     question.Content,
+		Images:       images,
+		Budget:       budget,
+	})
+}
+
+// buildKnowledgeMessages fits excerpts of saved pages, the conversation
+// history and the new question into the context window of the model.
+func buildKnowledgeMessages(excerpts []prompt.Excerpt, history []*models.Message, question *models.Message, images []llm.Image, budget prompt.Budget) ([]llm.ChatMessage, []prompt.Passage) {
+	return prompt.Build(prompt.Request{
+		Instructions: knowledgeInstructions,
+		Page:         prompt.Page{Excerpts: excerpts},
+		History:      previousTurns(history, question),
+		Question:     question.Content,
+		Images:       images,
+		Budget:       budget,
+	})
+}
+
+// metadataStrings reads a list of strings from message metadata, which
+// decodes as []interface{} after a round trip through JSON
+func metadataStrings(message *models.Message, key string) []string {
+	value, _ := message.GetMetadata(key)
+	switch list := value.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		strs := make([]string, 0, len(list))
+		for _, item := range list {
+			if str, ok := item.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// previousTurns converts the questions and replies stored before the
+// question into chat turns. Messages stored after it, such as other
+// questions asked meanwhile and their answers, are left out.
+func previousTurns(history []*models.Message, question *models.Message) []llm.ChatMessage {
+	var previous []llm.ChatMessage
+	for _, message := range history {
+		if message.SequenceNumber >= question.SequenceNumber {
+			continue
+		}
+		switch message.Type {
+		case models.UserQuestion:
+			previous = append(previous, llm.ChatMessage{Role: llm.RoleUser, Content: message.Content})
+		case models.LLMReply:
+			previous = append(previous, llm.ChatMessage{Role: llm.RoleAssistant, Content: message.Content})
+		}
+	}
+	return previous
+}
@@ -2,33 +2,61 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/config"
 	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
 	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/internal/tools"
 	"github.com/jzhang405/SmartChrome/backend/internal/websocket"
-	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
 	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 100
 )
 
 type Handlers struct {
-	sessionCache     *cache.SessionCache
-	jwtMiddleware    *middleware.JWTMiddleware
-	streamManager    *websocket.StreamManager
-	llmClient        *llm.LLMClient
+	store         storage.Store
+	jwtMiddleware *middleware.JWTMiddleware
+	streamManager *websocket.StreamManager
+	llmClient     *llm.LLMClient
+	quota         config.QuotaConfig
+	attachments   config.AttachmentConfig
+	retriever     *retrieval.Retriever
+	toolRegistry  *tools.Registry
+	// generations are the answers being generated by question ID
+	generations      map[string]generation
+	generationsMutex sync.Mutex
 }
 
-func NewHandlers(redisClient *cache.RedisClient, jwtMiddleware *middleware.JWTMiddleware, llmClient *llm.LLMClient) *Handlers {
-	sessionCache := cache.NewSessionCache(redisClient)
+// NewHandlers creates the HTTP handlers. The retriever is optional, without
+// it long pages are trimmed to the sections sharing words with the question.
+// Without a tool registry the model answers without tools.
+func NewHandlers(store storage.Store, jwtMiddleware *middleware.JWTMiddleware, llmClient *llm.LLMClient, quota config.QuotaConfig, attachments config.AttachmentConfig, retriever *retrieval.Retriever, toolRegistry *tools.Registry) *Handlers {
 	streamManager := websocket.NewStreamManager()
+	if toolRegistry == nil {
+		toolRegistry = tools.NewRegistry()
+	}
 
 	return &Handlers{
-		sessionCache:  sessionCache,
+		store:         store,
 		jwtMiddleware: jwtMiddleware,
 		streamManager: streamManager,
 		llmClient:     llmClient,
+		quota:         quota,
+		attachments:   attachments,
+		retriever:     retriever,
+		toolRegistry:  toolRegistry,
+		generations:   make(map[string]generation),
 	}
 }
 
@@ -37,6 +65,7 @@ func (h *Handlers) HealthCheck(c *gin.Context) {
 		"status":    "healthy",
 		"timestamp": "2025-10-16T00:00:00Z",
 		"version":   "1.0.0",
+		"providers": h.llmClient.Health(),
 	})
 }
 
@@ -46,7 +75,7 @@ func (h *Handlers) CreateSession(c *gin.Context) {
 	
 	// Store session in cache
 	ctx := context.Background()
-	if err := h.sessionCache.StoreSession(ctx, session); err != nil {
+	if err := h.store.StoreSession(ctx, session); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
@@ -68,7 +97,7 @@ func (h *Handlers) GetSession(c *gin.Context) {
 	sessionID := c.Param("sessionId")
 	
 	ctx := context.Background()
-	session, err := h.sessionCache.GetSession(ctx, sessionID)
+	session, err := h.store.GetSession(ctx, sessionID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
 		return
@@ -77,11 +106,24 @@ func (h *Handlers) GetSession(c *gin.Context) {
 	c.JSON(http.StatusOK, session)
 }
 
+// DeleteSession deletes the session of the token along with the pages it
+// saved to the knowledge base
 func (h *Handlers) DeleteSession(c *gin.Context) {
 	sessionID := c.Param("sessionId")
+	if sessionID != c.GetString("session_id") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
 	
 	ctx := context.Background()
-	if err := h.sessionCache.DeleteSession(ctx, sessionID); err != nil {
+	if h.retriever != nil {
+		if err := h.retriever.DeleteOwner(ctx, knowledgeOwner(sessionID)); err != nil {
+			log.Printf("Failed to delete the saved pages of session %s: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
+			return
+		}
+	}
+	if err := h.store.DeleteSession(ctx, sessionID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
 		return
 	}
@@ -113,11 +155,30 @@ func (h *Handlers) CreateConversation(c *gin.Context) {
 	
 	// Store conversation in cache
 	ctx := context.Background()
-	if err := h.sessionCache.StoreConversation(ctx, conversation); err != nil {
+	if err := h.store.StoreConversation(ctx, conversation); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
 		return
 	}
 
+	// Keep the extracted page so answers can be grounded in it
+	if req.WebpageContent != nil {
+		webpage := models.NewWebpageContent(req.URL, req.Title, req.WebpageContent.ExtractedText)
+		if req.WebpageContent.URL != "" {
+			webpage.URL = req.WebpageContent.URL
+		}
+		if req.WebpageContent.Title != "" {
+			webpage.Title = req.WebpageContent.Title
+		}
+		for key, value := range req.WebpageContent.Metadata {
+			webpage.SetMetadata(key, value)
+		}
+
+		if err := h.store.StoreWebpageContent(ctx, conversation.ID, webpage); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store webpage content"})
+			return
+		}
+	}
+
 	c.JSON(http.StatusCreated, conversation)
 }
 
@@ -125,7 +186,7 @@ func (h *Handlers) GetConversation(c *gin.Context) {
 	conversationID := c.Param("conversationId")
 	
 	ctx := context.Background()
-	conversation, err := h.sessionCache.GetConversation(ctx, conversationID)
+	conversation, err := h.store.GetConversation(ctx, conversationID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
 		return
@@ -136,73 +197,212 @@ func (h *Handlers) GetConversation(c *gin.Context) {
 
 func (h *Handlers) GetConversationMessages(c *gin.Context) {
 	conversationID := c.Param("conversationId")
-	// limit := c.DefaultQuery("limit", "50")
-	// offset := c.DefaultQuery("offset", "0")
-	
-	// Parse limit and offset
-	// In a real implementation, you would use these values for pagination
-	
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultMessagesLimit)))
+	if err != nil || limit < 1 || limit > maxMessagesLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+		return
+	}
+
 	ctx := context.Background()
-	messages, err := h.sessionCache.GetConversationMessages(ctx, conversationID, 0, 0)
+	if _, err := h.store.GetConversation(ctx, conversationID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	total, err := h.store.CountConversationMessages(ctx, conversationID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"messages": messages,
-		"total":    len(messages),
-	})
+	// The cursor is the sequence number of the last message already seen.
+	// Fetch one extra message to know whether another page exists.
+	var messages []*models.Message
+	if cursor := c.Query("cursor"); cursor != "" {
+		afterSequence, err := strconv.Atoi(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		messages, err = h.store.GetConversationMessagesAfter(ctx, conversationID, afterSequence, limit+1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+			return
+		}
+	} else {
+		messages, err = h.store.GetConversationMessages(ctx, conversationID, limit+1, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+			return
+		}
+	}
+
+	response := gin.H{
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	}
+
+	if len(messages) > limit {
+		messages = messages[:limit]
+		response["next_cursor"] = strconv.Itoa(messages[len(messages)-1].SequenceNumber)
+	}
+	response["messages"] = messages
+
+	c.JSON(http.StatusOK, response)
+}
+
+// sendMessageRequest is the body of a new message, posted over HTTP or
+// asked over a session socket
+type sendMessageRequest struct {
+	Content  string `json:"content" binding:"required"`
+	Type     string `json:"type" binding:"required"`
+	Provider string `json:"provider,omitempty"`
+	// Scope selects what the question is answered from, the page of the
+	// conversation or all saved pages
+	Scope string `json:"scope,omitempty"`
+	// OpenTabs are the conversation IDs of the user's other open tabs,
+	// which the model may read with tools
+	OpenTabs []string `json:"open_tabs,omitempty"`
+	// Attachments are images for vision models, such as a screenshot
+	// of the visible tab
+	Attachments []attachmentInput `json:"attachments,omitempty"`
 }
 
 func (h *Handlers) SendMessage(c *gin.Context) {
 	conversationID := c.Param("conversationId")
 	
-	var req struct {
-		Content string `json:"content" binding:"required"`
-		Type    string `json:"type" binding:"required"`
-	}
-	
+	// Images may be sent inline, which bounds the body
+	h.limitBody(c, h.attachments.MaxPerMessage)
+	var req sendMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		if bodyTooLarge(err) {
+			c.Error(attachmentTooLarge(h.attachments.MaxBytes))
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Create message
-	message := models.NewMessage(conversationID, models.MessageType(req.Type), req.Content, 0) // Sequence number would be determined in real implementation
+	message, err := h.postMessage(context.Background(), conversationID, c.GetString("session_id"), c.GetString("user_id"), req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, message)
+}
+
+// postMessage stores a message and starts answering it when it is a user
+// question. The answer is streamed to clients following the message ID.
+// The conversation must belong to the session. Errors are AppErrors.
+func (h *Handlers) postMessage(ctx context.Context, conversationID, sessionID, userID string, req sendMessageRequest) (*models.Message, error) {
+	if req.Scope != "" && req.Scope != ScopePage && req.Scope != ScopeKnowledge {
+		return nil, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", "scope must be page or knowledge")
+	}
+	if req.Scope == ScopeKnowledge && h.retriever == nil {
+		return nil, errKnowledgeUnavailable()
+	}
+
+	conversation, err := h.store.GetConversation(ctx, conversationID)
+	if err != nil || conversation.SessionID != sessionID {
+		return nil, middleware.NewAppError(http.StatusNotFound, "NOT_FOUND", "Conversation not found")
+	}
+
+	// Create message, the store assigns its sequence number
+	message := models.NewMessage(conversationID, models.MessageType(req.Type), req.Content, 0)
+	if req.Scope == ScopeKnowledge {
+		message.SetMetadata("scope", ScopeKnowledge)
+	}
+	if len(req.OpenTabs) > 0 {
+		message.SetMetadata("open_tabs", req.OpenTabs)
+	}
+
+	// Questions over quota are rejected before they are stored, or answered
+	// by the downgrade provider
+	providerName := req.Provider
+	if req.Type == string(models.UserQuestion) {
+		var downgraded bool
+		providerName, downgraded, err = h.quotaProvider(ctx, conversation.SessionID, userID, req.Provider)
+		if err != nil {
+			var appErr *middleware.AppError
+			if errors.As(err, &appErr) {
+				return nil, appErr
+			}
+			return nil, middleware.NewAppError(http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to check quota")
+		}
+		if downgraded {
+			message.SetMetadata("downgraded_to", providerName)
+		}
+	}
+
+	// Images are only sent to models declared to accept them
+	if len(req.Attachments) > 0 {
+		if req.Type == string(models.UserQuestion) && !h.llmClient.SupportsVision(providerName) {
+			name := providerName
+			if provider, exists := h.resolveProvider(providerName); exists {
+				name = provider.GetProvider()
+			}
+			return nil, middleware.NewAppError(http.StatusBadRequest, "VISION_NOT_SUPPORTED", "The model of provider "+name+" does not accept images")
+		}
+
+		attachments, err := h.messageAttachments(ctx, conversationID, req.Attachments)
+		if err != nil {
+			var appErr *middleware.AppError
+			if errors.As(err, &appErr) {
+				return nil, appErr
+			}
+			return nil, middleware.NewAppError(http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to store attachments")
+		}
+		ids := make([]string, 0, len(attachments))
+		for _, attachment := range attachments {
+			ids = append(ids, attachment.ID)
+		}
+		message.SetMetadata("attachments", ids)
+	}
 	
 	// Store message in cache
-	ctx := context.Background()
-	if err := h.sessionCache.StoreMessage(ctx, message); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
-		return
+	if err := h.store.AppendMessage(ctx, message); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, middleware.NewAppError(http.StatusNotFound, "NOT_FOUND", "Conversation not found")
+		}
+		return nil, middleware.NewAppError(http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to store message")
 	}
 
-	// If this is a user question, generate LLM response
+	// If this is a user question, generate the LLM response in the background.
+	// The answer is streamed to clients subscribed to this message ID, whose
+	// stream is opened first so they may connect before the answer starts.
 	if req.Type == string(models.UserQuestion) {
-		// Get conversation to get context
-		// conversation, err := h.sessionCache.GetConversation(ctx, conversationID)
-		// if err == nil {
-			// In a real implementation, you would:
-			// 1. Get previous messages for context
-			// 2. Get webpage content if available
-			// 3. Generate prompt with context
-			// 4. Call LLM to generate response
-			// 5. Stream response back to client
-			
-			// For now, we'll just log that we would generate a response
-			log.Printf("Would generate LLM response for conversation %s with content: %s", conversationID, req.Content)
-		// }
+		h.streamManager.Open(conversationID, message.ID)
+		go h.generateAnswer(conversation, message, providerName, userID)
 	}
 
-	c.JSON(http.StatusCreated, message)
+	return message, nil
 }
 
+// StreamHandler streams the answer to a question of one of the session's
+// conversations over a WebSocket
 func (h *Handlers) StreamHandler(c *gin.Context) {
+	if err := h.AuthorizeConversation(c.Request.Context(), c.GetString("session_id"), c.Query("conversationId")); err != nil {
+		c.Error(err)
+		return
+	}
 	h.streamManager.HandleWebSocket(c)
 }
 
-// GenerateLLMResponse generates a response using the configured LLM provider
-func (h *Handlers) GenerateLLMResponse(ctx context.Context, providerName, prompt string) (<-chan llm.StreamResponse, error) {
-	return h.llmClient.Generate(ctx, providerName, prompt)
+// StreamEventsHandler streams the same events as StreamHandler over
+// Server-Sent Events, for networks that block WebSockets
+func (h *Handlers) StreamEventsHandler(c *gin.Context) {
+	if err := h.AuthorizeConversation(c.Request.Context(), c.GetString("session_id"), c.Query("conversationId")); err != nil {
+		c.Error(err)
+		return
+	}
+	h.streamManager.HandleSSE(c)
 }
\ No newline at end of file
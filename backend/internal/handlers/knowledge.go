@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/prompt"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/pkg/vector"
+)
+
+const (
+	// ScopePage answers from the conversation's page, ScopeKnowledge from
+	// every page the user saved
+	ScopePage      = "page"
+	ScopeKnowledge = "knowledge"
+
+	// maxKnowledgeTopK caps the matches of a single search
+	maxKnowledgeTopK = 50
+
+	// knowledgeInstructions describes the assistant's task when answering
+	// from saved pages.
+	knowledgeInstructions = "You are a helpful assistant that answers questions about the web pages the user has saved. " +
+		"Base your answers on the excerpts below, mention which page an answer comes from, " +
+		"and say so when the saved pages do not contain the answer."
+)
+
+// knowledgeOwner returns whose knowledge base a request uses. Until user
+// accounts exist tokens carry no user ID, so pages belong to the session
+// that saved them. They are deleted with the session, and otherwise once
+// the token of the session has expired, see PurgeExpiredKnowledge.
+func knowledgeOwner(sessionID string) string {
+	return "session:" + sessionID
+}
+
+// PurgeExpiredKnowledge deletes the saved pages no token can reach any
+// more. A page is saved with a token of its session, so once a token
+// lifetime has passed since, the session can no longer be used. It returns
+// how many pages it removed.
+func (h *Handlers) PurgeExpiredKnowledge(ctx context.Context) (int64, error) {
+	if h.retriever == nil {
+		return 0, nil
+	}
+	return h.retriever.DeleteSavedBefore(ctx, time.Now().Add(-middleware.TokenLifetime))
+}
+
+// knowledgeAvailable reports an error to the client when no index of saved
+// pages is configured
+func (h *Handlers) knowledgeAvailable(c *gin.Context) bool {
+	if h.retriever == nil {
+		c.Error(errKnowledgeUnavailable())
+		return false
+	}
+	return true
+}
+
+func errKnowledgeUnavailable() *middleware.AppError {
+	return middleware.NewAppError(http.StatusServiceUnavailable, "KNOWLEDGE_UNAVAILABLE",
+		"Saving pages needs an LLM provider with an embedding model")
+}
+
+// SavePage adds a page to the knowledge base, either the page of a
+// conversation or one sent in the request. Saving a URL again replaces it.
+func (h *Handlers) SavePage(c *gin.Context) {
+	if !h.knowledgeAvailable(c) {
+		return
+	}
+
+	var req struct {
+		ConversationID string `json:"conversation_id,omitempty"`
+		URL            string `json:"url,omitempty"`
+		Title          string `json:"title,omitempty"`
+		ExtractedText  string `json:"extracted_text,omitempty"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	var page *models.WebpageContent
+	switch {
+	case req.ConversationID != "":
+		webpage, err := h.store.GetWebpageContent(ctx, req.ConversationID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webpage content not found"})
+			return
+		}
+		page = webpage
+	case req.URL != "" && req.ExtractedText != "":
+		page = models.NewWebpageContent(req.URL, req.Title, req.ExtractedText)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either conversation_id or url and extracted_text are required"})
+		return
+	}
+
+	sessionID, userID := c.GetString("session_id"), c.GetString("user_id")
+	meter := h.usageMeter(sessionID, userID, req.ConversationID)
+	saved, err := h.retriever.SavePage(ctx, meter, knowledgeOwner(sessionID), page)
+	if err != nil {
+		var appErr *middleware.AppError
+		if errors.As(err, &appErr) {
+			c.Error(appErr)
+			return
+		}
+		if errors.Is(err, retrieval.ErrEmptyPage) {
+			c.Error(middleware.NewAppError(http.StatusBadRequest, "EMPTY_PAGE", "The page has no text to save"))
+			return
+		}
+		log.Printf("Failed to save page %s: %v", page.URL, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save page"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, saved)
+}
+
+// ListSavedPages returns the pages in the knowledge base, most recently
+// saved first
+func (h *Handlers) ListSavedPages(c *gin.Context) {
+	if !h.knowledgeAvailable(c) {
+		return
+	}
+
+	owner := knowledgeOwner(c.GetString("session_id"))
+	pages, err := h.retriever.ListPages(context.Background(), owner)
+	if err != nil {
+		log.Printf("Failed to list saved pages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list saved pages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pages": pages})
+}
+
+// DeleteSavedPage removes a page from the knowledge base
+func (h *Handlers) DeleteSavedPage(c *gin.Context) {
+	if !h.knowledgeAvailable(c) {
+		return
+	}
+
+	owner := knowledgeOwner(c.GetString("session_id"))
+	if err := h.retriever.DeletePage(context.Background(), owner, c.Param("pageId")); err != nil {
+		if errors.Is(err, vector.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Saved page not found"})
+			return
+		}
+		log.Printf("Failed to delete saved page: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete saved page"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SearchKnowledge returns the chunks of saved pages most similar to a query,
+// optionally only of pages saved within a time range
+func (h *Handlers) SearchKnowledge(c *gin.Context) {
+	if !h.knowledgeAvailable(c) {
+		return
+	}
+
+	var req struct {
+		Query string     `json:"query" binding:"required"`
+		TopK  int        `json:"top_k,omitempty"`
+		Since *time.Time `json:"since,omitempty"`
+		Until *time.Time `json:"until,omitempty"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.TopK < 0 || req.TopK > maxKnowledgeTopK {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("top_k must be between 1 and %d", maxKnowledgeTopK)})
+		return
+	}
+
+	options := retrieval.SearchOptions{TopK: req.TopK}
+	if req.Since != nil {
+		options.Since = *req.Since
+	}
+	if req.Until != nil {
+		options.Until = *req.Until
+	}
+
+	sessionID, userID := c.GetString("session_id"), c.GetString("user_id")
+	meter := h.usageMeter(sessionID, userID, "")
+	matches, err := h.retriever.Search(context.Background(), meter, knowledgeOwner(sessionID), req.Query, options)
+	if err != nil {
+		var appErr *middleware.AppError
+		if errors.As(err, &appErr) {
+			c.Error(appErr)
+			return
+		}
+		log.Printf("Failed to search saved pages: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to search saved pages"})
+		return
+	}
+	if matches == nil {
+		matches = []vector.Match{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"matches": matches})
+}
+
+// knowledgeExcerpts returns the chunks of the owner's saved pages most
+// relevant to the question, labelled with the page they come from
+func (h *Handlers) knowledgeExcerpts(ctx context.Context, meter retrieval.Meter, owner string, question *models.Message) []prompt.Excerpt {
+	if h.retriever == nil {
+		return nil
+	}
+
+	matches, err := h.retriever.Search(ctx, meter, owner, question.Content, retrieval.SearchOptions{})
+	if err != nil {
+		log.Printf("Failed to search saved pages for conversation %s: %v", question.ConversationID, err)
+		return nil
+	}
+
+	excerpts := make([]prompt.Excerpt, 0, len(matches))
+	for _, match := range matches {
+		excerpts = append(excerpts, prompt.Excerpt{
+			Offset: match.Start,
+			Text:   match.Text,
+			Source: matchSource(match),
+			URL:    match.URL,
+		})
+	}
+	return excerpts
+}
+
+// matchSource labels a saved page in the prompt
+func matchSource(match vector.Match) string {
+	title := match.Title
+	if title == "" {
+		title = match.URL
+	}
+	return fmt.Sprintf("%s (%s), saved %s", title, match.URL, match.SavedAt.Format("2006-01-02"))
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+)
+
+// generation is an answer being generated, which the session that owns the
+// conversation may cancel
+type generation struct {
+	sessionID string
+	cancel    context.CancelFunc
+}
+
+// SessionSocketHandler serves the socket over which the extension asks
+// questions, cancels them and follows the answers of several conversations
+func (h *Handlers) SessionSocketHandler(c *gin.Context) {
+	// Images are uploaded beforehand, so frames only carry text
+	h.streamManager.HandleSession(c, h, requestOverhead)
+}
+
+// SetAllowedOrigins sets the browser origins besides the server's own that
+// may open WebSockets, such as the extension's
+func (h *Handlers) SetAllowedOrigins(origins []string) {
+	h.streamManager.SetAllowedOrigins(origins)
+}
+
+// AuthorizeConversation checks that a conversation belongs to a session.
+// Conversations of other sessions are reported as not found.
+func (h *Handlers) AuthorizeConversation(ctx context.Context, sessionID, conversationID string) error {
+	conversation, err := h.store.GetConversation(ctx, conversationID)
+	if err != nil || conversation.SessionID != sessionID {
+		return middleware.NewAppError(http.StatusNotFound, "NOT_FOUND", "Conversation not found")
+	}
+	return nil
+}
+
+// AskQuestion stores a message sent over a session socket, which has the
+// body of SendMessage with the type defaulting to a user question
+func (h *Handlers) AskQuestion(ctx context.Context, sessionID, userID, conversationID string, request json.RawMessage) (*models.Message, error) {
+	var req sendMessageRequest
+	if err := json.Unmarshal(request, &req); err != nil {
+		return nil, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", err.Error())
+	}
+	if req.Type == "" {
+		req.Type = string(models.UserQuestion)
+	}
+	// Inline images would need large frames, they are uploaded instead
+	for _, attachment := range req.Attachments {
+		if attachment.Data != "" {
+			return nil, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", "Attachments must be uploaded and referenced by id")
+		}
+	}
+	if err := binding.Validator.ValidateStruct(&req); err != nil {
+		return nil, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", err.Error())
+	}
+
+	return h.postMessage(ctx, conversationID, sessionID, userID, req)
+}
+
+// CancelGeneration stops generating the answer to a question. The partial
+// answer is discarded and its stream completes as cancelled.
+func (h *Handlers) CancelGeneration(sessionID, messageID string) error {
+	h.generationsMutex.Lock()
+	defer h.generationsMutex.Unlock()
+
+	running, exists := h.generations[messageID]
+	if !exists || running.sessionID != sessionID {
+		return middleware.NewAppError(http.StatusNotFound, "NOT_FOUND", "No answer is being generated for this message")
+	}
+	running.cancel()
+	return nil
+}
+
+// startGeneration returns the context of the answer to a question, which
+// ends with the generation timeout or when cancelled. The returned function
+// must be called once the answer is done.
+func (h *Handlers) startGeneration(sessionID, messageID string) (context.Context, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), generationTimeout)
+
+	h.generationsMutex.Lock()
+	h.generations[messageID] = generation{sessionID: sessionID, cancel: cancel}
+	h.generationsMutex.Unlock()
+
+	return ctx, func() {
+		h.generationsMutex.Lock()
+		delete(h.generations, messageID)
+		h.generationsMutex.Unlock()
+		cancel()
+	}
+}
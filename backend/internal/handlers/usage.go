@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+var usagePeriods = []storage.UsagePeriod{storage.UsagePeriodDay, storage.UsagePeriodMonth}
+
+// usageBudget is the consumption of a session or user over one period
+// together with the configured limits, zero meaning unlimited
+type usageBudget struct {
+	*models.UsageTotals
+	TokenLimit int     `json:"token_limit"`
+	CostLimit  float64 `json:"cost_limit"`
+}
+
+func (b usageBudget) exceeded() bool {
+	return (b.TokenLimit > 0 && b.TotalTokens >= b.TokenLimit) ||
+		(b.CostLimit > 0 && b.Cost >= b.CostLimit)
+}
+
+// budgetLimits returns the token and cost limits for a scope and period
+func (h *Handlers) budgetLimits(scope storage.UsageScope, period storage.UsagePeriod) (int, float64) {
+	switch {
+	case scope == storage.UsageScopeSession && period == storage.UsagePeriodDay:
+		return h.quota.SessionDailyTokens, h.quota.SessionDailyCost
+	case scope == storage.UsageScopeSession:
+		return h.quota.SessionMonthlyTokens, h.quota.SessionMonthlyCost
+	case period == storage.UsagePeriodDay:
+		return h.quota.UserDailyTokens, h.quota.UserDailyCost
+	default:
+		return h.quota.UserMonthlyTokens, h.quota.UserMonthlyCost
+	}
+}
+
+// usageBudgets loads the daily and monthly budgets of a session or user.
+// Until user accounts exist tokens carry no user ID, and the user budgets
+// apply to the usage of the session instead.
+func (h *Handlers) usageBudgets(ctx context.Context, scope storage.UsageScope, sessionID, userID string) (map[storage.UsagePeriod]usageBudget, error) {
+	owner, id := storage.UsageScopeUser, userID
+	if scope == storage.UsageScopeSession || userID == "" {
+		owner, id = storage.UsageScopeSession, sessionID
+	}
+
+	budgets := make(map[storage.UsagePeriod]usageBudget, len(usagePeriods))
+	for _, period := range usagePeriods {
+		totals, err := h.store.GetUsage(ctx, owner, id, period)
+		if err != nil {
+			return nil, err
+		}
+		tokenLimit, costLimit := h.budgetLimits(scope, period)
+		budgets[period] = usageBudget{UsageTotals: totals, TokenLimit: tokenLimit, CostLimit: costLimit}
+	}
+	return budgets, nil
+}
+
+// checkQuota returns a QUOTA_EXCEEDED error when the session or the user has
+// used up any of its budgets
+func (h *Handlers) checkQuota(ctx context.Context, sessionID, userID string) error {
+	for _, scope := range []storage.UsageScope{storage.UsageScopeSession, storage.UsageScopeUser} {
+		budgets, err := h.usageBudgets(ctx, scope, sessionID, userID)
+		if err != nil {
+			return err
+		}
+		for _, period := range usagePeriods {
+			if budget := budgets[period]; budget.exceeded() {
+				return middleware.NewAppErrorWithDetails(http.StatusTooManyRequests, "QUOTA_EXCEEDED",
+					fmt.Sprintf("The %s %s quota has been exceeded", scope, budgetPeriodName(period)),
+					gin.H{"scope": scope, "period": period, "usage": budget})
+			}
+		}
+	}
+	return nil
+}
+
+func budgetPeriodName(period storage.UsagePeriod) string {
+	if period == storage.UsagePeriodMonth {
+		return "monthly"
+	}
+	return "daily"
+}
+
+// recordUsage prices an answer with the configured price table and stores it
+// against the session and user that asked
+func (h *Handlers) recordUsage(ctx context.Context, conversation *models.Conversation, userID string, response *models.LLMResponse, provider string, estimated bool) {
+	cost := h.quota.Price(provider, response.ModelUsed).Cost(response.PromptTokens, response.CompletionTokens)
+	record := models.NewUsageRecord(conversation.SessionID, userID, conversation.ID, response.MessageID,
+		provider, response.ModelUsed, response.PromptTokens, response.CompletionTokens, cost)
+	record.Estimated = estimated
+
+	if err := h.store.RecordUsage(ctx, record); err != nil {
+		log.Printf("Failed to record usage for conversation %s: %v", conversation.ID, err)
+	}
+}
+
+// recordEmbeddingUsage prices embeddings and stores them against the session
+// and user they were made for, like the tokens of an answer
+func (h *Handlers) recordEmbeddingUsage(ctx context.Context, sessionID, userID, conversationID string, embeddings *llm.Embeddings) {
+	cost := h.quota.Price(embeddings.Provider, embeddings.Model).Cost(embeddings.Usage.PromptTokens, 0)
+	record := models.NewUsageRecord(sessionID, userID, conversationID, "", embeddings.Provider, embeddings.Model,
+		embeddings.Usage.PromptTokens, 0, cost)
+	record.Estimated = embeddings.Usage.Estimated
+
+	if err := h.store.RecordUsage(ctx, record); err != nil {
+		log.Printf("Failed to record embeddings usage for session %s: %v", sessionID, err)
+	}
+}
+
+// usageMeter holds the embeddings of page retrieval and knowledge searches
+// to the quotas of the session and user they run for
+type usageMeter struct {
+	h              *Handlers
+	sessionID      string
+	userID         string
+	conversationID string
+}
+
+func (h *Handlers) usageMeter(sessionID, userID, conversationID string) retrieval.Meter {
+	return usageMeter{h: h, sessionID: sessionID, userID: userID, conversationID: conversationID}
+}
+
+func (m usageMeter) Allow(ctx context.Context) error {
+	return m.h.checkQuota(ctx, m.sessionID, m.userID)
+}
+
+func (m usageMeter) Record(ctx context.Context, embeddings *llm.Embeddings) {
+	m.h.recordEmbeddingUsage(ctx, m.sessionID, m.userID, m.conversationID, embeddings)
+}
+
+// quotaProvider decides which provider answers a question. Requests over
+// quota are rejected, or sent to the downgrade provider when one is set.
+func (h *Handlers) quotaProvider(ctx context.Context, sessionID, userID, requested string) (string, bool, error) {
+	err := h.checkQuota(ctx, sessionID, userID)
+	if err == nil {
+		return requested, false, nil
+	}
+
+	var quotaErr *middleware.AppError
+	if errors.As(err, &quotaErr) && h.quota.DowngradeProvider != "" {
+		if _, exists := h.llmClient.GetProvider(h.quota.DowngradeProvider); exists {
+			return h.quota.DowngradeProvider, true, nil
+		}
+	}
+	return "", false, err
+}
+
+// GetUsage reports the token and cost consumption of the current session and
+// user against their budgets. Without a user ID both report the session.
+func (h *Handlers) GetUsage(c *gin.Context) {
+	sessionID := c.GetString("session_id")
+	if sessionID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session ID not found"})
+		return
+	}
+
+	ctx := context.Background()
+	response := gin.H{}
+
+	userID := c.GetString("user_id")
+	for _, scope := range []storage.UsageScope{storage.UsageScopeSession, storage.UsageScopeUser} {
+		budgets, err := h.usageBudgets(ctx, scope, sessionID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get usage"})
+			return
+		}
+		response[string(scope)] = budgets
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -9,6 +9,9 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// TokenLifetime is how long a session's token is valid
+const TokenLifetime = 24 * time.Hour
+
 type JWTMiddleware struct {
 	secretKey string
 }
@@ -28,7 +31,7 @@ func (m *JWTMiddleware) GenerateToken(userID, sessionID string) (string, error)
 		UserID:    userID,
 		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenLifetime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "chromllm",
 		},
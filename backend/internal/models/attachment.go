@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// Attachment is an image attached to a question, such as a screenshot of
+// the visible tab
+type Attachment struct {
+	ID             string    `json:"id"`
+	ConversationID string    `json:"conversation_id"`
+	MediaType      string    `json:"media_type"`
+	Size           int       `json:"size"`
+	Data           []byte    `json:"data,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func NewAttachment(conversationID, mediaType string, data []byte) *Attachment {
+	return &Attachment{
+		ID:             generateUUID(),
+		ConversationID: conversationID,
+		MediaType:      mediaType,
+		Size:           len(data),
+		Data:           data,
+		CreatedAt:      time.Now(),
+	}
+}
@@ -5,15 +5,18 @@ import (
 )
 
 type LLMResponse struct {
-	ID           string    `json:"id"`
-	MessageID    string    `json:"message_id"`
-	StreamID     string    `json:"stream_id"`
-	Content      string    `json:"content"`
-	IsComplete   bool      `json:"is_complete"`
-	TokensUsed   int       `json:"tokens_used"`
-	ModelUsed    string    `json:"model_used"`
-	CreatedAt    time.Time `json:"created_at"`
-	CompletedAt  time.Time `json:"completed_at,omitempty"`
+	ID               string    `json:"id"`
+	MessageID        string    `json:"message_id"`
+	StreamID         string    `json:"stream_id"`
+	Content          string    `json:"content"`
+	Reasoning        string    `json:"reasoning,omitempty"`
+	IsComplete       bool      `json:"is_complete"`
+	TokensUsed       int       `json:"tokens_used"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	ModelUsed        string    `json:"model_used"`
+	CreatedAt        time.Time `json:"created_at"`
+	CompletedAt      time.Time `json:"completed_at,omitempty"`
 }
 
 func NewLLMResponse(messageID, streamID, modelUsed string) *LLMResponse {
@@ -33,6 +36,12 @@ func (r *LLMResponse) AddContent(content string) {
 	r.Content += content
 }
 
+// AddReasoning records the thinking of a reasoning model, kept apart from
+// the answer in Content
+func (r *LLMResponse) AddReasoning(reasoning string) {
+	r.Reasoning += reasoning
+}
+
 func (r *LLMResponse) Complete() {
 	r.IsComplete = true
 	r.CompletedAt = time.Now()
@@ -40,4 +49,11 @@ func (r *LLMResponse) Complete() {
 
 func (r *LLMResponse) AddTokens(tokens int) {
 	r.TokensUsed += tokens
-}
\ No newline at end of file
+}
+
+// SetUsage records the prompt and completion tokens reported for the response
+func (r *LLMResponse) SetUsage(promptTokens, completionTokens int) {
+	r.PromptTokens = promptTokens
+	r.CompletionTokens = completionTokens
+	r.TokensUsed = promptTokens + completionTokens
+}
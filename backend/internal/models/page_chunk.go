@@ -0,0 +1,13 @@
+package models
+
+// PageChunk is a slice of a page's extracted text together with its
+// embedding. Chunks are shared by every page with the same content hash and
+// Start and End are byte offsets into the extracted text.
+type PageChunk struct {
+	ContentHash string    `json:"content_hash"`
+	Index       int       `json:"index"`
+	Start       int       `json:"start"`
+	End         int       `json:"end"`
+	Text        string    `json:"text"`
+	Embedding   []float32 `json:"embedding,omitempty"`
+}
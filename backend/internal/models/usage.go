@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+// UsageRecord is the token usage and cost of a single LLM answer
+type UsageRecord struct {
+	ID               string  `json:"id"`
+	SessionID        string  `json:"session_id"`
+	UserID           string  `json:"user_id,omitempty"`
+	ConversationID   string  `json:"conversation_id"`
+	MessageID        string  `json:"message_id"`
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	// Estimated is set when the provider reported no usage and the tokens
+	// were approximated from the text length
+	Estimated bool      `json:"estimated,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewUsageRecord(sessionID, userID, conversationID, messageID, provider, model string, promptTokens, completionTokens int, cost float64) *UsageRecord {
+	return &UsageRecord{
+		ID:               generateUUID(),
+		SessionID:        sessionID,
+		UserID:           userID,
+		ConversationID:   conversationID,
+		MessageID:        messageID,
+		Provider:         provider,
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+		Cost:             cost,
+		CreatedAt:        time.Now(),
+	}
+}
+
+// UsageTotals aggregates the usage records of a session or user over a period
+type UsageTotals struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	// EstimatedTokens is the part of TotalTokens that was approximated
+	EstimatedTokens int `json:"estimated_tokens"`
+}
+
+// Add counts a usage record in the totals
+func (t *UsageTotals) Add(record *UsageRecord) {
+	t.Requests++
+	t.PromptTokens += record.PromptTokens
+	t.CompletionTokens += record.CompletionTokens
+	t.TotalTokens += record.TotalTokens
+	t.Cost += record.Cost
+	if record.Estimated {
+		t.EstimatedTokens += record.TotalTokens
+	}
+}
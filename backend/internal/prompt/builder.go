@@ -0,0 +1,259 @@
+package prompt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+const (
+	// DefaultContextWindow is assumed for models whose context size is unknown
+	DefaultContextWindow = 8192
+	// DefaultAnswerTokens is reserved for the answer when no limit is configured
+	DefaultAnswerTokens = 1000
+
+	// safetyMargin is the share of the window kept free to absorb the error
+	// of the token estimate
+	safetyMargin = 0.1
+	// historyShare is the share of the remaining budget history is entitled
+	// to when it and the page do not both fit
+	historyShare = 0.3
+	// summaryShare is the share of the history budget set aside for the
+	// summary of dropped turns
+	summaryShare = 0.2
+	// summaryQuestionChars caps each earlier question quoted in the summary
+	summaryQuestionChars = 200
+)
+
+// Budget is the token budget of a single request. ToolTokens is left free
+// for the tool calls the model may make and their results.
+type Budget struct {
+	ContextWindow int
+	AnswerTokens  int
+	ToolTokens    int
+}
+
+// Capacity returns the prompt tokens a budget allows, leaving room for the
+// answer and for the error of the token estimate
+func (b Budget) Capacity() int {
+	window := b.ContextWindow
+	if window <= 0 {
+		window = DefaultContextWindow
+	}
+	answer := b.AnswerTokens
+	if answer <= 0 {
+		answer = DefaultAnswerTokens
+	}
+	return int(float64(window)*(1-safetyMargin)) - answer
+}
+
+// Page is the web page a conversation is about
+type Page struct {
+	Title string
+	URL   string
+	Text  string
+	// Excerpts are the parts of the page retrieved for the question, most
+	// relevant first. When set they are sent instead of Text.
+	Excerpts []Excerpt
+}
+
+// Excerpt is a part of the page starting Offset characters into its text.
+// Source names the page it was taken from when excerpts of several pages
+// are sent together, and URL is that page's address.
+type Excerpt struct {
+	Offset int
+	Text   string
+	Source string
+	URL    string
+}
+
+// Request holds everything that may go into a prompt. History is ordered
+// oldest first and does not include the question.
+type Request struct {
+	Instructions string
+	Page         Page
+	History      []llm.ChatMessage
+	Question     string
+	// Images are attached to the question, for models that accept them
+	Images []llm.Image
+	Budget Budget
+	// Uncited sends the page without numbered passages, for answers that
+	// cannot carry citations such as JSON
+	Uncited bool
+}
+
+// Build assembles the chat messages for a request so that they fit the
+// model's context window with room left for the answer and tool calls. When they do not
+// all fit, the oldest turns are replaced by a short summary and the page is
+// cut down to the sections most relevant to the question. The page content
+// is sent as numbered passages the model is asked to cite, which are
+// returned to resolve the citations of the answer.
+func Build(req Request) ([]llm.ChatMessage, []Passage) {
+	header := pageHeader(req.Instructions, req.Page)
+	question := llm.ChatMessage{Role: llm.RoleUser, Content: req.Question, Images: req.Images}
+
+	remaining := req.Budget.Capacity() - req.Budget.ToolTokens -
+		llm.EstimateMessageTokens(llm.ChatMessage{Role: llm.RoleSystem, Content: header}) -
+		llm.EstimateMessageTokens(question)
+	if !req.Uncited && (req.Page.Text != "" || len(req.Page.Excerpts) > 0) {
+		remaining -= llm.EstimateTokens(citationInstructions) + 1
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	pageNeed := pageTokens(req.Page)
+	historyNeed := historyTokens(req.History)
+
+	historyBudget := historyNeed
+	if pageNeed+historyNeed > remaining {
+		historyBudget = max(int(float64(remaining)*historyShare), remaining-pageNeed)
+		historyBudget = min(historyBudget, historyNeed)
+	}
+	history, summary := fitHistory(req.History, historyBudget)
+
+	used := historyTokens(history) + llm.EstimateTokens(summary)
+	var pageText string
+	var passages []Passage
+	if len(req.Page.Excerpts) > 0 {
+		pageText, passages = fitExcerpts(req.Page.Excerpts, remaining-used, !req.Uncited)
+	} else {
+		pageText, passages = fitPage(req.Page.Text, req.Question, remaining-used, !req.Uncited)
+	}
+
+	var system strings.Builder
+	system.WriteString(header)
+	if pageText != "" && len(passages) > 0 {
+		system.WriteString(citationInstructions)
+		system.WriteString("\n")
+	}
+	if pageText != "" {
+		system.WriteString(contentHeading(req.Page))
+		system.WriteString(pageText)
+		system.WriteString("\n")
+	}
+	if summary != "" {
+		system.WriteString("\n")
+		system.WriteString(summary)
+	}
+
+	messages := []llm.ChatMessage{{Role: llm.RoleSystem, Content: system.String()}}
+	messages = append(messages, history...)
+	return append(messages, question), passages
+}
+
+// pageHeader is the part of the system prompt that is always sent
+func pageHeader(instructions string, page Page) string {
+	var b strings.Builder
+	b.WriteString(instructions)
+	if instructions != "" && !strings.HasSuffix(instructions, "\n") {
+		b.WriteString("\n")
+	}
+	if page.Title != "" || page.URL != "" {
+		b.WriteString("\n")
+	}
+	if page.Title != "" {
+		fmt.Fprintf(&b, "Page title: %s\n", page.Title)
+	}
+	if page.URL != "" {
+		fmt.Fprintf(&b, "Page URL: %s\n", page.URL)
+	}
+	return b.String()
+}
+
+// contentHeading introduces the page text, or the excerpts of saved pages
+func contentHeading(page Page) string {
+	if len(page.Excerpts) > 0 && page.Excerpts[0].Source != "" {
+		return "\nExcerpts of saved pages:\n"
+	}
+	return "\nPage content:\n"
+}
+
+func pageTokens(page Page) int {
+	if len(page.Excerpts) == 0 {
+		return llm.EstimateTokens(page.Text)
+	}
+	var tokens int
+	for _, excerpt := range page.Excerpts {
+		tokens += llm.EstimateTokens(excerpt.Text) + llm.EstimateTokens(omission)
+	}
+	return tokens
+}
+
+func historyTokens(history []llm.ChatMessage) int {
+	var tokens int
+	for _, message := range history {
+		tokens += llm.EstimateMessageTokens(message)
+	}
+	return tokens
+}
+
+// fitHistory keeps the most recent turns that fit the budget and summarizes
+// the ones dropped before them
+func fitHistory(history []llm.ChatMessage, budget int) ([]llm.ChatMessage, string) {
+	if historyTokens(history) <= budget {
+		return history, ""
+	}
+
+	summaryBudget := int(float64(budget) * summaryShare)
+	keepBudget := budget - summaryBudget
+
+	start := len(history)
+	var used int
+	for start > 0 {
+		tokens := llm.EstimateMessageTokens(history[start-1])
+		if used+tokens > keepBudget {
+			break
+		}
+		used += tokens
+		start--
+	}
+
+	// Some providers require the conversation to open with a user turn
+	for start < len(history) && history[start].Role != llm.RoleUser {
+		used -= llm.EstimateMessageTokens(history[start])
+		start++
+	}
+
+	return history[start:], summarize(history[:start], budget-used)
+}
+
+// summarize condenses dropped turns into the questions the user asked,
+// keeping the most recent ones that fit the budget
+func summarize(dropped []llm.ChatMessage, budget int) string {
+	const intro = "Earlier in this conversation, which is no longer shown in full, the user asked:\n"
+
+	used := llm.EstimateTokens(intro)
+	var questions []string
+	for i := len(dropped) - 1; i >= 0; i-- {
+		if dropped[i].Role != llm.RoleUser {
+			continue
+		}
+		line := "- " + truncateRunes(strings.Join(strings.Fields(dropped[i].Content), " "), summaryQuestionChars) + "\n"
+		tokens := llm.EstimateTokens(line)
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		questions = append(questions, line)
+	}
+	if len(questions) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(intro)
+	for i := len(questions) - 1; i >= 0; i-- {
+		b.WriteString(questions[i])
+	}
+	return b.String()
+}
+
+func truncateRunes(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit]) + "..."
+}
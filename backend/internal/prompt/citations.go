@@ -0,0 +1,93 @@
+package prompt
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// citationInstructions asks the model to cite the numbered passages
+	citationInstructions = "The page content is split into numbered passages. " +
+		"Cite the passages that support your answer by their numbers in square brackets, for example [2] or [1][3]."
+	// snippetChars caps the passage text quoted in a citation
+	snippetChars = 200
+)
+
+// citationPattern matches [2] as well as [1, 3]
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// Passage is a numbered part of the page content sent to the model. Start
+// and End are character offsets into the page text, URL is set for excerpts
+// of saved pages.
+type Passage struct {
+	Number int
+	Start  int
+	End    int
+	Text   string
+	URL    string
+}
+
+func (p Passage) label() string {
+	return fmt.Sprintf("[%d] %s", p.Number, p.Text)
+}
+
+// Citation is a passage an answer refers to. The snippet quotes the start of
+// the passage so clients can find it in the page.
+type Citation struct {
+	Number  int    `json:"number"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Snippet string `json:"snippet"`
+	URL     string `json:"url,omitempty"`
+}
+
+// Citations returns the passages cited in an answer, in order of their first
+// citation. Numbers that match no passage are ignored.
+func Citations(answer string, passages []Passage) []Citation {
+	byNumber := make(map[int]Passage, len(passages))
+	for _, passage := range passages {
+		byNumber[passage.Number] = passage
+	}
+
+	seen := make(map[int]bool)
+	var citations []Citation
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, field := range strings.Split(match[1], ",") {
+			number, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || seen[number] {
+				continue
+			}
+			passage, exists := byNumber[number]
+			if !exists {
+				continue
+			}
+			seen[number] = true
+			citations = append(citations, Citation{
+				Number:  number,
+				Start:   passage.Start,
+				End:     passage.End,
+				Snippet: snippet(passage.Text),
+				URL:     passage.URL,
+			})
+		}
+	}
+	return citations
+}
+
+// snippet quotes the first line of a passage, cut at a word boundary
+func snippet(text string) string {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	runes := []rune(text)
+	if len(runes) <= snippetChars {
+		return text
+	}
+	cut := string(runes[:snippetChars])
+	if i := strings.LastIndexByte(cut, ' '); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return cut
+}
@@ -0,0 +1,346 @@
+package prompt
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+const (
+	// sectionTokens is the size page text is split into for trimming
+	sectionTokens = 200
+	// minPageTokens is the smallest budget worth spending on page content
+	minPageTokens = 50
+	// omission marks where page content was left out
+	omission = "[...]"
+)
+
+// section is a run of consecutive paragraphs of the page, from character
+// offset start to end of the page text
+type section struct {
+	text   string
+	start  int
+	end    int
+	tokens int
+	score  float64
+}
+
+// fitPage returns all sections of the page text if they fit the budget,
+// otherwise the sections most relevant to the question in page order, with
+// the start of the page kept since it usually introduces the topic. With
+// cite set the sections are numbered and returned as passages.
+func fitPage(text, question string, budget int, cite bool) (string, []Passage) {
+	sections := splitSections(text)
+	if len(sections) == 0 {
+		return "", nil
+	}
+
+	selected := make([]bool, len(sections))
+	var total int
+	for i, s := range sections {
+		total += s.tokens + labelTokens(i+1)
+	}
+
+	if total <= budget {
+		for i := range selected {
+			selected[i] = true
+		}
+	} else {
+		if budget < minPageTokens {
+			return "", nil
+		}
+
+		terms := queryTerms(question)
+		for i := range sections {
+			sections[i].score = relevance(sections[i].text, terms)
+		}
+		sections[0].score = math.Inf(1)
+
+		order := make([]int, len(sections))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return sections[order[a]].score > sections[order[b]].score
+		})
+
+		marker := llm.EstimateTokens(omission)
+		var used int
+		for _, i := range order {
+			if cost := sections[i].tokens + labelTokens(i+1) + marker; used+cost <= budget {
+				selected[i] = true
+				used += cost
+			}
+		}
+	}
+
+	var parts []string
+	var passages []Passage
+	for i, s := range sections {
+		if selected[i] && cite {
+			passage := Passage{Number: len(passages) + 1, Start: s.start, End: s.end, Text: s.text}
+			passages = append(passages, passage)
+			parts = append(parts, passage.label())
+		} else if selected[i] {
+			parts = append(parts, s.text)
+		} else if i == 0 || selected[i-1] {
+			parts = append(parts, omission)
+		}
+	}
+	return strings.Join(parts, "\n\n"), passages
+}
+
+// fitExcerpts returns the most relevant excerpts that fit the budget in page
+// order, marking the gaps between them. Excerpts of several pages are
+// grouped by source, the most relevant source first. With cite set the
+// excerpts are numbered and returned as passages.
+func fitExcerpts(excerpts []Excerpt, budget int, cite bool) (string, []Passage) {
+	marker := llm.EstimateTokens(omission)
+	var selected []Excerpt
+	rank := make(map[string]int)
+	var used int
+	for _, excerpt := range excerpts {
+		cost := llm.EstimateTokens(excerpt.Text) + labelTokens(len(selected)+1) + marker
+		if _, seen := rank[excerpt.Source]; !seen {
+			cost += llm.EstimateTokens(sourceLine(excerpt.Source))
+		}
+		if used+cost <= budget {
+			if _, seen := rank[excerpt.Source]; !seen {
+				rank[excerpt.Source] = len(rank)
+			}
+			selected = append(selected, excerpt)
+			used += cost
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		if rank[selected[i].Source] != rank[selected[j].Source] {
+			return rank[selected[i].Source] < rank[selected[j].Source]
+		}
+		return selected[i].Offset < selected[j].Offset
+	})
+
+	var parts []string
+	var passages []Passage
+	for i, excerpt := range selected {
+		newSource := i == 0 || excerpt.Source != selected[i-1].Source
+		if newSource && i > 0 {
+			parts = append(parts, omission)
+		}
+		if newSource && excerpt.Source != "" {
+			parts = append(parts, sourceLine(excerpt.Source))
+		}
+		if !newSource || excerpt.Offset > 0 {
+			parts = append(parts, omission)
+		}
+
+		if !cite {
+			parts = append(parts, excerpt.Text)
+			continue
+		}
+		passage := Passage{
+			Number: i + 1,
+			Start:  excerpt.Offset,
+			End:    excerpt.Offset + utf8.RuneCountInString(excerpt.Text),
+			Text:   excerpt.Text,
+			URL:    excerpt.URL,
+		}
+		passages = append(passages, passage)
+		parts = append(parts, passage.label())
+	}
+	if len(parts) > 0 {
+		parts = append(parts, omission)
+	}
+	return strings.Join(parts, "\n\n"), passages
+}
+
+func sourceLine(source string) string {
+	if source == "" {
+		return ""
+	}
+	return "Source: " + source
+}
+
+// labelTokens is the cost of numbering a passage
+func labelTokens(number int) int {
+	return llm.EstimateTokens(fmt.Sprintf("[%d] ", number))
+}
+
+// splitSections groups the paragraphs of text into sections of about
+// sectionTokens, breaking longer paragraphs at sentence boundaries
+func splitSections(text string) []section {
+	var sections []section
+	var current section
+	var pieces []string
+
+	flush := func() {
+		if len(pieces) > 0 {
+			current.text = strings.Join(pieces, "\n\n")
+			sections = append(sections, current)
+			current, pieces = section{}, nil
+		}
+	}
+
+	// Pieces are substrings of the text in order, so each is found after
+	// the end of the previous one. cursor counts bytes and chars characters.
+	var cursor, chars int
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		for _, piece := range splitLong(paragraph) {
+			if piece == "" {
+				continue
+			}
+			start := cursor + strings.Index(text[cursor:], piece)
+			startChar := chars + utf8.RuneCountInString(text[cursor:start])
+			cursor = start + len(piece)
+			chars = startChar + utf8.RuneCountInString(piece)
+
+			pieceTokens := llm.EstimateTokens(piece)
+			if current.tokens > 0 && current.tokens+pieceTokens > sectionTokens {
+				flush()
+			}
+			if len(pieces) == 0 {
+				current.start = startChar
+			}
+			pieces = append(pieces, piece)
+			current.end = chars
+			current.tokens += pieceTokens
+		}
+	}
+	flush()
+	return sections
+}
+
+// splitLong breaks a paragraph longer than sectionTokens into sentences,
+// and sentences that are still too long into fixed-size pieces
+func splitLong(paragraph string) []string {
+	if llm.EstimateTokens(paragraph) <= sectionTokens {
+		return []string{paragraph}
+	}
+
+	var pieces []string
+	var current strings.Builder
+	for _, sentence := range splitSentences(paragraph) {
+		if current.Len() > 0 && llm.EstimateTokens(current.String()+sentence) > sectionTokens {
+			pieces = append(pieces, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+		if llm.EstimateTokens(sentence) > sectionTokens {
+			// Every rune is at most one token, so this bounds the piece
+			runes := []rune(sentence)
+			for len(runes) > sectionTokens {
+				pieces = append(pieces, string(runes[:sectionTokens]))
+				runes = runes[sectionTokens:]
+			}
+			sentence = string(runes)
+		}
+		current.WriteString(sentence)
+	}
+	if current.Len() > 0 {
+		pieces = append(pieces, strings.TrimSpace(current.String()))
+	}
+	return pieces
+}
+
+// splitSentences splits text after sentence-ending punctuation, keeping the
+// punctuation and following space with the sentence
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+	for i, r := range runes {
+		if !strings.ContainsRune(".!?。！？\n", r) {
+			continue
+		}
+		// Full-width punctuation ends a sentence on its own, ASCII only
+		// before a space so decimals and abbreviations like 3.5 stay whole
+		if r < unicode.MaxASCII && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			continue
+		}
+		sentences = append(sentences, string(runes[start:i+1]))
+		start = i + 1
+	}
+	if start < len(runes) {
+		sentences = append(sentences, string(runes[start:]))
+	}
+	return sentences
+}
+
+// stopWords are frequent question words that say nothing about relevance
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "was": true, "were": true,
+	"what": true, "how": true, "why": true, "who": true, "when": true, "where": true, "which": true,
+	"does": true, "did": true, "can": true, "this": true, "that": true, "with": true, "from": true,
+	"about": true, "you": true, "your": true, "there": true, "page": true,
+}
+
+// queryTerms extracts the terms of a question to match page sections
+// against: words of three or more letters other than stop words, and character bigrams of CJK
+// text, which has no word separators
+func queryTerms(question string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	var word, cjk []rune
+	flush := func() {
+		if len(word) >= 3 && !stopWords[string(word)] {
+			add(string(word))
+		}
+		if len(cjk) == 1 {
+			add(string(cjk))
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			add(string(cjk[i : i+2]))
+		}
+		word, cjk = word[:0], cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(question) {
+		switch {
+		case isCJK(r):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// relevance scores a section by how often it mentions the question terms,
+// with diminishing returns for repeated mentions
+func relevance(text string, terms []string) float64 {
+	text = strings.ToLower(text)
+	var score float64
+	for _, term := range terms {
+		if count := strings.Count(text, term); count > 0 {
+			score += 1 + math.Log(float64(count))
+		}
+	}
+	return score
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
@@ -0,0 +1,128 @@
+package retrieval
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+// CharOffset converts a byte offset into text, such as the Start of a chunk,
+// to the character offset clients count in
+func CharOffset(text string, offset int) int {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	return utf8.RuneCountInString(text[:offset])
+}
+
+// segment is a sentence or line of text, as byte offsets
+type segment struct {
+	start, end int
+	tokens     int
+}
+
+// Chunk splits text into chunks of about size tokens that repeat the last
+// overlap tokens of the previous chunk, so a passage cut at a chunk border
+// is still whole in one of them. Chunks break at sentence and line ends
+// where possible.
+func Chunk(text string, size, overlap int) []*models.PageChunk {
+	if size <= 0 {
+		size = 300
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+
+	segments := splitSegments(text, size)
+	var chunks []*models.PageChunk
+	for i := 0; i < len(segments); {
+		j, tokens := i, 0
+		for j < len(segments) && (j == i || tokens+segments[j].tokens <= size) {
+			tokens += segments[j].tokens
+			j++
+		}
+
+		if chunk := newChunk(text, segments[i].start, segments[j-1].end, len(chunks)); chunk != nil {
+			chunks = append(chunks, chunk)
+		}
+		if j == len(segments) {
+			break
+		}
+
+		// Start the next chunk early enough to repeat the overlap
+		next, repeated := j, 0
+		for next-1 > i && repeated+segments[next-1].tokens <= overlap {
+			repeated += segments[next-1].tokens
+			next--
+		}
+		i = next
+	}
+	return chunks
+}
+
+// newChunk trims surrounding whitespace from text[start:end], nil when
+// nothing is left
+func newChunk(text string, start, end, index int) *models.PageChunk {
+	raw := text[start:end]
+	trimmed := strings.TrimLeftFunc(raw, unicode.IsSpace)
+	start += len(raw) - len(trimmed)
+	trimmed = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+	if trimmed == "" {
+		return nil
+	}
+	return &models.PageChunk{Index: index, Start: start, End: start + len(trimmed), Text: trimmed}
+}
+
+// splitSegments cuts text after line breaks and sentence-ending punctuation.
+// Segments longer than size tokens are cut into pieces of size runes, which
+// are at most size tokens.
+func splitSegments(text string, size int) []segment {
+	var segments []segment
+	add := func(start, end int) {
+		if start == end {
+			return
+		}
+		if tokens := llm.EstimateTokens(text[start:end]); tokens <= size {
+			segments = append(segments, segment{start: start, end: end, tokens: tokens})
+			return
+		}
+		for start < end {
+			cut := start
+			for n := 0; n < size && cut < end; n++ {
+				_, width := utf8.DecodeRuneInString(text[cut:])
+				cut += width
+			}
+			segments = append(segments, segment{start: start, end: cut, tokens: llm.EstimateTokens(text[start:cut])})
+			start = cut
+		}
+	}
+
+	start := 0
+	for i, r := range text {
+		if !isSentenceEnd(text, i, r) {
+			continue
+		}
+		end := i + utf8.RuneLen(r)
+		add(start, end)
+		start = end
+	}
+	add(start, len(text))
+	return segments
+}
+
+// isSentenceEnd reports whether the rune at byte offset i ends a sentence.
+// ASCII punctuation only counts before whitespace, so numbers like 3.5 and
+// names like example.com stay whole.
+func isSentenceEnd(text string, i int, r rune) bool {
+	switch r {
+	case '\n', '。', '！', '？':
+		return true
+	case '.', '!', '?':
+		next, _ := utf8.DecodeRuneInString(text[i+1:])
+		return i+1 == len(text) || unicode.IsSpace(next)
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package retrieval
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/vector"
+)
+
+// ErrEmptyPage is returned when a page without text is saved
+var ErrEmptyPage = errors.New("page has no text")
+
+// SearchOptions narrow a knowledge base search. Zero values mean the
+// configured number of matches and an open time range.
+type SearchOptions struct {
+	TopK  int
+	Since time.Time
+	Until time.Time
+}
+
+// pageID identifies a saved page by URL, so saving a page again replaces it
+func pageID(url string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(url)))[:32]
+}
+
+// SavePage adds a page to the owner's knowledge base, replacing an earlier
+// save of the same URL. Chunk embeddings are shared with page retrieval.
+func (r *Retriever) SavePage(ctx context.Context, meter Meter, owner string, page *models.WebpageContent) (*vector.Page, error) {
+	chunks, model, err := r.embeddedChunks(ctx, meter, page)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, ErrEmptyPage
+	}
+
+	id := pageID(page.URL)
+	savedAt := time.Now().UTC()
+	entries := make([]vector.Entry, len(chunks))
+	for i, chunk := range chunks {
+		entries[i] = vector.Entry{
+			Owner:   owner,
+			PageID:  id,
+			URL:     page.URL,
+			Title:   page.Title,
+			SavedAt: savedAt,
+			Model:   model,
+			Chunk:   chunk.Index,
+			Start:   CharOffset(page.ExtractedText, chunk.Start),
+			End:     CharOffset(page.ExtractedText, chunk.End),
+			Text:    chunk.Text,
+			Vector:  chunk.Embedding,
+		}
+	}
+
+	if err := r.index.SavePage(ctx, entries); err != nil {
+		return nil, fmt.Errorf("failed to save page: %w", err)
+	}
+	return &vector.Page{ID: id, URL: page.URL, Title: page.Title, SavedAt: savedAt, Chunks: len(entries)}, nil
+}
+
+// Search returns the chunks of the owner's saved pages most similar to the
+// query, most similar first
+func (r *Retriever) Search(ctx context.Context, meter Meter, owner, query string, options SearchOptions) ([]vector.Match, error) {
+	embeddings, err := r.embed(ctx, meter, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	topK := options.TopK
+	if topK <= 0 {
+		topK = r.config.KnowledgeTopK
+	}
+
+	return r.index.Search(ctx, vector.Query{
+		Owner:  owner,
+		Model:  embeddings.Model,
+		Vector: embeddings.Vectors[0],
+		TopK:   topK,
+		Since:  options.Since,
+		Until:  options.Until,
+	})
+}
+
+// ListPages returns the owner's saved pages, most recent first
+func (r *Retriever) ListPages(ctx context.Context, owner string) ([]vector.Page, error) {
+	return r.index.ListPages(ctx, owner)
+}
+
+// DeletePage removes a page from the owner's knowledge base
+func (r *Retriever) DeletePage(ctx context.Context, owner, id string) error {
+	return r.index.DeletePage(ctx, owner, id)
+}
+
+// DeleteOwner removes every page of the owner's knowledge base
+func (r *Retriever) DeleteOwner(ctx context.Context, owner string) error {
+	pages, err := r.index.ListPages(ctx, owner)
+	if err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if err := r.index.DeletePage(ctx, owner, page.ID); err != nil && !errors.Is(err, vector.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSavedBefore removes the pages of every knowledge base saved before
+// a time and returns how many it removed
+func (r *Retriever) DeleteSavedBefore(ctx context.Context, before time.Time) (int64, error) {
+	return r.index.DeleteSavedBefore(ctx, before)
+}
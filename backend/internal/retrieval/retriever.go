@@ -0,0 +1,139 @@
+package retrieval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/jzhang405/SmartChrome/backend/config"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+	"github.com/jzhang405/SmartChrome/backend/pkg/vector"
+)
+
+// Meter checks and records the embedding usage of whoever a retrieval runs
+// for, so embeddings count against the same quotas as chat. A nil Meter
+// leaves the usage unmetered.
+type Meter interface {
+	// Allow returns an error when no more may be spent
+	Allow(ctx context.Context) error
+	Record(ctx context.Context, embeddings *llm.Embeddings)
+}
+
+// Retriever finds the chunks of a page most similar to a question. Chunks
+// are embedded once per content hash and embedding model and kept in the
+// store, so only the question is embedded on later requests.
+type Retriever struct {
+	client *llm.LLMClient
+	store  storage.ChunkStore
+	index  vector.Index
+	config config.RetrievalConfig
+}
+
+// NewRetriever creates a retriever. Pages saved to knowledge bases are kept
+// in index.
+func NewRetriever(client *llm.LLMClient, store storage.ChunkStore, index vector.Index, cfg config.RetrievalConfig) *Retriever {
+	return &Retriever{
+		client: client,
+		store:  store,
+		index:  index,
+		config: cfg,
+	}
+}
+
+// Retrieve returns the TopK chunks of the page most similar to the question,
+// most similar first. Pages shorter than MinPageTokens return no chunks and
+// should be sent whole.
+func (r *Retriever) Retrieve(ctx context.Context, meter Meter, page *models.WebpageContent, question string) ([]*models.PageChunk, error) {
+	if page == nil || llm.EstimateTokens(page.ExtractedText) < r.config.MinPageTokens {
+		return nil, nil
+	}
+
+	chunks, _, err := r.embeddedChunks(ctx, meter, page)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := r.embed(ctx, meter, []string{question})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed question: %w", err)
+	}
+
+	scores := make(map[*models.PageChunk]float64, len(chunks))
+	for _, chunk := range chunks {
+		scores[chunk] = vector.Cosine(query.Vectors[0], chunk.Embedding)
+	}
+	ranked := append([]*models.PageChunk(nil), chunks...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+
+	if r.config.TopK > 0 && len(ranked) > r.config.TopK {
+		ranked = ranked[:r.config.TopK]
+	}
+	return ranked, nil
+}
+
+// embeddedChunks loads the embedded chunks of the page, chunking and
+// embedding it first when it has not been seen with the current model
+func (r *Retriever) embeddedChunks(ctx context.Context, meter Meter, page *models.WebpageContent) ([]*models.PageChunk, string, error) {
+	model, err := r.client.EmbeddingModel(r.config.EmbeddingProvider)
+	if err != nil {
+		return nil, "", err
+	}
+
+	chunks, err := r.store.GetPageChunks(ctx, page.ContentHash, model)
+	if err == nil {
+		return chunks, model, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, "", err
+	}
+
+	chunks = Chunk(page.ExtractedText, r.config.ChunkTokens, r.config.ChunkOverlap)
+	if len(chunks) == 0 {
+		return nil, model, nil
+	}
+
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+
+	embeddings, err := r.embed(ctx, meter, texts)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to embed page chunks: %w", err)
+	}
+	for i, chunk := range chunks {
+		chunk.ContentHash = page.ContentHash
+		chunk.Embedding = embeddings.Vectors[i]
+	}
+
+	// The chunks can still be used for this question if they cannot be kept
+	if err := r.store.StorePageChunks(ctx, page.ContentHash, embeddings.Model, chunks); err != nil {
+		log.Printf("Failed to store chunks of page %s: %v", page.ContentHash, err)
+	}
+	return chunks, embeddings.Model, nil
+}
+
+// embed embeds texts with the embedding provider once the meter allows it,
+// and records what they cost
+func (r *Retriever) embed(ctx context.Context, meter Meter, texts []string) (*llm.Embeddings, error) {
+	if meter != nil {
+		if err := meter.Allow(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	embeddings, err := r.client.Embed(ctx, r.config.EmbeddingProvider, texts)
+	if err != nil {
+		return nil, err
+	}
+	if meter != nil {
+		meter.Record(ctx, embeddings)
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,149 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+// RegisterBuiltins adds the backend's own tools. Searching saved pages is
+// only offered with a retriever.
+func RegisterBuiltins(registry *Registry, store storage.Store, retriever *retrieval.Retriever) {
+	tabs := &tabTools{store: store}
+	registry.Register(listOpenTabs, tabs.list)
+	registry.Register(getTabContent, tabs.content)
+
+	if retriever != nil {
+		search := &searchTool{retriever: retriever}
+		registry.Register(searchSavedPages, search.run)
+	}
+}
+
+var (
+	listOpenTabs = llmTool("list_open_tabs",
+		"List the other browser tabs the user has open, with their tab_id, title and URL.",
+		`{"type":"object","properties":{}}`)
+
+	getTabContent = llmTool("get_tab_content",
+		"Read the text of another open tab, found with list_open_tabs.",
+		`{"type":"object","required":["tab_id"],"properties":{"tab_id":{"type":"string","description":"The tab_id from list_open_tabs"}}}`)
+
+	searchSavedPages = llmTool("search_saved_pages",
+		"Search the pages the user saved to their knowledge base for passages about a topic. "+
+			"Use since and until, as RFC 3339 times, to only search pages saved in that period.",
+		`{"type":"object","required":["query"],"properties":{`+
+			`"query":{"type":"string","description":"What to look for"},`+
+			`"since":{"type":"string","format":"date-time"},`+
+			`"until":{"type":"string","format":"date-time"}}}`)
+)
+
+// tabTools read the pages of the other tabs the extension reported as open.
+// Tabs are conversations, which must belong to the caller's session.
+type tabTools struct {
+	store storage.Store
+}
+
+type tab struct {
+	ID    string `json:"tab_id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+func (t *tabTools) list(ctx context.Context, invocation Invocation, arguments json.RawMessage) (string, error) {
+	tabs := make([]tab, 0, len(invocation.OpenTabs))
+	for _, id := range invocation.OpenTabs {
+		conversation, err := t.store.GetConversation(ctx, id)
+		if err != nil || conversation.SessionID != invocation.SessionID || id == invocation.ConversationID {
+			continue
+		}
+		tabs = append(tabs, tab{ID: id, Title: conversation.Title, URL: conversation.URL})
+	}
+	return marshal(tabs)
+}
+
+func (t *tabTools) content(ctx context.Context, invocation Invocation, arguments json.RawMessage) (string, error) {
+	var args struct {
+		TabID string `json:"tab_id"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil || args.TabID == "" {
+		return "", errors.New("tab_id is required")
+	}
+
+	open := false
+	for _, id := range invocation.OpenTabs {
+		open = open || id == args.TabID
+	}
+	conversation, err := t.store.GetConversation(ctx, args.TabID)
+	if !open || err != nil || conversation.SessionID != invocation.SessionID {
+		return "", fmt.Errorf("no open tab %q", args.TabID)
+	}
+
+	webpage, err := t.store.GetWebpageContent(ctx, args.TabID)
+	if err != nil {
+		return "", fmt.Errorf("the content of tab %q is not available", args.TabID)
+	}
+	return fmt.Sprintf("Title: %s\nURL: %s\n\n%s", webpage.Title, webpage.URL, webpage.ExtractedText), nil
+}
+
+// searchTool searches the caller's knowledge base
+type searchTool struct {
+	retriever *retrieval.Retriever
+}
+
+type searchMatch struct {
+	Title   string    `json:"title"`
+	URL     string    `json:"url"`
+	SavedAt time.Time `json:"saved_at"`
+	Text    string    `json:"text"`
+}
+
+func (s *searchTool) run(ctx context.Context, invocation Invocation, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Query string     `json:"query"`
+		Since *time.Time `json:"since"`
+		Until *time.Time `json:"until"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if args.Query == "" {
+		return "", errors.New("query is required")
+	}
+
+	var options retrieval.SearchOptions
+	if args.Since != nil {
+		options.Since = *args.Since
+	}
+	if args.Until != nil {
+		options.Until = *args.Until
+	}
+
+	matches, err := s.retriever.Search(ctx, invocation.Meter, invocation.Owner, args.Query, options)
+	if err != nil {
+		return "", errors.New("the search failed")
+	}
+
+	results := make([]searchMatch, 0, len(matches))
+	for _, match := range matches {
+		results = append(results, searchMatch{Title: match.Title, URL: match.URL, SavedAt: match.SavedAt, Text: match.Text})
+	}
+	return marshal(results)
+}
+
+func llmTool(name, description, parameters string) llm.Tool {
+	return llm.Tool{Name: name, Description: description, Parameters: json.RawMessage(parameters)}
+}
+
+func marshal(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
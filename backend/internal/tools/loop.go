@@ -0,0 +1,197 @@
+package tools
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/prompt"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+const (
+	// maxRounds bounds the requests in which the model may call tools. The
+	// request after the last round is made without tools so it answers.
+	maxRounds = 4
+	// toolShare is the part of the context window a prompt leaves free for
+	// tool calls and their results
+	toolShare = 0.2
+	// truncated ends a tool result cut to fit the context window
+	truncated = "\n[truncated]"
+)
+
+// Call records a tool call made while answering
+type Call struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Stream receives the output of Run as it is generated. Either function
+// may be nil.
+type Stream struct {
+	Content func(string)
+	// Reasoning receives the thinking of reasoning models
+	Reasoning func(string)
+}
+
+// Result is the answer produced by Run
+type Result struct {
+	Content   string
+	Reasoning string
+	Usage     llm.Usage
+	Provider  string
+	Model     string
+	Calls     []Call
+}
+
+// Reserve returns the tokens a prompt should leave free in a context window
+// for the registry's tool definitions and the results of the calls. Nothing
+// is reserved without tools.
+func (r *Registry) Reserve(contextWindow int) int {
+	definitions := r.Definitions()
+	if len(definitions) == 0 {
+		return 0
+	}
+	if contextWindow <= 0 {
+		contextWindow = prompt.DefaultContextWindow
+	}
+	return definitionTokens(definitions) + int(float64(contextWindow)*toolShare)
+}
+
+// Run asks the model to answer the messages with the registry's tools
+// available. Tool calls are executed and their results sent back until the
+// model answers without calling a tool. Output is passed to the stream as
+// it is generated, including any text the model writes alongside its tool
+// calls. Tool results are cut to the room left in the model's context
+// window. When the answer fails or is cancelled, the result so far is
+// returned with the error, with the usage of an interrupted request
+// estimated since the provider may already have billed it.
+func (r *Registry) Run(ctx context.Context, client *llm.LLMClient, providerName string, messages []llm.ChatMessage, invocation Invocation, stream Stream, options ...llm.GenerateOption) (*Result, error) {
+	definitions := r.Definitions()
+	limits := client.Limits(providerName)
+	capacity := prompt.Budget{ContextWindow: limits.ContextWindow, AnswerTokens: limits.MaxOutputTokens}.Capacity() -
+		definitionTokens(definitions)
+	result := &Result{}
+	var content, reasoning strings.Builder
+
+	for round := 0; ; round++ {
+		roundOptions := options
+		if len(definitions) > 0 && round < maxRounds {
+			roundOptions = append(append([]llm.GenerateOption(nil), options...), llm.WithTools(definitions...))
+		}
+
+		chunks, err := client.Chat(ctx, providerName, messages, roundOptions...)
+		if err != nil {
+			return result.finish(&content, &reasoning), err
+		}
+
+		// Drain the whole stream so the provider goroutine can always finish
+		var text, roundReasoning strings.Builder
+		var builder llm.ToolCallBuilder
+		var streamErr error
+		var done bool
+		for chunk := range chunks {
+			if chunk.Provider != "" {
+				result.Provider, result.Model = chunk.Provider, chunk.Model
+			}
+			if chunk.Error != nil {
+				streamErr = chunk.Error
+				continue
+			}
+			if chunk.Reasoning != "" {
+				roundReasoning.WriteString(chunk.Reasoning)
+				reasoning.WriteString(chunk.Reasoning)
+				if stream.Reasoning != nil {
+					stream.Reasoning(chunk.Reasoning)
+				}
+			}
+			if chunk.Content != "" {
+				text.WriteString(chunk.Content)
+				if stream.Content != nil {
+					stream.Content(chunk.Content)
+				}
+			}
+			builder.Add(chunk.ToolCalls)
+			if chunk.Done {
+				done = true
+				result.addUsage(chunk.Usage)
+			}
+		}
+		content.WriteString(text.String())
+		if streamErr == nil && !done {
+			streamErr = ctx.Err()
+		}
+		if streamErr != nil {
+			if !done {
+				result.addUsage(llm.EstimateUsage(messages, roundReasoning.String()+text.String()))
+			}
+			return result.finish(&content, &reasoning), streamErr
+		}
+
+		calls := builder.Calls()
+		if len(calls) == 0 {
+			return result.finish(&content, &reasoning), nil
+		}
+
+		messages = append(messages, llm.ChatMessage{Role: llm.RoleAssistant, Content: text.String(), ToolCalls: calls})
+		left := capacity - llm.EstimateUsage(messages, "").PromptTokens
+		for i, call := range calls {
+			output, err := r.Execute(ctx, invocation, call)
+			record := Call{Name: call.Name, Arguments: call.Arguments}
+			if err != nil {
+				record.Error = err.Error()
+				output = "Error: " + err.Error()
+			}
+			result.Calls = append(result.Calls, record)
+
+			// The calls of a round share the room left
+			message := llm.ChatMessage{Role: llm.RoleTool, ToolCallID: call.ID}
+			message.Content = fitResult(output, left/(len(calls)-i)-llm.EstimateMessageTokens(message))
+			left -= llm.EstimateMessageTokens(message)
+			messages = append(messages, message)
+		}
+	}
+}
+
+func (r *Result) addUsage(usage llm.Usage) {
+	r.Usage.PromptTokens += usage.PromptTokens
+	r.Usage.CompletionTokens += usage.CompletionTokens
+	r.Usage.TotalTokens += usage.TotalTokens
+	r.Usage.Estimated = r.Usage.Estimated || usage.Estimated
+}
+
+func (r *Result) finish(content, reasoning *strings.Builder) *Result {
+	r.Content = content.String()
+	r.Reasoning = reasoning.String()
+	return r
+}
+
+// definitionTokens approximates the prompt tokens of tool definitions
+func definitionTokens(definitions []llm.Tool) int {
+	var tokens int
+	for _, definition := range definitions {
+		tokens += llm.EstimateTokens(definition.Name) + llm.EstimateTokens(definition.Description) +
+			llm.EstimateTokens(string(definition.Parameters))
+	}
+	return tokens
+}
+
+// fitResult cuts a tool result to about the given number of tokens
+func fitResult(output string, tokens int) string {
+	if llm.EstimateTokens(output) <= tokens {
+		return output
+	}
+	tokens -= llm.EstimateTokens(truncated)
+	if tokens <= 0 {
+		return strings.TrimSpace(truncated)
+	}
+
+	// The estimate grows with the length of the text, so the longest prefix
+	// that fits is found by bisection
+	runes := []rune(output)
+	n := sort.Search(len(runes), func(n int) bool {
+		return llm.EstimateTokens(string(runes[:n+1])) > tokens
+	})
+	return string(runes[:n]) + truncated
+}
@@ -0,0 +1,92 @@
+// Package tools lets the assistant call backend functions while answering,
+// such as reading another open tab or searching the user's saved pages.
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+// Invocation identifies who a tool is called for. Tools only reach data the
+// caller could reach through the API.
+type Invocation struct {
+	SessionID      string
+	UserID         string
+	ConversationID string
+	// Owner is whose saved pages are searched
+	Owner string
+	// Meter holds the embeddings of searches to the caller's quotas
+	Meter retrieval.Meter
+	// OpenTabs are the conversation IDs of the other tabs open in the
+	// extension when the question was asked
+	OpenTabs []string
+}
+
+// Func runs a tool with the JSON arguments the model produced and returns
+// the result for the model to read
+type Func func(ctx context.Context, invocation Invocation, arguments json.RawMessage) (string, error)
+
+type registered struct {
+	definition llm.Tool
+	run        Func
+}
+
+// Registry holds the tools offered to the model
+type Registry struct {
+	mutex sync.RWMutex
+	tools map[string]registered
+	order []string
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{tools: make(map[string]registered)}
+}
+
+// Register adds a tool, replacing any tool of the same name
+func (r *Registry) Register(definition llm.Tool, run Func) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.tools[definition.Name]; !exists {
+		r.order = append(r.order, definition.Name)
+	}
+	r.tools[definition.Name] = registered{definition: definition, run: run}
+}
+
+// Definitions returns the tools in registration order
+func (r *Registry) Definitions() []llm.Tool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	definitions := make([]llm.Tool, 0, len(r.order))
+	for _, name := range r.order {
+		definitions = append(definitions, r.tools[name].definition)
+	}
+	return definitions
+}
+
+// Execute runs a tool call. Unknown tools and malformed arguments are
+// errors the model can be told about.
+func (r *Registry) Execute(ctx context.Context, invocation Invocation, call llm.ToolCall) (string, error) {
+	r.mutex.RLock()
+	tool, exists := r.tools[call.Name]
+	r.mutex.RUnlock()
+	if !exists {
+		return "", fmt.Errorf("unknown tool %q", call.Name)
+	}
+
+	arguments := json.RawMessage(call.Arguments)
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	if !json.Valid(arguments) {
+		return "", fmt.Errorf("arguments are not valid JSON")
+	}
+	return tool.run(ctx, invocation, arguments)
+}
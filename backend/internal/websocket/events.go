@@ -0,0 +1,191 @@
+package websocket
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamRetention is how long the events of a stream are kept after it
+	// finishes, or after it was last written to, for clients that connect
+	// late or reconnect
+	streamRetention = 5 * time.Minute
+	// maxStreamEvents bounds the events buffered for a single stream. Past
+	// it the oldest events are dropped, so the final event always gets in.
+	maxStreamEvents = 10000
+)
+
+// eventLog buffers the messages of one stream so that every client, over
+// WebSocket or SSE, receives all of them in order however late it connects
+// and can resume after the last event it saw. Messages are numbered from 1.
+type eventLog struct {
+	mutex  sync.Mutex
+	events []StreamMessage
+	// dropped counts the oldest events removed to stay within
+	// maxStreamEvents, so events[0] has ID dropped+1
+	dropped   int
+	finished  bool
+	updatedAt time.Time
+	// changed is closed and replaced whenever the log changes
+	changed chan struct{}
+	// onAppend, when set, is called after each message is added
+	onAppend func()
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{updatedAt: time.Now(), changed: make(chan struct{})}
+}
+
+// append numbers and adds a message. Messages after the final one are
+// dropped, and a full log drops its oldest message to make room.
+func (l *eventLog) append(message StreamMessage) {
+	l.mutex.Lock()
+	if l.finished {
+		l.mutex.Unlock()
+		return
+	}
+	if len(l.events) >= maxStreamEvents {
+		l.events = l.events[1:]
+		l.dropped++
+	}
+	message.ID = l.dropped + len(l.events) + 1
+	l.events = append(l.events, message)
+	l.finished = isFinal(message)
+	l.updatedAt = time.Now()
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+	onAppend := l.onAppend
+	l.mutex.Unlock()
+
+	if onAppend != nil {
+		onAppend()
+	}
+}
+
+// since returns the events after the given ID, whether the stream has
+// finished and a channel closed when more events arrive. Clients behind the
+// oldest event kept skip the dropped ones.
+func (l *eventLog) since(afterID int) ([]StreamMessage, bool, <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	start := max(0, min(afterID-l.dropped, len(l.events)))
+	events := append([]StreamMessage(nil), l.events[start:]...)
+	return events, l.finished, l.changed
+}
+
+// last returns the ID of the last event and whether the stream has finished
+func (l *eventLog) last() (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.dropped + len(l.events), l.finished
+}
+
+func (l *eventLog) expired(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return now.Sub(l.updatedAt) > streamRetention
+}
+
+// isFinal reports whether a message ends its stream
+func isFinal(message StreamMessage) bool {
+	if message.Type == "error" {
+		return true
+	}
+	data, _ := message.Data.(map[string]interface{})
+	complete, _ := data["is_complete"].(bool)
+	return message.Type == "stream" && complete
+}
+
+// streamLog returns the log of a stream, creating it when the stream is
+// opened or first written to. Expired logs are dropped.
+func (sm *StreamManager) streamLog(conversationID, messageID string) *eventLog {
+	key := conversationID + ":" + messageID
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if log, exists := sm.logs[key]; exists {
+		return log
+	}
+
+	now := time.Now()
+	for existing, log := range sm.logs {
+		if log.expired(now) {
+			delete(sm.logs, existing)
+		}
+	}
+
+	log := newEventLog()
+	log.onAppend = func() { sm.notify(conversationID) }
+	sm.logs[key] = log
+	return log
+}
+
+// existingLog returns the log of a stream without creating it, so clients
+// cannot make the manager keep logs for streams that were never opened
+func (sm *StreamManager) existingLog(conversationID, messageID string) (*eventLog, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	log, exists := sm.logs[conversationID+":"+messageID]
+	if !exists || log.expired(time.Now()) {
+		return nil, false
+	}
+	return log, true
+}
+
+// Open starts the stream of a question before its first event, so clients
+// that connect as soon as the question is stored find it
+func (sm *StreamManager) Open(conversationID, messageID string) {
+	sm.streamLog(conversationID, messageID)
+}
+
+// conversationLogs returns the logs of the streams of a conversation by
+// message ID
+func (sm *StreamManager) conversationLogs(conversationID string) map[string]*eventLog {
+	prefix := conversationID + ":"
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	logs := make(map[string]*eventLog)
+	for key, events := range sm.logs {
+		if messageID, ok := strings.CutPrefix(key, prefix); ok {
+			logs[messageID] = events
+		}
+	}
+	return logs
+}
+
+// watch wakes a session whenever a stream of the conversation changes
+func (sm *StreamManager) watch(conversationID string, s *session) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if sm.watchers[conversationID] == nil {
+		sm.watchers[conversationID] = make(map[*session]struct{})
+	}
+	sm.watchers[conversationID][s] = struct{}{}
+}
+
+func (sm *StreamManager) unwatch(conversationID string, s *session) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	delete(sm.watchers[conversationID], s)
+	if len(sm.watchers[conversationID]) == 0 {
+		delete(sm.watchers, conversationID)
+	}
+}
+
+func (sm *StreamManager) notify(conversationID string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for s := range sm.watchers[conversationID] {
+		s.wakeUp()
+	}
+}
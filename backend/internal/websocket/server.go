@@ -4,43 +4,80 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for now
-	},
-}
-
+// StreamMessage is a single event of an answer stream. ID numbers the
+// events of a stream from 1, which clients pass back to resume after it.
 type StreamMessage struct {
+	ID        int         `json:"id"`
 	Type      string      `json:"type"`
 	Content   string      `json:"content"`
 	MessageID string      `json:"message_id"`
 	Data      interface{} `json:"data,omitempty"`
 }
 
+// StreamManager delivers answer streams to clients. Messages are buffered
+// per stream, so clients may connect before or after generation starts and
+// several clients may follow the same stream, over WebSocket or SSE.
 type StreamManager struct {
-	clients map[string]*Client
-	mutex   sync.RWMutex
+	logs map[string]*eventLog
+	// watchers are the session sockets subscribed to each conversation
+	watchers map[string]map[*session]struct{}
+	// allowedOrigins are the browser origins other than the server's own
+	// that may open sockets, such as the extension's
+	allowedOrigins map[string]bool
+	upgrader       websocket.Upgrader
+	mutex          sync.Mutex
 }
 
-type Client struct {
-	conn         *websocket.Conn
-	conversationID string
-	messageID     string
-	send         chan StreamMessage
+func NewStreamManager() *StreamManager {
+	sm := &StreamManager{
+		logs:           make(map[string]*eventLog),
+		watchers:       make(map[string]map[*session]struct{}),
+		allowedOrigins: make(map[string]bool),
+	}
+	sm.upgrader = websocket.Upgrader{CheckOrigin: sm.checkOrigin}
+	return sm
 }
 
-func NewStreamManager() *StreamManager {
-	return &StreamManager{
-		clients: make(map[string]*Client),
+// SetAllowedOrigins sets the origins that may open sockets besides the
+// server's own, e.g. chrome-extension://<extension id>
+func (sm *StreamManager) SetAllowedOrigins(origins []string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	sm.allowedOrigins = make(map[string]bool)
+	for _, origin := range origins {
+		sm.allowedOrigins[strings.TrimSuffix(origin, "/")] = true
 	}
 }
 
+// checkOrigin accepts sockets from the server's own origin, from the
+// allowed origins and from clients other than browsers, which send no
+// Origin, so other web pages cannot open sockets with a user's token
+func (sm *StreamManager) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.allowedOrigins[origin]
+}
+
+// HandleWebSocket streams the events of a message over a WebSocket. The
+// optional lastEventId query parameter resumes after that event.
 func (sm *StreamManager) HandleWebSocket(c *gin.Context) {
 	conversationID := c.Query("conversationId")
 	messageID := c.Query("messageId")
@@ -49,67 +86,66 @@ func (sm *StreamManager) HandleWebSocket(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "conversationId and messageId are required"})
 		return
 	}
+	lastEventID, _ := strconv.Atoi(c.Query("lastEventId"))
+	events, exists := sm.existingLog(conversationID, messageID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stream not found"})
+		return
+	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := sm.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
-	client := &Client{
-		conn:          conn,
-		conversationID: conversationID,
-		messageID:     messageID,
-		send:          make(chan StreamMessage, 256),
-	}
-
-	clientKey := conversationID + ":" + messageID
-
-	sm.mutex.Lock()
-	sm.clients[clientKey] = client
-	sm.mutex.Unlock()
-
-	go sm.writePump(client)
-	go sm.readPump(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	go sm.writePump(ctx, conn, events, lastEventID)
+	go sm.readPump(conn, cancel)
 }
 
-func (sm *StreamManager) writePump(client *Client) {
-	defer func() {
-		client.conn.Close()
-	}()
+// writePump follows the stream until the client goes away. The connection
+// is left open after the final event for the client to close.
+func (sm *StreamManager) writePump(ctx context.Context, conn *websocket.Conn, events *eventLog, lastEventID int) {
+	defer conn.Close()
 
 	for {
-		message, ok := <-client.send
-		if !ok {
-			client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		messages, finished, changed := events.since(lastEventID)
+		for _, message := range messages {
+			if err := conn.WriteJSON(message); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+			lastEventID = message.ID
+		}
+		if finished {
+			<-ctx.Done()
 			return
 		}
 
-		if err := client.conn.WriteJSON(message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
+		select {
+		case <-changed:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (sm *StreamManager) readPump(client *Client) {
+func (sm *StreamManager) readPump(conn *websocket.Conn, cancel context.CancelFunc) {
 	defer func() {
-		clientKey := client.conversationID + ":" + client.messageID
-		sm.mutex.Lock()
-		delete(sm.clients, clientKey)
-		sm.mutex.Unlock()
-		client.conn.Close()
+		cancel()
+		conn.Close()
 	}()
 
-	client.conn.SetReadLimit(512)
-	// client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	client.conn.SetPongHandler(func(string) error {
-		// client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetReadLimit(512)
+	// conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		// conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 		return nil
 	})
 
 	for {
-		_, _, err := client.conn.ReadMessage()
+		_, _, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
@@ -119,34 +155,17 @@ func (sm *StreamManager) readPump(client *Client) {
 	}
 }
 
+// SendMessage adds a message to the stream of a question, for every client
+// following it now or later
 func (sm *StreamManager) SendMessage(conversationID, messageID string, message StreamMessage) {
-	clientKey := conversationID + ":" + messageID
-
-	sm.mutex.RLock()
-	client, exists := sm.clients[clientKey]
-	sm.mutex.RUnlock()
-
-	if exists {
-		select {
-		case client.send <- message:
-		default:
-			log.Printf("Client send buffer full, dropping message")
-		}
-	}
+	sm.streamLog(conversationID, messageID).append(message)
 }
 
+// BroadcastToConversation adds a message to every unfinished stream of the
+// conversation
 func (sm *StreamManager) BroadcastToConversation(conversationID string, message StreamMessage) {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
-
-	for clientKey, client := range sm.clients {
-		if client.conversationID == conversationID {
-			select {
-			case client.send <- message:
-			default:
-				log.Printf("Client send buffer full, dropping message for %s", clientKey)
-			}
-		}
+	for _, events := range sm.conversationLogs(conversationID) {
+		events.append(message)
 	}
 }
 
@@ -163,6 +182,48 @@ func (sm *StreamManager) SendStreamResponse(ctx context.Context, conversationID,
 	sm.SendMessage(conversationID, messageID, message)
 }
 
+// SendComplete ends the stream of an answer that has been stored. data is
+// added to the final message, such as the ID of the reply and its citations.
+func (sm *StreamManager) SendComplete(ctx context.Context, conversationID, messageID string, data map[string]interface{}) {
+	final := map[string]interface{}{"is_complete": true}
+	for key, value := range data {
+		final[key] = value
+	}
+
+	sm.SendMessage(conversationID, messageID, StreamMessage{
+		Type:      "stream",
+		MessageID: messageID,
+		Data:      final,
+	})
+}
+
+// SendThinking streams the reasoning of a reasoning model, which the
+// extension shows apart from the answer
+func (sm *StreamManager) SendThinking(ctx context.Context, conversationID, messageID string, content string) {
+	message := StreamMessage{
+		Type:      "thinking",
+		Content:   content,
+		MessageID: messageID,
+	}
+
+	sm.SendMessage(conversationID, messageID, message)
+}
+
+// SendCancelled ends the stream of a question whose generation was
+// cancelled
+func (sm *StreamManager) SendCancelled(ctx context.Context, conversationID, messageID string) {
+	message := StreamMessage{
+		Type:      "stream",
+		MessageID: messageID,
+		Data: map[string]interface{}{
+			"is_complete": true,
+			"cancelled":   true,
+		},
+	}
+
+	sm.SendMessage(conversationID, messageID, message)
+}
+
 func (sm *StreamManager) SendError(ctx context.Context, conversationID, messageID string, errorMsg string) {
 	message := StreamMessage{
 		Type:      "error",
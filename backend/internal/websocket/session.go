@@ -0,0 +1,399 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+)
+
+// Frames clients send over a session socket
+const (
+	FrameSubscribe   = "subscribe"
+	FrameUnsubscribe = "unsubscribe"
+	FrameAsk         = "ask"
+	FrameCancel      = "cancel"
+	FramePing        = "ping"
+)
+
+// Frames the server sends over a session socket
+const (
+	FrameAck      = "ack"
+	FrameStream   = "stream"
+	FrameThinking = "thinking"
+	FrameComplete = "complete"
+	FrameError    = "error"
+	FramePong     = "pong"
+)
+
+const (
+	// pingInterval is how often the server pings a session socket, a client
+	// that does not answer within pongWait is disconnected
+	pingInterval = 30 * time.Second
+	pongWait     = 2 * pingInterval
+	writeWait    = 10 * time.Second
+	// minReadLimit bounds the frames of a session socket when the caller
+	// does not allow more
+	minReadLimit = 64 << 10
+)
+
+// ClientFrame is a request sent over a session socket. ID is chosen by the
+// client and echoed in the ack or error answering the request.
+type ClientFrame struct {
+	Type           string `json:"type"`
+	ID             string `json:"id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	// MessageID is the question to cancel, or the stream to resume when
+	// subscribing
+	MessageID   string `json:"message_id,omitempty"`
+	LastEventID int    `json:"last_event_id,omitempty"`
+	// Message is the question to ask, with the body of
+	// POST /conversations/{conversationId}/messages
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// ServerFrame is an ack, error or stream event sent over a session socket.
+// Stream events carry the conversation, the question they answer and the
+// event ID within its stream.
+type ServerFrame struct {
+	Type           string      `json:"type"`
+	ID             string      `json:"id,omitempty"`
+	ConversationID string      `json:"conversation_id,omitempty"`
+	MessageID      string      `json:"message_id,omitempty"`
+	EventID        int         `json:"event_id,omitempty"`
+	Content        string      `json:"content,omitempty"`
+	Code           string      `json:"code,omitempty"`
+	Data           interface{} `json:"data,omitempty"`
+}
+
+// SessionHandler serves the requests of session sockets. It is implemented
+// by the HTTP handlers, which own the store and the models. Errors that are
+// AppErrors are reported to the client with their code.
+type SessionHandler interface {
+	// AuthorizeConversation checks that the conversation belongs to the
+	// session
+	AuthorizeConversation(ctx context.Context, sessionID, conversationID string) error
+	// AskQuestion stores a question of the session and starts answering it
+	AskQuestion(ctx context.Context, sessionID, userID, conversationID string, request json.RawMessage) (*models.Message, error)
+	// CancelGeneration stops answering a question of the session
+	CancelGeneration(sessionID, messageID string) error
+}
+
+// session is the socket of one extension session. It follows every stream
+// of the conversations it subscribed to.
+type session struct {
+	manager   *StreamManager
+	handler   SessionHandler
+	conn      *websocket.Conn
+	sessionID string
+	userID    string
+	// wake is signalled when frames are queued or a followed stream changes
+	wake chan struct{}
+
+	mutex         sync.Mutex
+	conversations map[string]bool
+	// cursors are the last event IDs sent per conversation:message stream
+	cursors map[string]int
+	outbox  []ServerFrame
+	// holding delays stream events while a question is being stored, so
+	// its ack is sent before its answer
+	holding bool
+}
+
+// HandleSession serves the socket of a session, over which the extension
+// subscribes to conversations, asks questions, cancels their generation and
+// receives the answers. One socket serves every tab of the session. The
+// read limit should allow the largest question, whose images are uploaded
+// beforehand and referenced by ID.
+func (sm *StreamManager) HandleSession(c *gin.Context, handler SessionHandler, readLimit int64) {
+	sessionID := c.GetString("session_id")
+	if sessionID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session token required"})
+		return
+	}
+
+	conn, err := sm.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+
+	s := &session{
+		manager:       sm,
+		handler:       handler,
+		conn:          conn,
+		sessionID:     sessionID,
+		userID:        c.GetString("user_id"),
+		wake:          make(chan struct{}, 1),
+		conversations: make(map[string]bool),
+		cursors:       make(map[string]int),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.writeLoop(ctx)
+	go s.readLoop(ctx, cancel, max(readLimit, minReadLimit))
+}
+
+func (s *session) readLoop(ctx context.Context, cancel context.CancelFunc, readLimit int64) {
+	defer func() {
+		cancel()
+		s.conn.Close()
+		s.unsubscribeAll()
+	}()
+
+	s.conn.SetReadLimit(readLimit)
+	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		var frame ClientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			s.reply(ServerFrame{Type: FrameError, Code: "BAD_REQUEST", Content: "Frames must be JSON objects"})
+			continue
+		}
+		s.handle(ctx, frame)
+	}
+}
+
+// handle answers a client frame. Frames are handled one at a time in the
+// order they arrive.
+func (s *session) handle(ctx context.Context, frame ClientFrame) {
+	ack := ServerFrame{Type: FrameAck, ID: frame.ID, ConversationID: frame.ConversationID, MessageID: frame.MessageID}
+
+	switch frame.Type {
+	case FramePing:
+		s.reply(ServerFrame{Type: FramePong, ID: frame.ID})
+
+	case FrameSubscribe:
+		if frame.ConversationID == "" {
+			s.fail(frame, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", "conversation_id is required"))
+			return
+		}
+		if err := s.handler.AuthorizeConversation(ctx, s.sessionID, frame.ConversationID); err != nil {
+			s.fail(frame, err)
+			return
+		}
+		s.hold(true)
+		s.subscribe(frame.ConversationID, frame.MessageID, frame.LastEventID)
+		s.reply(ack)
+		s.hold(false)
+
+	case FrameUnsubscribe:
+		s.unsubscribe(frame.ConversationID)
+		s.reply(ack)
+
+	case FrameAsk:
+		if frame.ConversationID == "" || len(frame.Message) == 0 {
+			s.fail(frame, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", "conversation_id and message are required"))
+			return
+		}
+		if err := s.handler.AuthorizeConversation(ctx, s.sessionID, frame.ConversationID); err != nil {
+			s.fail(frame, err)
+			return
+		}
+		// Asking subscribes to the conversation so the answer is delivered
+		s.hold(true)
+		s.subscribe(frame.ConversationID, "", 0)
+		message, err := s.handler.AskQuestion(ctx, s.sessionID, s.userID, frame.ConversationID, frame.Message)
+		if err != nil {
+			s.fail(frame, err)
+		} else {
+			ack.MessageID, ack.Data = message.ID, message
+			s.reply(ack)
+		}
+		s.hold(false)
+
+	case FrameCancel:
+		if frame.MessageID == "" {
+			s.fail(frame, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", "message_id is required"))
+			return
+		}
+		if err := s.handler.CancelGeneration(s.sessionID, frame.MessageID); err != nil {
+			s.fail(frame, err)
+			return
+		}
+		s.reply(ack)
+
+	default:
+		s.fail(frame, middleware.NewAppError(http.StatusBadRequest, "BAD_REQUEST", "Unknown frame type "+frame.Type))
+	}
+}
+
+// writeLoop is the only writer of the connection. It sends queued frames,
+// then the new events of the followed streams, and pings the client.
+func (s *session) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		s.conn.Close()
+	}()
+
+	for {
+		for _, frame := range s.pending() {
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.conn.WriteJSON(frame); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+		}
+
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pending takes the queued frames followed by the stream events not sent yet
+func (s *session) pending() []ServerFrame {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	frames := s.outbox
+	s.outbox = nil
+	if s.holding {
+		return frames
+	}
+
+	for conversationID := range s.conversations {
+		for messageID, events := range s.manager.conversationLogs(conversationID) {
+			key := conversationID + ":" + messageID
+			messages, _, _ := events.since(s.cursors[key])
+			for _, message := range messages {
+				frames = append(frames, eventFrame(conversationID, messageID, message))
+				s.cursors[key] = message.ID
+			}
+		}
+	}
+	return frames
+}
+
+// eventFrame converts a stream event, the last event of a completed answer
+// becomes a complete frame
+func eventFrame(conversationID, messageID string, message StreamMessage) ServerFrame {
+	frame := ServerFrame{
+		Type:           message.Type,
+		ConversationID: conversationID,
+		MessageID:      messageID,
+		EventID:        message.ID,
+		Content:        message.Content,
+		Data:           message.Data,
+	}
+	switch {
+	case message.Type == "stream" && isFinal(message):
+		frame.Type = FrameComplete
+	case message.Type == "error":
+		frame.Code = "GENERATION_FAILED"
+	}
+	return frame
+}
+
+// subscribe follows the streams of a conversation. Streams that finished
+// before the first subscription are not replayed, a message ID resumes its
+// stream after the given event.
+func (s *session) subscribe(conversationID, messageID string, lastEventID int) {
+	s.mutex.Lock()
+	if !s.conversations[conversationID] {
+		s.conversations[conversationID] = true
+		for id, events := range s.manager.conversationLogs(conversationID) {
+			if last, finished := events.last(); finished {
+				s.cursors[conversationID+":"+id] = last
+			}
+		}
+	}
+	if messageID != "" {
+		s.cursors[conversationID+":"+messageID] = lastEventID
+	}
+	s.mutex.Unlock()
+
+	s.manager.watch(conversationID, s)
+	s.wakeUp()
+}
+
+func (s *session) unsubscribe(conversationID string) {
+	s.manager.unwatch(conversationID, s)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.conversations, conversationID)
+	for messageID := range s.manager.conversationLogs(conversationID) {
+		delete(s.cursors, conversationID+":"+messageID)
+	}
+}
+
+func (s *session) unsubscribeAll() {
+	s.mutex.Lock()
+	conversations := make([]string, 0, len(s.conversations))
+	for conversationID := range s.conversations {
+		conversations = append(conversations, conversationID)
+	}
+	s.mutex.Unlock()
+
+	for _, conversationID := range conversations {
+		s.unsubscribe(conversationID)
+	}
+}
+
+func (s *session) reply(frame ServerFrame) {
+	s.mutex.Lock()
+	s.outbox = append(s.outbox, frame)
+	s.mutex.Unlock()
+	s.wakeUp()
+}
+
+// fail reports an error answering a client frame
+func (s *session) fail(frame ClientFrame, err error) {
+	var appErr *middleware.AppError
+	if !errors.As(err, &appErr) {
+		log.Printf("WebSocket %s request failed: %v", frame.Type, err)
+		appErr = middleware.ErrInternalServer
+	}
+	s.reply(ServerFrame{
+		Type:           FrameError,
+		ID:             frame.ID,
+		ConversationID: frame.ConversationID,
+		MessageID:      frame.MessageID,
+		Content:        appErr.Message,
+		Code:           appErr.Code,
+		Data:           appErr.Details,
+	})
+}
+
+func (s *session) hold(holding bool) {
+	s.mutex.Lock()
+	s.holding = holding
+	s.mutex.Unlock()
+	s.wakeUp()
+}
+
+func (s *session) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,91 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// heartbeatInterval keeps proxies from closing an idle SSE connection
+	heartbeatInterval = 15 * time.Second
+	// sseRetry is the reconnection delay suggested to clients, in milliseconds
+	sseRetry = 3000
+)
+
+// HandleSSE streams the events of a message as Server-Sent Events, for
+// networks where WebSockets do not get through. Each event carries a
+// StreamMessage as JSON with its ID, so a client reconnecting with
+// Last-Event-ID (or the lastEventId query parameter) resumes after it.
+// Comments are sent as heartbeats while the model is quiet. Once the stream
+// has finished and been delivered, the response ends and a reconnecting
+// client gets 204, which stops EventSource from retrying. Streams that were
+// never opened, or have expired, get 404.
+func (sm *StreamManager) HandleSSE(c *gin.Context) {
+	conversationID := c.Query("conversationId")
+	messageID := c.Query("messageId")
+
+	if conversationID == "" || messageID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "conversationId and messageId are required"})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	after, _ := strconv.Atoi(lastEventID)
+
+	events, exists := sm.existingLog(conversationID, messageID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stream not found"})
+		return
+	}
+	if messages, finished, _ := events.since(after); finished && len(messages) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// Stops nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", sseRetry)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	ctx := c.Request.Context()
+	for {
+		messages, finished, changed := events.since(after)
+		for _, message := range messages {
+			data, err := json.Marshal(message)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", message.ID, data)
+			after = message.ID
+		}
+		c.Writer.Flush()
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
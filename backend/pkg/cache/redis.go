@@ -49,4 +49,35 @@ func (r *RedisClient) Exists(ctx context.Context, key string) (bool, error) {
 
 func (r *RedisClient) Close() error {
 	return r.client.Close()
-}
\ No newline at end of file
+}
+func (r *RedisClient) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	return r.client.MGet(ctx, keys...).Result()
+}
+
+func (r *RedisClient) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return r.client.ZRange(ctx, key, start, stop).Result()
+}
+
+func (r *RedisClient) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) ([]string, error) {
+	return r.client.ZRangeByScore(ctx, key, opt).Result()
+}
+
+func (r *RedisClient) ZCard(ctx context.Context, key string) (int64, error) {
+	return r.client.ZCard(ctx, key).Result()
+}
+
+// TxPipelined runs the queued commands atomically in a MULTI/EXEC block
+func (r *RedisClient) TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) error {
+	_, err := r.client.TxPipelined(ctx, fn)
+	return err
+}
+
+// Watch runs fn in an optimistic transaction that fails with redis.TxFailedErr
+// when any of the watched keys change before it commits
+func (r *RedisClient) Watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	return r.client.Watch(ctx, fn, keys...)
+}
+
+func (r *RedisClient) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return r.client.HGetAll(ctx, key).Result()
+}
@@ -3,12 +3,21 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/jzhang405/SmartChrome/backend/internal/models"
 )
 
+// maxTxRetries bounds optimistic transaction retries under contention
+const maxTxRetries = 10
+
+// ErrConversationNotFound is returned when a message targets an unknown conversation
+var ErrConversationNotFound = errors.New("conversation not found")
+
 type SessionCache struct {
 	client *RedisClient
 }
@@ -87,6 +96,8 @@ func (s *SessionCache) GetConversation(ctx context.Context, conversationID strin
 	return &conversation, nil
 }
 
+// StoreMessage saves the message and indexes it in the conversation's
+// sorted set, scored by sequence number
 func (s *SessionCache) StoreMessage(ctx context.Context, message *models.Message) error {
 	messageJSON, err := json.Marshal(message)
 	if err != nil {
@@ -94,14 +105,327 @@ func (s *SessionCache) StoreMessage(ctx context.Context, message *models.Message
 	}
 
 	key := fmt.Sprintf("message:%s", message.ID)
-	return s.client.Set(ctx, key, messageJSON, 30*24*time.Hour) // 30 days
+	indexKey := conversationMessagesKey(message.ConversationID)
+
+	err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, messageJSON, 30*24*time.Hour) // 30 days
+		pipe.ZAdd(ctx, indexKey, &redis.Z{Score: float64(message.SequenceNumber), Member: message.ID})
+		pipe.Expire(ctx, indexKey, 30*24*time.Hour)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store message: %w", err)
+	}
+
+	return nil
+}
+
+// AppendMessage assigns the conversation's next sequence number to the message
+// and stores it together with the updated conversation message count. The
+// number is taken in the same transaction, retried when another writer wins,
+// so failed appends leave no gaps in the numbering.
+func (s *SessionCache) AppendMessage(ctx context.Context, message *models.Message) error {
+	conversationKey := fmt.Sprintf("conversation:%s", message.ConversationID)
+	sequenceKey := conversationSequenceKey(message.ConversationID)
+	messageKey := fmt.Sprintf("message:%s", message.ID)
+	indexKey := conversationMessagesKey(message.ConversationID)
+
+	update := func(tx *redis.Tx) error {
+		conversationJSON, err := tx.Get(ctx, conversationKey).Result()
+		if err == redis.Nil {
+			return ErrConversationNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		sequence, err := tx.Get(ctx, sequenceKey).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		message.SequenceNumber = sequence + 1
+
+		messageJSON, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		var conversation models.Conversation
+		if err := json.Unmarshal([]byte(conversationJSON), &conversation); err != nil {
+			return fmt.Errorf("failed to unmarshal conversation: %w", err)
+		}
+		conversation.AddMessage()
+
+		updatedJSON, err := json.Marshal(&conversation)
+		if err != nil {
+			return fmt.Errorf("failed to marshal conversation: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, sequenceKey, message.SequenceNumber, 30*24*time.Hour)
+			pipe.Set(ctx, conversationKey, updatedJSON, 30*24*time.Hour) // 30 days
+			pipe.Set(ctx, messageKey, messageJSON, 30*24*time.Hour)
+			pipe.ZAdd(ctx, indexKey, &redis.Z{Score: float64(message.SequenceNumber), Member: message.ID})
+			pipe.Expire(ctx, indexKey, 30*24*time.Hour)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for i := 0; i < maxTxRetries; i++ {
+		err = s.client.Watch(ctx, update, conversationKey, sequenceKey)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrConversationNotFound) {
+			return err
+		}
+		return fmt.Errorf("failed to append message: %w", err)
+	}
+
+	return nil
 }
 
+// GetConversationMessages returns messages in sequence order. A limit of zero
+// or less returns every message from offset onwards.
 func (s *SessionCache) GetConversationMessages(ctx context.Context, conversationID string, limit, offset int) ([]*models.Message, error) {
-	// This is a simplified implementation - in production, you might want to use
-	// Redis sorted sets for better pagination support
-	
-	// For now, return empty list - this would need to be implemented based on your specific Redis setup
-	// and how you want to store message lists
-	return []*models.Message{}, nil
-}
\ No newline at end of file
+	if offset < 0 {
+		offset = 0
+	}
+
+	stop := int64(-1)
+	if limit > 0 {
+		stop = int64(offset + limit - 1)
+	}
+
+	ids, err := s.client.ZRange(ctx, conversationMessagesKey(conversationID), int64(offset), stop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message index: %w", err)
+	}
+
+	return s.getMessages(ctx, ids)
+}
+
+// GetConversationMessagesAfter returns up to limit messages whose sequence
+// number is strictly greater than afterSequence, for cursor pagination
+func (s *SessionCache) GetConversationMessagesAfter(ctx context.Context, conversationID string, afterSequence, limit int) ([]*models.Message, error) {
+	opt := &redis.ZRangeBy{
+		Min: fmt.Sprintf("(%d", afterSequence),
+		Max: "+inf",
+	}
+	if limit > 0 {
+		opt.Count = int64(limit)
+	}
+
+	ids, err := s.client.ZRangeByScore(ctx, conversationMessagesKey(conversationID), opt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message index: %w", err)
+	}
+
+	return s.getMessages(ctx, ids)
+}
+
+func (s *SessionCache) CountConversationMessages(ctx context.Context, conversationID string) (int, error) {
+	count, err := s.client.ZCard(ctx, conversationMessagesKey(conversationID))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+	return int(count), nil
+}
+
+func (s *SessionCache) getMessages(ctx context.Context, ids []string) ([]*models.Message, error) {
+	messages := make([]*models.Message, 0, len(ids))
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("message:%s", id)
+	}
+
+	values, err := s.client.MGet(ctx, keys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+
+	for _, value := range values {
+		// Skip index entries whose message has already expired
+		messageJSON, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var message models.Message
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		messages = append(messages, &message)
+	}
+
+	return messages, nil
+}
+
+func conversationSequenceKey(conversationID string) string {
+	return fmt.Sprintf("conversation:%s:seq", conversationID)
+}
+
+func conversationMessagesKey(conversationID string) string {
+	return fmt.Sprintf("conversation:%s:messages", conversationID)
+}
+
+func (s *SessionCache) StoreWebpageContent(ctx context.Context, conversationID string, content *models.WebpageContent) error {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webpage content: %w", err)
+	}
+
+	key := fmt.Sprintf("webpage:%s", conversationID)
+	return s.client.Set(ctx, key, contentJSON, 30*24*time.Hour) // 30 days
+}
+
+func (s *SessionCache) GetWebpageContent(ctx context.Context, conversationID string) (*models.WebpageContent, error) {
+	key := fmt.Sprintf("webpage:%s", conversationID)
+	contentJSON, err := s.client.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webpage content: %w", err)
+	}
+
+	var content models.WebpageContent
+	if err := json.Unmarshal([]byte(contentJSON), &content); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webpage content: %w", err)
+	}
+
+	return &content, nil
+}
+
+func (s *SessionCache) StoreLLMResponse(ctx context.Context, response *models.LLMResponse) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal LLM response: %w", err)
+	}
+
+	key := fmt.Sprintf("llm_response:%s", response.ID)
+	return s.client.Set(ctx, key, responseJSON, 30*24*time.Hour) // 30 days
+}
+
+func pageChunksKey(contentHash, model string) string {
+	return fmt.Sprintf("page_chunks:%s:%s", model, contentHash)
+}
+
+// StorePageChunks keeps the embedded chunks of page content for as long as
+// conversations are kept
+func (s *SessionCache) StorePageChunks(ctx context.Context, contentHash, model string, chunks []*models.PageChunk) error {
+	chunksJSON, err := json.Marshal(chunks)
+	if err != nil {
+		return fmt.Errorf("failed to marshal page chunks: %w", err)
+	}
+
+	return s.client.Set(ctx, pageChunksKey(contentHash, model), chunksJSON, 30*24*time.Hour) // 30 days
+}
+
+func (s *SessionCache) GetPageChunks(ctx context.Context, contentHash, model string) ([]*models.PageChunk, error) {
+	chunksJSON, err := s.client.Get(ctx, pageChunksKey(contentHash, model))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page chunks: %w", err)
+	}
+
+	var chunks []*models.PageChunk
+	if err := json.Unmarshal([]byte(chunksJSON), &chunks); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal page chunks: %w", err)
+	}
+
+	return chunks, nil
+}
+
+// StoreAttachment keeps an attached image for as long as conversations are kept
+func (s *SessionCache) StoreAttachment(ctx context.Context, attachment *models.Attachment) error {
+	attachmentJSON, err := json.Marshal(attachment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment: %w", err)
+	}
+
+	key := fmt.Sprintf("attachment:%s", attachment.ID)
+	return s.client.Set(ctx, key, attachmentJSON, 30*24*time.Hour) // 30 days
+}
+
+func (s *SessionCache) GetAttachment(ctx context.Context, attachmentID string) (*models.Attachment, error) {
+	key := fmt.Sprintf("attachment:%s", attachmentID)
+	attachmentJSON, err := s.client.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+
+	var attachment models.Attachment
+	if err := json.Unmarshal([]byte(attachmentJSON), &attachment); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attachment: %w", err)
+	}
+
+	return &attachment, nil
+}
+
+func (s *SessionCache) DeleteConversation(ctx context.Context, conversationID string) error {
+	key := fmt.Sprintf("conversation:%s", conversationID)
+	return s.client.Delete(ctx, key)
+}
+
+// Usage counters are kept per scope ("session:<id>" or "user:<id>") in one
+// hash per UTC day and month, long enough for the period to be queried
+var usagePeriods = map[string]struct {
+	layout string
+	ttl    time.Duration
+}{
+	"day":   {"2006-01-02", 48 * time.Hour},
+	"month": {"2006-01", 32 * 24 * time.Hour},
+}
+
+func usageKey(scope, period string, t time.Time) string {
+	return fmt.Sprintf("usage:%s:%s", scope, t.UTC().Format(usagePeriods[period].layout))
+}
+
+// RecordUsage adds the record to the daily and monthly counters of its
+// session and, when known, its user
+func (s *SessionCache) RecordUsage(ctx context.Context, record *models.UsageRecord) error {
+	scopes := []string{"session:" + record.SessionID}
+	if record.UserID != "" {
+		scopes = append(scopes, "user:"+record.UserID)
+	}
+
+	return s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, scope := range scopes {
+			for period, settings := range usagePeriods {
+				key := usageKey(scope, period, record.CreatedAt)
+				pipe.HIncrBy(ctx, key, "requests", 1)
+				pipe.HIncrBy(ctx, key, "prompt_tokens", int64(record.PromptTokens))
+				pipe.HIncrBy(ctx, key, "completion_tokens", int64(record.CompletionTokens))
+				pipe.HIncrByFloat(ctx, key, "cost", record.Cost)
+				if record.Estimated {
+					pipe.HIncrBy(ctx, key, "estimated_tokens", int64(record.TotalTokens))
+				}
+				pipe.Expire(ctx, key, settings.ttl)
+			}
+		}
+		return nil
+	})
+}
+
+// GetUsage returns the counters of a scope such as "session:<id>" for the
+// current "day" or "month"
+func (s *SessionCache) GetUsage(ctx context.Context, scope, period string) (*models.UsageTotals, error) {
+	values, err := s.client.HGetAll(ctx, usageKey(scope, period, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	totals := &models.UsageTotals{}
+	totals.Requests, _ = strconv.Atoi(values["requests"])
+	totals.PromptTokens, _ = strconv.Atoi(values["prompt_tokens"])
+	totals.CompletionTokens, _ = strconv.Atoi(values["completion_tokens"])
+	totals.TotalTokens = totals.PromptTokens + totals.CompletionTokens
+	totals.Cost, _ = strconv.ParseFloat(values["cost"], 64)
+	totals.EstimatedTokens, _ = strconv.Atoi(values["estimated_tokens"])
+	return totals, nil
+}
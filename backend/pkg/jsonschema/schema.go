@@ -0,0 +1,325 @@
+// Package jsonschema validates JSON values against the subset of JSON Schema
+// that is useful to describe data extracted by an LLM: types, enums, object
+// properties, arrays and simple string and number bounds. Unsupported
+// keywords are ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidSchema is returned when a schema cannot be parsed
+var ErrInvalidSchema = errors.New("invalid JSON schema")
+
+var validTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// Schema is a parsed JSON Schema
+type Schema struct {
+	Types      []string
+	Enum       []interface{}
+	Const      interface{}
+	hasConst   bool
+	Properties map[string]*Schema
+	Required   []string
+	// Additional validates properties not listed in Properties. It is nil
+	// when they are allowed without constraint.
+	Additional   *Schema
+	NoAdditional bool
+	Items        *Schema
+	MinItems     *int
+	MaxItems     *int
+	MinLength    *int
+	MaxLength    *int
+	Minimum      *float64
+	Maximum      *float64
+	Pattern      *regexp.Regexp
+	AnyOf        []*Schema
+}
+
+type rawSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []interface{}              `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	Pattern              string                     `json:"pattern"`
+	AnyOf                []json.RawMessage          `json:"anyOf"`
+	OneOf                []json.RawMessage          `json:"oneOf"`
+}
+
+// Parse parses a schema, failing on malformed JSON, unknown types and
+// invalid patterns
+func Parse(data []byte) (*Schema, error) {
+	schema, err := parse(data, "$")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return schema, nil
+}
+
+func parse(data []byte, path string) (*Schema, error) {
+	var raw rawSchema
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	schema := &Schema{
+		Enum:      raw.Enum,
+		Required:  raw.Required,
+		MinItems:  raw.MinItems,
+		MaxItems:  raw.MaxItems,
+		MinLength: raw.MinLength,
+		MaxLength: raw.MaxLength,
+		Minimum:   raw.Minimum,
+		Maximum:   raw.Maximum,
+	}
+
+	if len(raw.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(raw.Type, &single); err == nil {
+			schema.Types = []string{single}
+		} else if err := json.Unmarshal(raw.Type, &schema.Types); err != nil {
+			return nil, fmt.Errorf("%s: type must be a string or an array of strings", path)
+		}
+		for _, t := range schema.Types {
+			if !validTypes[t] {
+				return nil, fmt.Errorf("%s: unknown type %q", path, t)
+			}
+		}
+	}
+
+	if len(raw.Const) > 0 {
+		if err := json.Unmarshal(raw.Const, &schema.Const); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		schema.hasConst = true
+	}
+
+	if len(raw.Properties) > 0 {
+		schema.Properties = make(map[string]*Schema, len(raw.Properties))
+		for name, data := range raw.Properties {
+			property, err := parse(data, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			schema.Properties[name] = property
+		}
+	}
+
+	if len(raw.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(raw.AdditionalProperties, &allowed); err == nil {
+			schema.NoAdditional = !allowed
+		} else {
+			additional, err := parse(raw.AdditionalProperties, path+".additionalProperties")
+			if err != nil {
+				return nil, err
+			}
+			schema.Additional = additional
+		}
+	}
+
+	if len(raw.Items) > 0 {
+		items, err := parse(raw.Items, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		schema.Items = items
+	}
+
+	if raw.Pattern != "" {
+		pattern, err := regexp.Compile(raw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern: %v", path, err)
+		}
+		schema.Pattern = pattern
+	}
+
+	// oneOf is checked like anyOf, which is close enough for the disjoint
+	// alternatives it is normally used with
+	for _, data := range append(raw.AnyOf, raw.OneOf...) {
+		alternative, err := parse(data, path)
+		if err != nil {
+			return nil, err
+		}
+		schema.AnyOf = append(schema.AnyOf, alternative)
+	}
+
+	return schema, nil
+}
+
+// ValidationError lists every place a value does not match its schema
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Validate checks a value decoded by encoding/json against the schema
+func (s *Schema) Validate(value interface{}) error {
+	var problems []string
+	s.validate(value, "$", &problems)
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (s *Schema) validate(value interface{}, path string, problems *[]string) {
+	report := func(format string, args ...interface{}) {
+		*problems = append(*problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Types) > 0 && !s.matchesType(value) {
+		report("expected %s, got %s", strings.Join(s.Types, " or "), typeOf(value))
+		return
+	}
+
+	if s.hasConst && !reflect.DeepEqual(value, s.Const) {
+		report("must be %v", s.Const)
+	}
+	if len(s.Enum) > 0 && !contains(s.Enum, value) {
+		report("must be one of %v", s.Enum)
+	}
+
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, alternative := range s.AnyOf {
+			var ignored []string
+			alternative.validate(value, path, &ignored)
+			if len(ignored) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			report("does not match any of the allowed schemas")
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		s.validateObject(v, path, problems)
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			report("expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			report("expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			report("expected at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			report("expected at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(v) {
+			report("does not match pattern %s", s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			report("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			report("must be at most %v", *s.Maximum)
+		}
+	}
+}
+
+func (s *Schema) validateObject(object map[string]interface{}, path string, problems *[]string) {
+	for _, name := range s.Required {
+		if _, exists := object[name]; !exists {
+			*problems = append(*problems, fmt.Sprintf("%s: missing required property %q", path, name))
+		}
+	}
+
+	// Sorted so problems are reported in a stable order
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if property, exists := s.Properties[name]; exists {
+			property.validate(object[name], path+"."+name, problems)
+		} else if s.NoAdditional {
+			*problems = append(*problems, fmt.Sprintf("%s: unexpected property %q", path, name))
+		} else if s.Additional != nil {
+			s.Additional.validate(object[name], path+"."+name, problems)
+		}
+	}
+}
+
+func (s *Schema) matchesType(value interface{}) bool {
+	for _, t := range s.Types {
+		switch t {
+		case "integer":
+			if n, ok := value.(float64); ok && n == math.Trunc(n) {
+				return true
+			}
+		default:
+			if typeOf(value) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// typeOf names the JSON type of a value decoded by encoding/json
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,411 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicDefaultBaseURL   = "https://api.anthropic.com"
+	anthropicDefaultModel     = "claude-3-5-sonnet-latest"
+	anthropicAPIVersion       = "2023-06-01"
+	anthropicDefaultMaxTokens = 1024
+)
+
+// AnthropicProvider implements the LLMProvider interface for the Anthropic Messages API
+type AnthropicProvider struct {
+	client   *http.Client
+	model    string
+	provider string
+	baseURL  string
+	apiKey   string
+	// maxTokens and temperature apply unless a request sets its own
+	maxTokens   int
+	temperature *float64
+}
+
+// NewAnthropicProvider creates a new Anthropic provider
+func NewAnthropicProvider(apiKey, baseURL, model string) (*AnthropicProvider, error) {
+	if apiKey == "" {
+		return nil, errors.New("API key is required")
+	}
+
+	if model == "" {
+		model = anthropicDefaultModel
+	}
+
+	if baseURL == "" {
+		baseURL = anthropicDefaultBaseURL
+	}
+
+	return &AnthropicProvider{
+		client:    &http.Client{},
+		model:     model,
+		provider:  "anthropic",
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		apiKey:    apiKey,
+		maxTokens: anthropicDefaultMaxTokens,
+	}, nil
+}
+
+// SetDefaults sets the max_tokens and temperature of requests that do not
+// set their own. The Messages API requires max_tokens, so a non-positive
+// value keeps the built-in default.
+func (p *AnthropicProvider) SetDefaults(maxTokens int, temperature float64) {
+	if maxTokens > 0 {
+		p.maxTokens = maxTokens
+	}
+	p.temperature = &temperature
+}
+
+// EmbeddingModel is empty since Anthropic offers no embeddings API
+func (p *AnthropicProvider) EmbeddingModel() string {
+	return ""
+}
+
+func (p *AnthropicProvider) Embed(ctx context.Context, texts []string, options ...EmbedOption) (*Embeddings, error) {
+	return nil, ErrEmbeddingsNotSupported
+}
+
+func (p *AnthropicProvider) GetModel() string {
+	return p.model
+}
+
+func (p *AnthropicProvider) GetProvider() string {
+	return p.provider
+}
+
+func (p *AnthropicProvider) Validate() error {
+	if p.apiKey == "" {
+		return errors.New("API key is required")
+	}
+
+	if p.client == nil {
+		return errors.New("Anthropic client is not initialized")
+	}
+
+	return nil
+}
+
+func (p *AnthropicProvider) Generate(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.GenerateStream(ctx, prompt, options...)
+}
+
+func (p *AnthropicProvider) GenerateStream(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.Chat(ctx, []ChatMessage{{Role: RoleUser, Content: prompt}}, options...)
+}
+
+// anthropicMessage is a single entry of the Messages API "messages" array
+type anthropicMessage struct {
+	Role    string
+	Content string
+	Images  []Image
+}
+
+// anthropicBlock is a content block, used for messages with images
+type anthropicBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// MarshalJSON sends the content as a plain string unless the message has
+// images, which need content blocks
+func (m anthropicMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Images) == 0 {
+		return json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{m.Role, m.Content})
+	}
+
+	blocks := make([]anthropicBlock, 0, len(m.Images)+1)
+	for _, image := range m.Images {
+		blocks = append(blocks, anthropicBlock{Type: "image", Source: &anthropicImageSource{
+			Type:      "base64",
+			MediaType: image.MediaType,
+			Data:      base64.StdEncoding.EncodeToString(image.Data),
+		}})
+	}
+	if m.Content != "" {
+		blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+	}
+	return json.Marshal(struct {
+		Role    string           `json:"role"`
+		Content []anthropicBlock `json:"content"`
+	}{m.Role, blocks})
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream"`
+}
+
+// anthropicEvent covers the fields of every streaming event type we handle
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type         string `json:"type"`
+		Text         string `json:"text"`
+		Thinking     string `json:"thinking"`
+		StopReason   string `json:"stop_reason"`
+		StopSequence string `json:"stop_sequence"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicError is an error returned by the Anthropic API
+type AnthropicError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *AnthropicError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("anthropic API error (status %d, %s): %s", e.StatusCode, e.Type, e.Message)
+	}
+	return fmt.Sprintf("anthropic API error (%s): %s", e.Type, e.Message)
+}
+
+func (p *AnthropicProvider) Chat(ctx context.Context, messages []ChatMessage, options ...GenerateOption) (<-chan StreamResponse, error) {
+	if len(messages) == 0 {
+		return nil, ErrNoMessages
+	}
+
+	req := anthropicRequest{
+		Model:       p.model,
+		MaxTokens:   p.maxTokens,
+		Temperature: p.temperature,
+		Stream:      true,
+	}
+	req.System, req.Messages = toAnthropicMessages(messages)
+
+	// Apply options
+	for _, option := range options {
+		if option.MaxTokens != nil {
+			req.MaxTokens = *option.MaxTokens
+		}
+		if option.Temperature != nil {
+			req.Temperature = option.Temperature
+		}
+		if option.TopP != nil {
+			req.TopP = option.TopP
+		}
+		if option.Stop != nil {
+			req.StopSequences = option.Stop
+		}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	httpReq.Header.Set("x-api-key", p.apiKey)
+	httpReq.Header.Set("anthropic-version", anthropicAPIVersion)
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message stream: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, withRetryAfter(decodeAnthropicError(resp), resp.Header)
+	}
+
+	responseChan := make(chan StreamResponse)
+
+	go func() {
+		defer close(responseChan)
+		defer resp.Body.Close()
+
+		send := func(response StreamResponse) bool {
+			select {
+			case responseChan <- response:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var usage anthropicUsage
+		var stopReason string
+		var finished bool
+
+		err := readSSE(resp.Body, func(data []byte) bool {
+			var event anthropicEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				send(StreamResponse{Error: fmt.Errorf("failed to decode stream event: %w", err)})
+				finished = true
+				return false
+			}
+
+			switch event.Type {
+			case "message_start":
+				usage.InputTokens = event.Message.Usage.InputTokens
+				usage.OutputTokens = event.Message.Usage.OutputTokens
+			case "content_block_delta":
+				if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+					return send(StreamResponse{Content: event.Delta.Text})
+				}
+				// Extended thinking streams the reasoning in thinking blocks
+				if event.Delta.Type == "thinking_delta" && event.Delta.Thinking != "" {
+					return send(StreamResponse{Reasoning: event.Delta.Thinking})
+				}
+			case "message_delta":
+				if event.Delta.StopReason != "" {
+					stopReason = event.Delta.StopReason
+				}
+				if event.Usage.OutputTokens > 0 {
+					usage.OutputTokens = event.Usage.OutputTokens
+				}
+			case "message_stop":
+				finished = true
+				send(StreamResponse{
+					Done:         true,
+					FinishReason: stopReason,
+					Usage: Usage{
+						PromptTokens:     usage.InputTokens,
+						CompletionTokens: usage.OutputTokens,
+						TotalTokens:      usage.InputTokens + usage.OutputTokens,
+					},
+				})
+				return false
+			case "error":
+				finished = true
+				send(StreamResponse{Error: &AnthropicError{Type: event.Error.Type, Message: event.Error.Message}})
+				return false
+			}
+			return true
+		})
+
+		if err != nil {
+			send(StreamResponse{Error: err})
+		} else if !finished {
+			send(StreamResponse{Error: io.ErrUnexpectedEOF})
+		}
+	}()
+
+	return responseChan, nil
+}
+
+// toAnthropicMessages moves system messages into the separate system prompt
+// and merges consecutive messages of the same role, which the API rejects.
+// Tool calling is not supported, so tool calls and results made with
+// another provider before a fallback are written out as text.
+func toAnthropicMessages(messages []ChatMessage) (string, []anthropicMessage) {
+	var system []string
+	var result []anthropicMessage
+
+	for _, message := range messages {
+		if message.Role == RoleSystem {
+			system = append(system, message.Content)
+			continue
+		}
+
+		role, content := string(message.Role), message.Content
+		for _, call := range message.ToolCalls {
+			content = strings.TrimSpace(content + "\n\nCalled tool " + call.Name + " with " + call.Arguments)
+		}
+		if message.Role == RoleTool {
+			role, content = string(RoleUser), "Tool result:\n"+content
+		}
+
+		if n := len(result); n > 0 && result[n-1].Role == role {
+			result[n-1].Content += "\n\n" + content
+			result[n-1].Images = append(result[n-1].Images, message.Images...)
+			continue
+		}
+		result = append(result, anthropicMessage{Role: role, Content: content, Images: message.Images})
+	}
+
+	return strings.Join(system, "\n\n"), result
+}
+
+func decodeAnthropicError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var payload anthropicEvent
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error.Message != "" {
+		return &AnthropicError{StatusCode: resp.StatusCode, Type: payload.Error.Type, Message: payload.Error.Message}
+	}
+	return &AnthropicError{StatusCode: resp.StatusCode, Type: "http_error", Message: strings.TrimSpace(string(body))}
+}
+
+// readSSE calls handle with the data of every server-sent event until the
+// stream ends or handle returns false
+func readSSE(r io.Reader, handle func(data []byte) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		// A blank line terminates the event
+		if len(line) == 0 {
+			if data.Len() > 0 {
+				if !handle(data.Bytes()) {
+					return nil
+				}
+				data.Reset()
+			}
+			continue
+		}
+
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(value, []byte(" ")))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if data.Len() > 0 {
+		handle(data.Bytes())
+	}
+	return nil
+}
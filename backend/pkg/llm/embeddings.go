@@ -0,0 +1,145 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// embeddingBatchSize is the number of texts LLMClient sends per embeddings
+// request, well within the input limits of OpenAI and Ollama
+const embeddingBatchSize = 64
+
+var (
+	// ErrEmbeddingsNotSupported is returned when a provider has no embedding model
+	ErrEmbeddingsNotSupported = errors.New("provider does not support embeddings")
+	// ErrNoInput is returned when an embeddings request contains no texts
+	ErrNoInput = errors.New("at least one input is required")
+)
+
+// EmbedOption represents an option for creating embeddings
+type EmbedOption struct {
+	// Dimensions shortens the vectors of models that support it, such as
+	// text-embedding-3-small
+	Dimensions *int
+}
+
+func WithDimensions(dimensions int) EmbedOption {
+	return EmbedOption{Dimensions: &dimensions}
+}
+
+// Embeddings are the vectors of a batch of texts, in the order of the texts
+type Embeddings struct {
+	Vectors    [][]float32
+	Dimensions int
+	Usage      Usage
+	// Provider and Model identify where the vectors come from. Vectors of
+	// different models cannot be compared.
+	Provider string
+	Model    string
+}
+
+// dimensions returns the common length of the vectors
+func dimensions(vectors [][]float32) (int, error) {
+	if len(vectors) == 0 {
+		return 0, nil
+	}
+	for _, vector := range vectors {
+		if len(vector) != len(vectors[0]) {
+			return 0, errors.New("embeddings have different dimensions")
+		}
+	}
+	return len(vectors[0]), nil
+}
+
+// embedder resolves the provider that embeds for the given name: the named
+// provider, or the embedding provider when the name is empty
+func (c *LLMClient) embedder(providerName string) (string, LLMProvider, error) {
+	if providerName == "" {
+		providerName = c.embeddingProvider
+	}
+	if providerName == "" {
+		providerName = c.defaultProvider
+	}
+	provider, exists := c.providers[providerName]
+	if !exists {
+		return "", nil, NewProviderNotFoundError(providerName)
+	}
+	if provider.EmbeddingModel() == "" {
+		return "", nil, ErrEmbeddingsNotSupported
+	}
+	return providerName, provider, nil
+}
+
+// EmbeddingModel returns the model Embed would use for the provider name,
+// so stored vectors can be looked up without embedding anything
+func (c *LLMClient) EmbeddingModel(providerName string) (string, error) {
+	_, provider, err := c.embedder(providerName)
+	if err != nil {
+		return "", err
+	}
+	return provider.EmbeddingModel(), nil
+}
+
+// Embed embeds texts with the named provider, or the embedding provider
+// when the name is empty, in batches of embeddingBatchSize. There is no
+// fallback since vectors of different models cannot be compared.
+func (c *LLMClient) Embed(ctx context.Context, providerName string, texts []string, options ...EmbedOption) (*Embeddings, error) {
+	if len(texts) == 0 {
+		return nil, ErrNoInput
+	}
+	providerName, provider, err := c.embedder(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Embeddings{Provider: providerName, Model: provider.EmbeddingModel()}
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		batch := texts[start:min(start+embeddingBatchSize, len(texts))]
+
+		embeddings, err := provider.Embed(ctx, batch, options...)
+		if err != nil {
+			return nil, err
+		}
+		if len(embeddings.Vectors) != len(batch) {
+			return nil, fmt.Errorf("%s returned %d embeddings for %d texts", providerName, len(embeddings.Vectors), len(batch))
+		}
+
+		result.Vectors = append(result.Vectors, embeddings.Vectors...)
+		result.Usage.PromptTokens += embeddings.Usage.PromptTokens
+		result.Usage.TotalTokens += embeddings.Usage.TotalTokens
+		result.Usage.Estimated = result.Usage.Estimated || embeddings.Usage.Estimated
+	}
+
+	dims, err := dimensions(result.Vectors)
+	if err != nil {
+		return nil, err
+	}
+	result.Dimensions = dims
+	return result, nil
+}
+
+// estimateEmbeddingUsage approximates the usage of an embeddings request for
+// providers that do not report it
+func estimateEmbeddingUsage(texts []string) Usage {
+	var tokens int
+	for _, text := range texts {
+		tokens += EstimateTokens(text)
+	}
+	return Usage{PromptTokens: tokens, TotalTokens: tokens, Estimated: true}
+}
+
+// Embed is retried and circuit broken like chat requests
+func (p *ResilientProvider) Embed(ctx context.Context, texts []string, options ...EmbedOption) (*Embeddings, error) {
+	if p.EmbeddingModel() == "" {
+		return nil, ErrEmbeddingsNotSupported
+	}
+
+	var embeddings *Embeddings
+	err := p.retry(ctx, func() error {
+		var err error
+		embeddings, err = p.LLMProvider.Embed(ctx, texts, options...)
+		return err
+	})
+	return embeddings, err
+}
@@ -0,0 +1,247 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// providerChain returns the names of the providers to try for a request: the
+// named provider, or the default one when the name is unknown, followed by
+// its registered fallbacks
+func (c *LLMClient) providerChain(providerName string) []string {
+	primary := providerName
+	if _, exists := c.providers[primary]; !exists {
+		primary = c.defaultProvider
+	}
+	if _, exists := c.providers[primary]; !exists {
+		return nil
+	}
+
+	chain := []string{primary}
+	seen := map[string]bool{primary: true}
+	for _, name := range c.fallbacks[primary] {
+		if _, exists := c.providers[name]; exists && !seen[name] {
+			chain = append(chain, name)
+			seen[name] = true
+		}
+	}
+
+	// Try providers with an open circuit last, they fail immediately anyway
+	var available, unavailable []string
+	for _, name := range chain {
+		if breaker := breakerOf(c.providers[name]); breaker != nil && breaker.State() == BreakerOpen {
+			unavailable = append(unavailable, name)
+		} else {
+			available = append(available, name)
+		}
+	}
+	return append(available, unavailable...)
+}
+
+// withFallback starts a stream on each provider of the chain in turn until
+// one produces output. A provider is skipped only when it fails with a
+// retryable error before emitting any content, so callers never see a
+// partial answer from one provider continued by another. A provider that
+// sends nothing within the first token timeout counts as timed out.
+func (c *LLMClient) withFallback(ctx context.Context, providerName string, chain []string, start func(context.Context, LLMProvider) (<-chan StreamResponse, error)) (<-chan StreamResponse, error) {
+	if len(chain) == 0 {
+		return nil, NewProviderNotFoundError(providerName)
+	}
+
+	var err error
+	for i, name := range chain {
+		provider := c.providers[name]
+
+		// The attempt is cancelled when it times out, or once its stream
+		// has been delivered
+		attemptCtx, cancel := context.WithCancel(ctx)
+		var stream <-chan StreamResponse
+		var pending []StreamResponse
+		stream, pending, err = c.openWithin(attemptCtx, cancel, func() (<-chan StreamResponse, error) {
+			return start(attemptCtx, provider)
+		})
+		if err == nil {
+			model := provider.GetModel()
+			return replay(ctx, pending, stream, func(response *StreamResponse) {
+				response.Provider = name
+				response.Model = model
+			}, cancel), nil
+		}
+		cancel()
+
+		if i == len(chain)-1 || ctx.Err() != nil || !IsRetryable(err) {
+			return nil, err
+		}
+		log.Printf("LLM provider %s failed, falling back: %v", name, err)
+	}
+
+	return nil, err
+}
+
+// openWithin opens a stream, giving up with context.DeadlineExceeded when
+// nothing arrives within the first token timeout. cancel stops the attempt,
+// whose stream is then discarded.
+func (c *LLMClient) openWithin(ctx context.Context, cancel context.CancelFunc, start func() (<-chan StreamResponse, error)) (<-chan StreamResponse, []StreamResponse, error) {
+	if c.firstTokenTimeout <= 0 {
+		return open(start)
+	}
+
+	type opened struct {
+		stream  <-chan StreamResponse
+		pending []StreamResponse
+		err     error
+	}
+	result := make(chan opened, 1)
+	go func() {
+		stream, pending, err := open(start)
+		result <- opened{stream, pending, err}
+	}()
+
+	timer := time.NewTimer(c.firstTokenTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-result:
+		return r.stream, r.pending, r.err
+	case <-timer.C:
+		cancel()
+		go func() {
+			if r := <-result; r.stream != nil {
+				drain(r.stream)
+			}
+		}()
+		return nil, nil, fmt.Errorf("no output within %s: %w", c.firstTokenTimeout, context.DeadlineExceeded)
+	}
+}
+
+// open starts a stream and holds back chunks until the first content or
+// tool call arrives. A failure before that point is returned as the error so the
+// request can still be retried or sent elsewhere.
+func open(start func() (<-chan StreamResponse, error)) (<-chan StreamResponse, []StreamResponse, error) {
+	stream, err := start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pending []StreamResponse
+	for chunk := range stream {
+		if chunk.Error != nil {
+			drain(stream)
+			return nil, nil, chunk.Error
+		}
+		pending = append(pending, chunk)
+		if chunk.Content != "" || chunk.Reasoning != "" || len(chunk.ToolCalls) > 0 || chunk.Done {
+			break
+		}
+	}
+	return stream, pending, nil
+}
+
+// replay sends the held back chunks and then the rest of the stream,
+// applying tag to each chunk when given. done, when given, is called once
+// the stream has been delivered or abandoned.
+func replay(ctx context.Context, pending []StreamResponse, stream <-chan StreamResponse, tag func(*StreamResponse), done func()) <-chan StreamResponse {
+	responseChan := make(chan StreamResponse)
+
+	go func() {
+		defer close(responseChan)
+		if done != nil {
+			defer done()
+		}
+		defer drain(stream)
+
+		send := func(response StreamResponse) bool {
+			if tag != nil {
+				tag(&response)
+			}
+			select {
+			case responseChan <- response:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, chunk := range pending {
+			if !send(chunk) {
+				return
+			}
+		}
+		for chunk := range stream {
+			if !send(chunk) {
+				return
+			}
+		}
+	}()
+
+	return responseChan
+}
+
+// drain discards the rest of a stream so its producer can finish
+func drain(stream <-chan StreamResponse) {
+	for range stream {
+	}
+}
+
+// IsRetryable reports whether err is a transient provider failure: a server
+// error, a rate limit, a timeout or an unreachable server
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var circuitErr *CircuitOpenError
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &circuitErr) {
+		return true
+	}
+
+	if status := statusCode(err); status != 0 {
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// statusCode extracts the HTTP status of a provider error, or 0 when the
+// error did not come from an HTTP response
+func statusCode(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode
+	}
+
+	var anthropicErr *AnthropicError
+	if errors.As(err, &anthropicErr) {
+		if anthropicErr.StatusCode != 0 {
+			return anthropicErr.StatusCode
+		}
+		// Errors sent mid-stream carry only their type
+		switch anthropicErr.Type {
+		case "rate_limit_error":
+			return http.StatusTooManyRequests
+		case "overloaded_error", "api_error":
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+
+	var ollamaErr *OllamaError
+	if errors.As(err, &ollamaErr) {
+		return ollamaErr.StatusCode
+	}
+
+	return 0
+}
@@ -2,24 +2,81 @@ package llm
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
 )
 
+// ErrNoMessages is returned when a chat request contains no messages
+var ErrNoMessages = errors.New("at least one message is required")
+
 // LLMProvider defines the interface for an LLM provider
 type LLMProvider interface {
 	GetModel() string
 	GetProvider() string
 	Generate(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error)
 	GenerateStream(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error)
+	Chat(ctx context.Context, messages []ChatMessage, options ...GenerateOption) (<-chan StreamResponse, error)
+	// Embed returns one vector per text. Providers without an embedding
+	// model return ErrEmbeddingsNotSupported.
+	Embed(ctx context.Context, texts []string, options ...EmbedOption) (*Embeddings, error)
+	// EmbeddingModel is empty when the provider cannot embed
+	EmbeddingModel() string
 	Validate() error
 }
 
+// Role identifies the author of a chat message
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+	// RoleTool messages carry the result of a tool call
+	RoleTool Role = "tool"
+)
+
+// ChatMessage represents a single role-tagged message in a conversation
+type ChatMessage struct {
+	Role    Role
+	Content string
+	// ToolCalls are the tools an assistant message asked to call
+	ToolCalls []ToolCall
+	// ToolCallID links a tool message to the call it answers
+	ToolCallID string
+	// Images are sent along with the content to models that accept them
+	Images []Image
+}
+
+// Image is an encoded image, such as a PNG screenshot of the visible tab
+type Image struct {
+	MediaType string
+	Data      []byte
+}
+
+// DataURL encodes the image as a data: URL
+func (i Image) DataURL() string {
+	return "data:" + i.MediaType + ";base64," + base64.StdEncoding.EncodeToString(i.Data)
+}
+
 // StreamResponse represents a single response from the LLM stream
 type StreamResponse struct {
-	Content     string
-	Done        bool
-	Error       error
-	Usage       Usage
+	Content      string
+	Done         bool
+	Error        error
+	Usage        Usage
 	FinishReason string
+	// Reasoning is the thinking of a reasoning model, streamed before the
+	// answer and kept apart from Content
+	Reasoning string
+	// ToolCalls are fragments of the tools the model calls, to be put
+	// together with a ToolCallBuilder
+	ToolCalls []ToolCallDelta
+	// Provider and Model identify who actually answered, which differs from
+	// the requested provider after a fallback. Set by LLMClient.
+	Provider string
+	Model    string
 }
 
 // Usage represents token usage
@@ -27,6 +84,10 @@ type Usage struct {
 	PromptTokens     int
 	CompletionTokens int
 	TotalTokens      int
+	// Estimated is set when the provider did not report usage and the
+	// counts were approximated from the text length with EstimateTokens,
+	// without the model's tokenizer. Such counts are rough.
+	Estimated bool
 }
 
 // GenerateOption represents an option for generating text
@@ -35,8 +96,28 @@ type GenerateOption struct {
 	Temperature *float64
 	TopP        *float64
 	Stop        []string
+	// ResponseFormat asks for JSON output matching a schema, using the
+	// provider's JSON mode where it has one
+	ResponseFormat *ResponseFormat
+	// Tools the model may call instead of answering. Providers without
+	// tool support ignore them.
+	Tools []Tool
 }
 
+// ResponseFormat describes the JSON output expected from the model
+type ResponseFormat struct {
+	Name   string
+	Schema json.RawMessage
+}
+
+// JSON modes of OpenAI-compatible endpoints: "schema" constrains the output
+// to the JSON schema, "object" only to valid JSON. Endpoints without a JSON
+// mode rely on instructions and validation alone.
+const (
+	JSONModeSchema = "schema"
+	JSONModeObject = "object"
+)
+
 // Option functions
 func WithMaxTokens(maxTokens int) GenerateOption {
 	return GenerateOption{MaxTokens: &maxTokens}
@@ -54,15 +135,40 @@ func WithStop(stop []string) GenerateOption {
 	return GenerateOption{Stop: stop}
 }
 
+func WithJSONSchema(name string, schema json.RawMessage) GenerateOption {
+	return GenerateOption{ResponseFormat: &ResponseFormat{Name: name, Schema: schema}}
+}
+
+func WithTools(tools ...Tool) GenerateOption {
+	return GenerateOption{Tools: tools}
+}
+
 // LLMClient manages multiple LLM providers
 type LLMClient struct {
-	providers map[string]LLMProvider
-	defaultProvider string
+	providers         map[string]LLMProvider
+	defaultProvider   string
+	fallbacks         map[string][]string
+	limits            map[string]Limits
+	vision            map[string]bool
+	embeddingProvider string
+	// firstTokenTimeout bounds the wait for a provider's first output
+	// before falling back, zero for no bound
+	firstTokenTimeout time.Duration
+}
+
+// Limits describes the token budget of a provider's model. Zero values mean
+// unknown.
+type Limits struct {
+	ContextWindow   int
+	MaxOutputTokens int
 }
 
 func NewLLMClient() *LLMClient {
 	return &LLMClient{
 		providers: make(map[string]LLMProvider),
+		fallbacks: make(map[string][]string),
+		limits:    make(map[string]Limits),
+		vision:    make(map[string]bool),
 	}
 }
 
@@ -91,17 +197,87 @@ func (c *LLMClient) GetDefaultProvider() (LLMProvider, bool) {
 	return c.GetProvider(c.defaultProvider)
 }
 
+// SetFallbacks sets the providers tried in order when the named provider
+// fails before producing any output
+func (c *LLMClient) SetFallbacks(name string, fallbacks []string) {
+	c.fallbacks[name] = fallbacks
+}
+
+// SetFirstTokenTimeout sets how long a provider may take to send its first
+// output before the next provider of its fallback chain is tried
+func (c *LLMClient) SetFirstTokenTimeout(timeout time.Duration) {
+	c.firstTokenTimeout = timeout
+}
+
+// SetEmbeddingProvider sets the provider that embeds text when no provider
+// is named
+func (c *LLMClient) SetEmbeddingProvider(name string) {
+	c.embeddingProvider = name
+}
+
+// SetLimits sets the token limits of the named provider's model
+func (c *LLMClient) SetLimits(name string, limits Limits) {
+	c.limits[name] = limits
+}
+
+// Limits returns the token limits a request to the named provider must fit
+// in. Since any provider of the fallback chain may end up answering, these
+// are the smallest known limits along the chain.
+func (c *LLMClient) Limits(providerName string) Limits {
+	var result Limits
+	for _, name := range c.providerChain(providerName) {
+		limits := c.limits[name]
+		if limits.ContextWindow > 0 && (result.ContextWindow == 0 || limits.ContextWindow < result.ContextWindow) {
+			result.ContextWindow = limits.ContextWindow
+		}
+		if limits.MaxOutputTokens > 0 && (result.MaxOutputTokens == 0 || limits.MaxOutputTokens < result.MaxOutputTokens) {
+			result.MaxOutputTokens = limits.MaxOutputTokens
+		}
+	}
+	return result
+}
+
+// SetVision declares whether the named provider's model accepts images
+func (c *LLMClient) SetVision(name string, supported bool) {
+	c.vision[name] = supported
+}
+
+// SupportsVision reports whether the provider a request to the named
+// provider goes to first accepts images. Fallbacks that do not are skipped
+// for chats with images.
+func (c *LLMClient) SupportsVision(providerName string) bool {
+	chain := c.providerChain(providerName)
+	return len(chain) > 0 && c.vision[chain[0]]
+}
+
 func (c *LLMClient) Generate(ctx context.Context, providerName, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
-	provider, exists := c.GetProvider(providerName)
-	if !exists {
-		// Try to use the default provider
-		provider, exists = c.GetDefaultProvider()
-		if !exists {
-			return nil, NewProviderNotFoundError(providerName)
+	return c.withFallback(ctx, providerName, c.providerChain(providerName), func(ctx context.Context, provider LLMProvider) (<-chan StreamResponse, error) {
+		return provider.GenerateStream(ctx, prompt, options...)
+	})
+}
+
+// Chat sends an ordered list of chat messages to the named provider, falling
+// back to the default provider when the name is unknown and along the
+// provider's fallback chain when it fails. Messages with images only go to
+// providers that accept them.
+func (c *LLMClient) Chat(ctx context.Context, providerName string, messages []ChatMessage, options ...GenerateOption) (<-chan StreamResponse, error) {
+	chain := c.providerChain(providerName)
+	if hasImages(messages) {
+		var capable []string
+		for _, name := range chain {
+			if c.vision[name] {
+				capable = append(capable, name)
+			}
+		}
+		if len(capable) == 0 && len(chain) > 0 {
+			return nil, &VisionNotSupportedError{ProviderName: chain[0]}
 		}
+		chain = capable
 	}
 
-	return provider.GenerateStream(ctx, prompt, options...)
+	return c.withFallback(ctx, providerName, chain, func(ctx context.Context, provider LLMProvider) (<-chan StreamResponse, error) {
+		return provider.Chat(ctx, messages, options...)
+	})
 }
 
 // ProviderNotFoundError indicates that the requested provider was not found
@@ -115,4 +291,23 @@ func (e *ProviderNotFoundError) Error() string {
 
 func NewProviderNotFoundError(providerName string) error {
 	return &ProviderNotFoundError{ProviderName: providerName}
+}
+
+// VisionNotSupportedError is returned for chats with images when neither the
+// provider nor any of its fallbacks accepts images
+type VisionNotSupportedError struct {
+	ProviderName string
+}
+
+func (e *VisionNotSupportedError) Error() string {
+	return "LLM provider does not accept images: " + e.ProviderName
+}
+
+func hasImages(messages []ChatMessage) bool {
+	for _, message := range messages {
+		if len(message.Images) > 0 {
+			return true
+		}
+	}
+	return false
 }
\ No newline at end of file
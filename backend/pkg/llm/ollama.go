@@ -0,0 +1,434 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	ollamaDefaultBaseURL = "http://localhost:11434"
+	ollamaDefaultModel   = "llama3.1"
+)
+
+// OllamaProvider implements the LLMProvider interface for models served
+// locally by Ollama, using the streaming /api/chat endpoint
+type OllamaProvider struct {
+	client         *http.Client
+	model          string
+	provider       string
+	baseURL        string
+	embeddingModel string
+	tools          bool
+}
+
+// NewOllamaProvider creates a new Ollama provider. No API key is needed since
+// the server runs locally.
+func NewOllamaProvider(baseURL, model string) (*OllamaProvider, error) {
+	if model == "" {
+		model = ollamaDefaultModel
+	}
+
+	if baseURL == "" {
+		baseURL = ollamaDefaultBaseURL
+	}
+
+	return &OllamaProvider{
+		client:   &http.Client{},
+		model:    model,
+		provider: "ollama",
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+func (p *OllamaProvider) GetModel() string {
+	return p.model
+}
+
+func (p *OllamaProvider) GetProvider() string {
+	return p.provider
+}
+
+// SetEmbeddingModel enables Embed with a locally pulled embedding model such
+// as nomic-embed-text
+func (p *OllamaProvider) SetEmbeddingModel(model string) {
+	p.embeddingModel = model
+}
+
+// SetTools enables tool calling, for models trained for it such as llama3.1
+func (p *OllamaProvider) SetTools(enabled bool) {
+	p.tools = enabled
+}
+
+func (p *OllamaProvider) EmbeddingModel() string {
+	return p.embeddingModel
+}
+
+func (p *OllamaProvider) Validate() error {
+	if p.baseURL == "" {
+		return errors.New("base URL is required")
+	}
+
+	if p.client == nil {
+		return errors.New("Ollama client is not initialized")
+	}
+
+	return nil
+}
+
+func (p *OllamaProvider) Generate(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.GenerateStream(ctx, prompt, options...)
+}
+
+func (p *OllamaProvider) GenerateStream(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.Chat(ctx, []ChatMessage{{Role: RoleUser, Content: prompt}}, options...)
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	// Images are base64 encoded without a data: prefix
+	Images []string `json:"images,omitempty"`
+	// Thinking is the reasoning of thinking models, only in responses
+	Thinking string `json:"thinking,omitempty"`
+}
+
+// ollamaToolCall carries the arguments as a JSON object rather than a string
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaOptions struct {
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Options  ollamaOptions   `json:"options"`
+	// Format is a JSON schema the output must follow
+	Format json.RawMessage `json:"format,omitempty"`
+	Tools  []ollamaTool    `json:"tools,omitempty"`
+}
+
+// ollamaChunk is one line of the NDJSON response stream
+type ollamaChunk struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+// OllamaError is an error reported by the Ollama server
+type OllamaError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *OllamaError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("ollama error (status %d): %s", e.StatusCode, e.Message)
+	}
+	return "ollama error: " + e.Message
+}
+
+func (p *OllamaProvider) Chat(ctx context.Context, messages []ChatMessage, options ...GenerateOption) (<-chan StreamResponse, error) {
+	if len(messages) == 0 {
+		return nil, ErrNoMessages
+	}
+
+	req := ollamaRequest{
+		Model:  p.model,
+		Stream: true,
+	}
+	for _, message := range messages {
+		req.Messages = append(req.Messages, toOllamaMessage(message))
+	}
+
+	// Apply options
+	for _, option := range options {
+		if option.MaxTokens != nil {
+			req.Options.NumPredict = option.MaxTokens
+		}
+		if option.Temperature != nil {
+			req.Options.Temperature = option.Temperature
+		}
+		if option.TopP != nil {
+			req.Options.TopP = option.TopP
+		}
+		if option.Stop != nil {
+			req.Options.Stop = option.Stop
+		}
+		if option.ResponseFormat != nil {
+			req.Format = option.ResponseFormat.Schema
+		}
+		if option.Tools != nil && p.tools {
+			req.Tools = toOllamaTools(option.Tools)
+		}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chat stream: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, withRetryAfter(decodeOllamaError(resp), resp.Header)
+	}
+
+	responseChan := make(chan StreamResponse)
+
+	go func() {
+		defer close(responseChan)
+		defer resp.Body.Close()
+
+		send := func(response StreamResponse) bool {
+			select {
+			case responseChan <- response:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		// Ollama sends each tool call whole, without an ID
+		var completion strings.Builder
+		var toolCallCount int
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			var chunk ollamaChunk
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				send(StreamResponse{Error: fmt.Errorf("failed to decode stream chunk: %w", err)})
+				return
+			}
+
+			if chunk.Error != "" {
+				send(StreamResponse{Error: &OllamaError{Message: chunk.Error}})
+				return
+			}
+
+			completion.WriteString(chunk.Message.Thinking)
+			completion.WriteString(chunk.Message.Content)
+
+			var toolCalls []ToolCallDelta
+			for _, call := range chunk.Message.ToolCalls {
+				toolCalls = append(toolCalls, ToolCallDelta{
+					Index:     toolCallCount,
+					ID:        fmt.Sprintf("call_%d", toolCallCount),
+					Name:      call.Function.Name,
+					Arguments: string(call.Function.Arguments),
+				})
+				completion.Write(call.Function.Arguments)
+				toolCallCount++
+			}
+
+			if chunk.Done {
+				send(StreamResponse{
+					Content:      chunk.Message.Content,
+					Reasoning:    chunk.Message.Thinking,
+					ToolCalls:    toolCalls,
+					Done:         true,
+					FinishReason: chunk.DoneReason,
+					Usage:        ollamaUsage(chunk, messages, completion.String()),
+				})
+				return
+			}
+
+			if chunk.Message.Content != "" || chunk.Message.Thinking != "" || len(toolCalls) > 0 {
+				if !send(StreamResponse{Content: chunk.Message.Content, Reasoning: chunk.Message.Thinking, ToolCalls: toolCalls}) {
+					return
+				}
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			send(StreamResponse{Error: err})
+			return
+		}
+		send(StreamResponse{Error: io.ErrUnexpectedEOF})
+	}()
+
+	return responseChan, nil
+}
+
+type ollamaEmbedRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions *int     `json:"dimensions,omitempty"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+// Embed embeds texts with the configured embedding model using /api/embed
+func (p *OllamaProvider) Embed(ctx context.Context, texts []string, options ...EmbedOption) (*Embeddings, error) {
+	if p.embeddingModel == "" {
+		return nil, ErrEmbeddingsNotSupported
+	}
+	if len(texts) == 0 {
+		return nil, ErrNoInput
+	}
+
+	req := ollamaEmbedRequest{Model: p.embeddingModel, Input: texts}
+	for _, option := range options {
+		if option.Dimensions != nil {
+			req.Dimensions = option.Dimensions
+		}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/embed", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embeddings: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, withRetryAfter(decodeOllamaError(resp), resp.Header)
+	}
+
+	var result ollamaEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings: %w", err)
+	}
+
+	dims, err := dimensions(result.Embeddings)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := estimateEmbeddingUsage(texts)
+	if result.PromptEvalCount > 0 {
+		usage = Usage{PromptTokens: result.PromptEvalCount, TotalTokens: result.PromptEvalCount}
+	}
+
+	return &Embeddings{
+		Vectors:    result.Embeddings,
+		Dimensions: dims,
+		Usage:      usage,
+		Provider:   p.provider,
+		Model:      p.embeddingModel,
+	}, nil
+}
+
+func toOllamaMessage(message ChatMessage) ollamaMessage {
+	converted := ollamaMessage{Role: string(message.Role), Content: message.Content}
+	for _, call := range message.ToolCalls {
+		var toolCall ollamaToolCall
+		toolCall.Function.Name = call.Name
+		toolCall.Function.Arguments = json.RawMessage(call.Arguments)
+		if !json.Valid(toolCall.Function.Arguments) {
+			toolCall.Function.Arguments = json.RawMessage("{}")
+		}
+		converted.ToolCalls = append(converted.ToolCalls, toolCall)
+	}
+	for _, image := range message.Images {
+		converted.Images = append(converted.Images, base64.StdEncoding.EncodeToString(image.Data))
+	}
+	return converted
+}
+
+func toOllamaTools(tools []Tool) []ollamaTool {
+	result := make([]ollamaTool, 0, len(tools))
+	for _, tool := range tools {
+		var converted ollamaTool
+		converted.Type = "function"
+		converted.Function.Name = tool.Name
+		converted.Function.Description = tool.Description
+		converted.Function.Parameters = toolParameters(tool)
+		result = append(result, converted)
+	}
+	return result
+}
+
+// ollamaUsage reads the token counts of the final chunk. Ollama leaves out
+// prompt_eval_count when the prompt was served from its cache, the missing
+// count is estimated instead.
+func ollamaUsage(chunk ollamaChunk, messages []ChatMessage, completion string) Usage {
+	if chunk.PromptEvalCount > 0 && chunk.EvalCount > 0 {
+		return Usage{
+			PromptTokens:     chunk.PromptEvalCount,
+			CompletionTokens: chunk.EvalCount,
+			TotalTokens:      chunk.PromptEvalCount + chunk.EvalCount,
+		}
+	}
+
+	usage := EstimateUsage(messages, completion)
+	if chunk.PromptEvalCount > 0 {
+		usage.PromptTokens = chunk.PromptEvalCount
+	}
+	if chunk.EvalCount > 0 {
+		usage.CompletionTokens = chunk.EvalCount
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+func decodeOllamaError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error != "" {
+		return &OllamaError{StatusCode: resp.StatusCode, Message: payload.Error}
+	}
+	return &OllamaError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
@@ -2,83 +2,158 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
 
+	"github.com/jzhang405/SmartChrome/backend/pkg/jsonschema"
 	"github.com/sashabaranov/go-openai"
 )
 
-// OpenAIProvider implements the LLMProvider interface for OpenAI
-type OpenAIProvider struct {
-	client  *openai.Client
-	model   string
+// OpenAICompatibleConfig describes a named endpoint that speaks the OpenAI
+// chat completions API, such as OpenAI itself, DeepSeek, Together, Groq,
+// vLLM, llama.cpp, Moonshot or an Azure OpenAI deployment
+type OpenAICompatibleConfig struct {
+	Name    string
+	APIKey  string
+	BaseURL string
+	Model   string
+	// APIType is "azure" for Azure OpenAI, where BaseURL is the resource
+	// endpoint and Model the deployment name. Empty means plain OpenAI.
+	APIType    string
+	APIVersion string
+	// EmbeddingModel enables Embed, e.g. text-embedding-3-small
+	EmbeddingModel string
+	// JSONMode is the response_format the endpoint supports, JSONModeSchema
+	// or JSONModeObject. Empty means none.
+	JSONMode string
+	// Tools enables tool calling, which not every endpoint supports
+	Tools bool
+	// StreamUsage sends stream_options.include_usage, which some servers
+	// reject. Without it usage is estimated. Azure never gets it.
+	StreamUsage bool
+	// MaxTokens and Temperature apply unless a request sets its own. Zero
+	// leaves them to the endpoint.
+	MaxTokens   int
+	Temperature float64
+}
+
+// OpenAICompatibleProvider implements the LLMProvider interface for any
+// OpenAI-compatible endpoint
+type OpenAICompatibleProvider struct {
+	client   *openai.Client
+	model    string
 	provider string
-	baseURL string
-	apiKey  string
+	baseURL  string
+	apiKey   string
+	// streamUsage requests usage in the final stream chunk, which older Azure
+	// API versions and some compatible servers reject
+	streamUsage    bool
+	embeddingModel string
+	jsonMode       string
+	tools          bool
+	maxTokens      int
+	temperature    float32
 }
 
-// NewOpenAIProvider creates a new OpenAI provider
-func NewOpenAIProvider(apiKey, baseURL, model string) (*OpenAIProvider, error) {
-	if apiKey == "" {
-		return nil, errors.New("API key is required")
+// NewOpenAICompatibleProvider creates a provider for the endpoint described
+// by cfg. The API key is optional since self-hosted servers often run without
+// one.
+func NewOpenAICompatibleProvider(cfg OpenAICompatibleConfig) (*OpenAICompatibleProvider, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("provider name is required")
+	}
+
+	if cfg.BaseURL == "" {
+		return nil, errors.New("base URL is required")
 	}
 
-	if model == "" {
-		model = openai.GPT3Dot5Turbo
+	if cfg.Model == "" {
+		return nil, errors.New("model is required")
 	}
 
-	config := openai.DefaultConfig(apiKey)
-	if baseURL != "" {
-		config.BaseURL = baseURL
+	var config openai.ClientConfig
+	streamUsage := cfg.StreamUsage
+	switch strings.ToLower(cfg.APIType) {
+	case "", "openai":
+		config = openai.DefaultConfig(cfg.APIKey)
+		config.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	case "azure":
+		streamUsage = false
+		if cfg.APIKey == "" {
+			return nil, errors.New("API key is required")
+		}
+		config = openai.DefaultAzureConfig(cfg.APIKey, cfg.BaseURL)
+		if cfg.APIVersion != "" {
+			config.APIVersion = cfg.APIVersion
+		}
+	default:
+		return nil, fmt.Errorf("unsupported API type: %s", cfg.APIType)
 	}
 
-	client := openai.NewClientWithConfig(config)
+	config.HTTPClient = &http.Client{Transport: &retryAfterTransport{base: http.DefaultTransport}}
 
-	return &OpenAIProvider{
-		client:   client,
-		model:    model,
-		provider: "openai",
-		baseURL:  baseURL,
-		apiKey:   apiKey,
+	return &OpenAICompatibleProvider{
+		client:   openai.NewClientWithConfig(config),
+		model:    cfg.Model,
+		provider: cfg.Name,
+		baseURL:  cfg.BaseURL,
+		apiKey:   cfg.APIKey,
+
+		streamUsage:    streamUsage,
+		embeddingModel: cfg.EmbeddingModel,
+		jsonMode:       cfg.JSONMode,
+		tools:          cfg.Tools,
+		maxTokens:      cfg.MaxTokens,
+		temperature:    float32(cfg.Temperature),
 	}, nil
 }
 
-func (p *OpenAIProvider) GetModel() string {
+func (p *OpenAICompatibleProvider) GetModel() string {
 	return p.model
 }
 
-func (p *OpenAIProvider) GetProvider() string {
+func (p *OpenAICompatibleProvider) GetProvider() string {
 	return p.provider
 }
 
-func (p *OpenAIProvider) Validate() error {
-	if p.apiKey == "" {
-		return errors.New("API key is required")
+func (p *OpenAICompatibleProvider) Validate() error {
+	if p.model == "" {
+		return errors.New("model is required")
 	}
-	
+
 	if p.client == nil {
-		return errors.New("OpenAI client is not initialized")
+		return fmt.Errorf("%s client is not initialized", p.provider)
 	}
-	
+
 	return nil
 }
 
-func (p *OpenAIProvider) Generate(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+func (p *OpenAICompatibleProvider) Generate(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
 	return p.GenerateStream(ctx, prompt, options...)
 }
 
-func (p *OpenAIProvider) GenerateStream(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
-	// Apply options
+func (p *OpenAICompatibleProvider) GenerateStream(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.Chat(ctx, []ChatMessage{{Role: RoleUser, Content: prompt}}, options...)
+}
+
+func (p *OpenAICompatibleProvider) Chat(ctx context.Context, messages []ChatMessage, options ...GenerateOption) (<-chan StreamResponse, error) {
+	if len(messages) == 0 {
+		return nil, ErrNoMessages
+	}
+
 	req := openai.ChatCompletionRequest{
-		Model: p.model,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: prompt,
-			},
-		},
-		Stream: true,
+		Model:       p.model,
+		Messages:    toOpenAIMessages(messages),
+		Stream:      true,
+		MaxTokens:   p.maxTokens,
+		Temperature: p.temperature,
+	}
+	if p.streamUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
 	}
 
 	// Apply options
@@ -95,11 +170,18 @@ func (p *OpenAIProvider) GenerateStream(ctx context.Context, prompt string, opti
 		if option.Stop != nil {
 			req.Stop = option.Stop
 		}
+		if option.ResponseFormat != nil {
+			req.ResponseFormat = p.responseFormat(option.ResponseFormat)
+		}
+		if option.Tools != nil && p.tools {
+			req.Tools = toOpenAITools(option.Tools)
+		}
 	}
 
-	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	var failureHeader http.Header
+	stream, err := p.client.CreateChatCompletionStream(context.WithValue(ctx, failureHeaderKey{}, &failureHeader), req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create chat completion stream: %w", err)
+		return nil, withRetryAfter(fmt.Errorf("failed to create chat completion stream: %w", err), failureHeader)
 	}
 
 	responseChan := make(chan StreamResponse)
@@ -108,59 +190,242 @@ func (p *OpenAIProvider) GenerateStream(ctx context.Context, prompt string, opti
 		defer close(responseChan)
 		defer stream.Close()
 
+		send := func(response StreamResponse) bool {
+			select {
+			case responseChan <- response:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// With usage requested, the finish reason and the usage arrive in
+		// separate chunks before the stream ends
+		var completion, reasoning, arguments strings.Builder
+		var finishReason string
+		var usage *openai.Usage
+
 		for {
 			response, err := stream.Recv()
-			if errors.Is(err, context.Canceled) {
-				responseChan <- StreamResponse{
-					Error: err,
-				}
-				return
-			}
-			
-			if errors.Is(err, context.DeadlineExceeded) {
-				responseChan <- StreamResponse{
-					Error: err,
+			if errors.Is(err, io.EOF) {
+				final := StreamResponse{Done: true, FinishReason: finishReason}
+				if usage != nil {
+					final.Usage = Usage{
+						PromptTokens:     usage.PromptTokens,
+						CompletionTokens: usage.CompletionTokens,
+						TotalTokens:      usage.TotalTokens,
+					}
+				} else {
+					// Reasoning and tool call arguments are generated tokens too
+					final.Usage = EstimateUsage(messages, reasoning.String()+completion.String()+arguments.String())
 				}
+				send(final)
 				return
 			}
 
 			if err != nil {
-				// Check if it's EOF (stream finished)
-				if strings.Contains(err.Error(), "EOF") {
-					responseChan <- StreamResponse{
-						Done: true,
-					}
-					return
-				}
-				
-				responseChan <- StreamResponse{
-					Error: err,
-				}
+				send(StreamResponse{Error: err})
 				return
 			}
 
-			if len(response.Choices) > 0 {
-				content := response.Choices[0].Delta.Content
-				finishReason := ""
-				
-				if response.Choices[0].FinishReason != "" {
-					finishReason = string(response.Choices[0].FinishReason)
+			if response.Usage != nil {
+				usage = response.Usage
+			}
+
+			if len(response.Choices) == 0 {
+				continue
+			}
+
+			if reason := string(response.Choices[0].FinishReason); reason != "" {
+				finishReason = reason
+			}
+
+			delta := response.Choices[0].Delta
+			var toolCalls []ToolCallDelta
+			for i, call := range delta.ToolCalls {
+				// Some servers leave out the index when they send whole calls
+				index := i
+				if call.Index != nil {
+					index = *call.Index
 				}
+				toolCalls = append(toolCalls, ToolCallDelta{
+					Index:     index,
+					ID:        call.ID,
+					Name:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+				})
+				arguments.WriteString(call.Function.Arguments)
+			}
 
-				responseChan <- StreamResponse{
-					Content:      content,
-					Done:         finishReason != "",
-					FinishReason: finishReason,
-					// Note: Stream responses don't have usage data
-					Usage: Usage{
-						PromptTokens:     0,
-						CompletionTokens: 0,
-						TotalTokens:      0,
-					},
+			// Reasoning models such as deepseek-reasoner stream their
+			// reasoning in reasoning_content before the answer
+			if delta.Content != "" || delta.ReasoningContent != "" || len(toolCalls) > 0 {
+				completion.WriteString(delta.Content)
+				reasoning.WriteString(delta.ReasoningContent)
+				if !send(StreamResponse{Content: delta.Content, Reasoning: delta.ReasoningContent, ToolCalls: toolCalls}) {
+					return
 				}
 			}
 		}
 	}()
 
 	return responseChan, nil
-}
\ No newline at end of file
+}
+
+// responseFormat maps the requested format to the endpoint's JSON mode. The
+// schema is not strict since strict mode rejects schemas that leave
+// properties optional. JSON object mode always produces an object, so
+// schemas with another root, such as a list of table rows, rely on the
+// instructions alone.
+func (p *OpenAICompatibleProvider) responseFormat(format *ResponseFormat) *openai.ChatCompletionResponseFormat {
+	switch p.jsonMode {
+	case JSONModeSchema:
+		name := format.Name
+		if name == "" {
+			name = "response"
+		}
+		return &openai.ChatCompletionResponseFormat{
+			Type:       openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{Name: name, Schema: format.Schema},
+		}
+	case JSONModeObject:
+		if !objectRoot(format.Schema) {
+			return nil
+		}
+		return &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	default:
+		return nil
+	}
+}
+
+// objectRoot reports whether a schema only accepts an object at its root
+func objectRoot(schema json.RawMessage) bool {
+	parsed, err := jsonschema.Parse(schema)
+	return err == nil && len(parsed.Types) == 1 && parsed.Types[0] == "object"
+}
+
+func (p *OpenAICompatibleProvider) EmbeddingModel() string {
+	return p.embeddingModel
+}
+
+// Embed embeds texts with the configured embedding model
+func (p *OpenAICompatibleProvider) Embed(ctx context.Context, texts []string, options ...EmbedOption) (*Embeddings, error) {
+	if p.embeddingModel == "" {
+		return nil, ErrEmbeddingsNotSupported
+	}
+	if len(texts) == 0 {
+		return nil, ErrNoInput
+	}
+
+	req := openai.EmbeddingRequestStrings{
+		Input: texts,
+		Model: openai.EmbeddingModel(p.embeddingModel),
+	}
+	for _, option := range options {
+		if option.Dimensions != nil {
+			req.Dimensions = *option.Dimensions
+		}
+	}
+
+	var failureHeader http.Header
+	resp, err := p.client.CreateEmbeddings(context.WithValue(ctx, failureHeaderKey{}, &failureHeader), req)
+	if err != nil {
+		return nil, withRetryAfter(fmt.Errorf("failed to create embeddings: %w", err), failureHeader)
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range resp.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding index %d out of range", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+
+	dims, err := dimensions(vectors)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := Usage{PromptTokens: resp.Usage.PromptTokens, TotalTokens: resp.Usage.TotalTokens}
+	if usage.TotalTokens == 0 {
+		usage = estimateEmbeddingUsage(texts)
+	}
+
+	return &Embeddings{
+		Vectors:    vectors,
+		Dimensions: dims,
+		Usage:      usage,
+		Provider:   p.provider,
+		Model:      p.embeddingModel,
+	}, nil
+}
+
+// failureHeaderKey is the context key under which retryAfterTransport stores
+// the headers of a failed response
+type failureHeaderKey struct{}
+
+// retryAfterTransport keeps the headers of failed responses, which the
+// OpenAI client discards, so the Retry-After delay can be honoured
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		if header, ok := req.Context().Value(failureHeaderKey{}).(*http.Header); ok {
+			*header = resp.Header.Clone()
+		}
+	}
+	return resp, err
+}
+
+// toOpenAIMessages converts chat messages to the OpenAI wire format shared by
+// all OpenAI-compatible providers
+func toOpenAIMessages(messages []ChatMessage) []openai.ChatCompletionMessage {
+	result := make([]openai.ChatCompletionMessage, 0, len(messages))
+	for _, message := range messages {
+		converted := openai.ChatCompletionMessage{
+			Role:       string(message.Role),
+			Content:    message.Content,
+			ToolCallID: message.ToolCallID,
+		}
+		for _, call := range message.ToolCalls {
+			converted.ToolCalls = append(converted.ToolCalls, openai.ToolCall{
+				ID:       call.ID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+			})
+		}
+		// Images turn the content into parts, which replace the plain content
+		if len(message.Images) > 0 {
+			converted.Content = ""
+			if message.Content != "" {
+				converted.MultiContent = append(converted.MultiContent, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: message.Content})
+			}
+			for _, image := range message.Images {
+				converted.MultiContent = append(converted.MultiContent, openai.ChatMessagePart{
+					Type:     openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{URL: image.DataURL()},
+				})
+			}
+		}
+		result = append(result, converted)
+	}
+	return result
+}
+
+func toOpenAITools(tools []Tool) []openai.Tool {
+	result := make([]openai.Tool, 0, len(tools))
+	for _, tool := range tools {
+		result = append(result, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  toolParameters(tool),
+			},
+		})
+	}
+	return result
+}
@@ -0,0 +1,327 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy bounds how often and how long a failed request is retried
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	// MaxDelay caps the backoff. A Retry-After longer than this is not waited
+	// for, the error is returned so the caller can fall back instead.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy retries twice, starting at half a second
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 2,
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   10 * time.Second,
+	}
+}
+
+// backoff returns the jittered exponential delay before the given retry,
+// somewhere between half and all of BaseDelay * 2^attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << attempt
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// CircuitBreaker stops sending requests to a provider after repeated
+// failures. Once the cooldown has passed a single trial request is let
+// through; its outcome closes or reopens the circuit.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+// NewCircuitBreaker creates a breaker that opens after threshold consecutive
+// failures and stays open for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// Allow reports whether a request may be sent now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Success records a request that reached a working provider
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// Release ends a request that has no outcome because its caller gave up,
+// letting another trial through without changing the state
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+// Failure records a transient provider failure
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.trial || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+	b.trial = false
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState()
+}
+
+// Failures returns the number of consecutive failures
+func (b *CircuitBreaker) Failures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+func (b *CircuitBreaker) currentState() BreakerState {
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// CircuitOpenError is returned without contacting a provider whose circuit
+// breaker is open
+type CircuitOpenError struct {
+	Provider string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "LLM provider unavailable, circuit open: " + e.Provider
+}
+
+// RetryAfterError carries the delay a server asked for in its Retry-After
+// header along with the error it returned
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// withRetryAfter attaches the Retry-After delay from header to err, if any
+func withRetryAfter(err error, header http.Header) error {
+	if delay := parseRetryAfter(header.Get("Retry-After")); delay > 0 {
+		return &RetryAfterError{Err: err, RetryAfter: delay}
+	}
+	return err
+}
+
+// parseRetryAfter accepts both forms of the header: delay seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// ResilientProvider wraps a provider with bounded retries and a circuit
+// breaker. Only failures before the first content are retried.
+type ResilientProvider struct {
+	LLMProvider
+	policy  RetryPolicy
+	breaker *CircuitBreaker
+}
+
+// NewResilientProvider wraps provider with the given retry policy and breaker
+func NewResilientProvider(provider LLMProvider, policy RetryPolicy, breaker *CircuitBreaker) *ResilientProvider {
+	return &ResilientProvider{
+		LLMProvider: provider,
+		policy:      policy,
+		breaker:     breaker,
+	}
+}
+
+// Breaker returns the provider's circuit breaker
+func (p *ResilientProvider) Breaker() *CircuitBreaker {
+	return p.breaker
+}
+
+func (p *ResilientProvider) Generate(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.GenerateStream(ctx, prompt, options...)
+}
+
+func (p *ResilientProvider) GenerateStream(ctx context.Context, prompt string, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.do(ctx, func() (<-chan StreamResponse, error) {
+		return p.LLMProvider.GenerateStream(ctx, prompt, options...)
+	})
+}
+
+func (p *ResilientProvider) Chat(ctx context.Context, messages []ChatMessage, options ...GenerateOption) (<-chan StreamResponse, error) {
+	return p.do(ctx, func() (<-chan StreamResponse, error) {
+		return p.LLMProvider.Chat(ctx, messages, options...)
+	})
+}
+
+func (p *ResilientProvider) do(ctx context.Context, start func() (<-chan StreamResponse, error)) (<-chan StreamResponse, error) {
+	var stream <-chan StreamResponse
+	var pending []StreamResponse
+	err := p.retry(ctx, func() error {
+		var err error
+		stream, pending, err = open(start)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replay(ctx, pending, stream, nil, nil), nil
+}
+
+// retry runs attempt until it succeeds, fails with an error that is not
+// retryable or runs out of retries, recording each outcome in the breaker.
+// Attempts that fail because the caller's context is done are neither
+// retried nor recorded.
+func (p *ResilientProvider) retry(ctx context.Context, attempt func() error) error {
+	for n := 0; ; n++ {
+		if !p.breaker.Allow() {
+			return &CircuitOpenError{Provider: p.GetProvider()}
+		}
+
+		err := attempt()
+		if err != nil && ctx.Err() != nil {
+			// The caller cancelled or timed out, which says nothing about
+			// the provider
+			p.breaker.Release()
+			return err
+		}
+		if err == nil || !IsRetryable(err) {
+			// The provider answered, even if it rejected the request
+			p.breaker.Success()
+			return err
+		}
+
+		p.breaker.Failure()
+		if n >= p.policy.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := p.policy.backoff(n)
+		var retryAfter *RetryAfterError
+		if errors.As(err, &retryAfter) {
+			if retryAfter.RetryAfter > p.policy.MaxDelay {
+				return err
+			}
+			delay = retryAfter.RetryAfter
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// ProviderHealth describes the availability of a registered provider
+type ProviderHealth struct {
+	Model    string       `json:"model"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+}
+
+// breakerOf returns the circuit breaker of a provider, if it has one
+func breakerOf(provider LLMProvider) *CircuitBreaker {
+	if resilient, ok := provider.(*ResilientProvider); ok {
+		return resilient.breaker
+	}
+	return nil
+}
+
+// Health reports the circuit breaker state of every registered provider.
+// Providers without a breaker are always reported as closed.
+func (c *LLMClient) Health() map[string]ProviderHealth {
+	health := make(map[string]ProviderHealth, len(c.providers))
+	for name, provider := range c.providers {
+		status := ProviderHealth{Model: provider.GetModel(), State: BreakerClosed}
+		if breaker := breakerOf(provider); breaker != nil {
+			status.State = breaker.State()
+			status.Failures = breaker.Failures()
+		}
+		health[name] = status
+	}
+	return health
+}
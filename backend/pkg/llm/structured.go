@@ -0,0 +1,178 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jzhang405/SmartChrome/backend/pkg/jsonschema"
+)
+
+// maxJSONAttempts bounds how often the model is asked for valid output
+const maxJSONAttempts = 3
+
+// InvalidOutputError is returned when the model did not produce JSON
+// matching the schema within maxJSONAttempts
+type InvalidOutputError struct {
+	Output string
+	Err    error
+}
+
+func (e *InvalidOutputError) Error() string {
+	return fmt.Sprintf("model output does not match the schema: %v", e.Err)
+}
+
+func (e *InvalidOutputError) Unwrap() error {
+	return e.Err
+}
+
+// JSONResult is the parsed output of ChatJSON
+type JSONResult struct {
+	Value    interface{}
+	Raw      string
+	Usage    Usage
+	Provider string
+	Model    string
+	// Attempts counts the requests made, more than one when the model had
+	// to be asked to correct its output
+	Attempts int
+}
+
+// ChatJSON asks the named provider for JSON output matching the schema and
+// returns it parsed. Providers with a JSON mode are constrained to the
+// schema. Output that still does not match is sent back to the model with
+// the problems found, up to maxJSONAttempts times. Usage covers every
+// attempt, and the result is returned with errors too so the usage of
+// failed attempts can be accounted for.
+func (c *LLMClient) ChatJSON(ctx context.Context, providerName string, messages []ChatMessage, format ResponseFormat, options ...GenerateOption) (*JSONResult, error) {
+	schema, err := jsonschema.Parse(format.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	messages = withSchemaInstructions(messages, format.Schema)
+	options = append(options, GenerateOption{ResponseFormat: &format})
+
+	result := &JSONResult{}
+	for {
+		result.Attempts++
+
+		output, err := c.collect(ctx, providerName, messages, options, result)
+		if err != nil {
+			return result, err
+		}
+		result.Raw = output
+
+		value, err := parseJSONOutput(output)
+		if err == nil {
+			err = schema.Validate(value)
+		}
+		if err == nil {
+			result.Value = value
+			return result, nil
+		}
+
+		if result.Attempts == maxJSONAttempts {
+			return result, &InvalidOutputError{Output: output, Err: err}
+		}
+		messages = append(messages,
+			ChatMessage{Role: RoleAssistant, Content: output},
+			ChatMessage{Role: RoleUser, Content: "That output is not valid: " + err.Error() +
+				". Reply again with only the corrected JSON, matching the schema."},
+		)
+	}
+}
+
+// collect runs one chat request to completion, adding its usage and the
+// provider that answered to the result. The usage of a stream that fails
+// part way is estimated, since the provider may bill it.
+func (c *LLMClient) collect(ctx context.Context, providerName string, messages []ChatMessage, options []GenerateOption, result *JSONResult) (string, error) {
+	stream, err := c.Chat(ctx, providerName, messages, options...)
+	if err != nil {
+		return "", err
+	}
+
+	// Drain the whole stream so the provider goroutine can always finish
+	var output strings.Builder
+	var streamErr error
+	var done bool
+	for chunk := range stream {
+		if chunk.Provider != "" {
+			result.Provider, result.Model = chunk.Provider, chunk.Model
+		}
+		if chunk.Error != nil {
+			streamErr = chunk.Error
+			continue
+		}
+		output.WriteString(chunk.Content)
+		if chunk.Done {
+			done = true
+			result.addUsage(chunk.Usage)
+		}
+	}
+	if streamErr == nil && !done {
+		streamErr = ctx.Err()
+	}
+	if streamErr != nil {
+		if !done {
+			result.addUsage(EstimateUsage(messages, output.String()))
+		}
+		return "", streamErr
+	}
+	return output.String(), nil
+}
+
+func (r *JSONResult) addUsage(usage Usage) {
+	r.Usage.PromptTokens += usage.PromptTokens
+	r.Usage.CompletionTokens += usage.CompletionTokens
+	r.Usage.TotalTokens += usage.TotalTokens
+	r.Usage.Estimated = r.Usage.Estimated || usage.Estimated
+}
+
+// withSchemaInstructions tells the model the schema, which providers without
+// a JSON mode only learn from the prompt. The instructions are added to the
+// system message so the prompt keeps a single one.
+func withSchemaInstructions(messages []ChatMessage, schema json.RawMessage) []ChatMessage {
+	instructions := "Reply with only a JSON value, without any other text or code fences, that matches this JSON schema:\n" +
+		string(schema)
+
+	result := make([]ChatMessage, 0, len(messages)+1)
+	if len(messages) > 0 && messages[0].Role == RoleSystem {
+		system := messages[0]
+		system.Content = strings.TrimRight(system.Content, "\n") + "\n\n" + instructions
+		result = append(result, system)
+		messages = messages[1:]
+	} else {
+		result = append(result, ChatMessage{Role: RoleSystem, Content: instructions})
+	}
+	return append(result, messages...)
+}
+
+// parseJSONOutput decodes the JSON in a model's output, which models
+// without a JSON mode tend to wrap in a code fence or a sentence
+func parseJSONOutput(output string) (interface{}, error) {
+	text := strings.TrimSpace(output)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err == nil {
+		return value, nil
+	}
+
+	// Fall back to the outermost object or array in the text
+	start := strings.IndexAny(text, "{[")
+	end := strings.LastIndexAny(text, "}]")
+	if start < 0 || end <= start {
+		return nil, errors.New("the output contains no JSON")
+	}
+	if err := json.Unmarshal([]byte(text[start:end+1]), &value); err != nil {
+		return nil, fmt.Errorf("the output is not valid JSON: %v", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,55 @@
+package llm
+
+import "unicode"
+
+// messageOverheadTokens approximates the per-message framing (role and
+// separators) that chat APIs add to the prompt
+const messageOverheadTokens = 4
+
+// imageTokens approximates the prompt tokens of an attached image. Providers
+// charge from a few hundred to about 1600 tokens for a screenshot depending
+// on its size.
+const imageTokens = 1000
+
+// EstimateTokens approximates the number of tokens in text for providers
+// that do not report usage. It is a character count heuristic, not a
+// tokenizer: BPE tokenizers average about four characters per token for
+// Latin text, while CJK characters are mostly one token each. Counts for
+// code, numbers or other scripts may be off by a third or more.
+func EstimateTokens(text string) int {
+	var tokens, latin int
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			tokens++
+		} else {
+			latin++
+		}
+	}
+	return tokens + (latin+3)/4
+}
+
+// EstimateMessageTokens approximates the prompt tokens of a chat message,
+// including its framing
+func EstimateMessageTokens(message ChatMessage) int {
+	tokens := messageOverheadTokens + EstimateTokens(message.Content)
+	for _, call := range message.ToolCalls {
+		tokens += EstimateTokens(call.Name) + EstimateTokens(call.Arguments)
+	}
+	return tokens + len(message.Images)*imageTokens
+}
+
+// EstimateUsage approximates the usage of a chat request and its completion
+func EstimateUsage(messages []ChatMessage, completion string) Usage {
+	var prompt int
+	for _, message := range messages {
+		prompt += EstimateMessageTokens(message)
+	}
+	completionTokens := EstimateTokens(completion)
+
+	return Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completionTokens,
+		TotalTokens:      prompt + completionTokens,
+		Estimated:        true,
+	}
+}
@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Tool describes a function the model may call. Parameters is the JSON
+// schema of its arguments.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+// ToolCall is a complete call of a tool. Arguments is the JSON object the
+// model produced, which may be malformed.
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// ToolCallDelta is a streamed fragment of the tool call at Index. The ID and
+// name arrive first, the arguments in pieces to be concatenated.
+type ToolCallDelta struct {
+	Index     int
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// ToolCallBuilder puts streamed tool call fragments back together
+type ToolCallBuilder struct {
+	calls map[int]*ToolCall
+}
+
+// Add merges fragments into the calls they belong to
+func (b *ToolCallBuilder) Add(deltas []ToolCallDelta) {
+	if b.calls == nil {
+		b.calls = make(map[int]*ToolCall)
+	}
+	for _, delta := range deltas {
+		call, exists := b.calls[delta.Index]
+		if !exists {
+			call = &ToolCall{}
+			b.calls[delta.Index] = call
+		}
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Name != "" {
+			call.Name = delta.Name
+		}
+		call.Arguments += delta.Arguments
+	}
+}
+
+// Calls returns the complete calls in index order
+func (b *ToolCallBuilder) Calls() []ToolCall {
+	indexes := make([]int, 0, len(b.calls))
+	for index := range b.calls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	calls := make([]ToolCall, 0, len(indexes))
+	for _, index := range indexes {
+		calls = append(calls, *b.calls[index])
+	}
+	return calls
+}
+
+// emptyParameters is sent for tools that take no arguments, since some
+// endpoints require a schema
+var emptyParameters = json.RawMessage(`{"type":"object","properties":{}}`)
+
+func toolParameters(tool Tool) json.RawMessage {
+	if len(tool.Parameters) == 0 {
+		return emptyParameters
+	}
+	return tool.Parameters
+}
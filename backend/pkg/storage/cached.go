@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
+)
+
+// CachedStore keeps Redis as a hot cache in front of a durable store.
+// Sessions, conversations and webpage content are read from Redis first and
+// filled from the durable store on a miss; everything else goes straight to
+// the durable store. Writes always hit the durable store first, and cache
+// failures are logged without failing the request.
+type CachedStore struct {
+	Store
+	client *cache.RedisClient
+	cache  *cache.SessionCache
+}
+
+// NewCachedStore puts the Redis client in front of the durable store
+func NewCachedStore(durable Store, client *cache.RedisClient) *CachedStore {
+	return &CachedStore{
+		Store:  durable,
+		client: client,
+		cache:  cache.NewSessionCache(client),
+	}
+}
+
+func (s *CachedStore) StoreSession(ctx context.Context, session *models.UserSession) error {
+	if err := s.Store.StoreSession(ctx, session); err != nil {
+		return err
+	}
+	logCacheError("store session", s.cache.StoreSession(ctx, session))
+	return nil
+}
+
+func (s *CachedStore) GetSession(ctx context.Context, sessionID string) (*models.UserSession, error) {
+	session, err := s.cache.GetSession(ctx, sessionID)
+	if err == nil {
+		return session, nil
+	}
+	logCacheMiss("session", err)
+
+	session, err = s.Store.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	logCacheError("fill session", s.cache.StoreSession(ctx, session))
+	return session, nil
+}
+
+func (s *CachedStore) DeleteSession(ctx context.Context, sessionID string) error {
+	if err := s.Store.DeleteSession(ctx, sessionID); err != nil {
+		return err
+	}
+	logCacheError("delete session", s.cache.DeleteSession(ctx, sessionID))
+	return nil
+}
+
+func (s *CachedStore) StoreConversation(ctx context.Context, conversation *models.Conversation) error {
+	if err := s.Store.StoreConversation(ctx, conversation); err != nil {
+		return err
+	}
+	logCacheError("store conversation", s.cache.StoreConversation(ctx, conversation))
+	return nil
+}
+
+func (s *CachedStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	conversation, err := s.cache.GetConversation(ctx, conversationID)
+	if err == nil {
+		return conversation, nil
+	}
+	logCacheMiss("conversation", err)
+
+	conversation, err = s.Store.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	logCacheError("fill conversation", s.cache.StoreConversation(ctx, conversation))
+	return conversation, nil
+}
+
+// AppendMessage drops the cached conversation because its message count and
+// update time changed in the durable store
+func (s *CachedStore) AppendMessage(ctx context.Context, message *models.Message) error {
+	if err := s.Store.AppendMessage(ctx, message); err != nil {
+		return err
+	}
+	logCacheError("invalidate conversation", s.cache.DeleteConversation(ctx, message.ConversationID))
+	return nil
+}
+
+func (s *CachedStore) StoreWebpageContent(ctx context.Context, conversationID string, content *models.WebpageContent) error {
+	if err := s.Store.StoreWebpageContent(ctx, conversationID, content); err != nil {
+		return err
+	}
+	logCacheError("store webpage content", s.cache.StoreWebpageContent(ctx, conversationID, content))
+	return nil
+}
+
+func (s *CachedStore) GetWebpageContent(ctx context.Context, conversationID string) (*models.WebpageContent, error) {
+	content, err := s.cache.GetWebpageContent(ctx, conversationID)
+	if err == nil {
+		return content, nil
+	}
+	logCacheMiss("webpage content", err)
+
+	content, err = s.Store.GetWebpageContent(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	logCacheError("fill webpage content", s.cache.StoreWebpageContent(ctx, conversationID, content))
+	return content, nil
+}
+
+func (s *CachedStore) Close() error {
+	cacheErr := s.client.Close()
+	if err := s.Store.Close(); err != nil {
+		return err
+	}
+	return cacheErr
+}
+
+func logCacheMiss(kind string, err error) {
+	if !errors.Is(err, redis.Nil) {
+		log.Printf("Cache lookup for %s failed: %v", kind, err)
+	}
+}
+
+func logCacheError(action string, err error) {
+	if err != nil {
+		log.Printf("Cache %s failed: %v", action, err)
+	}
+}
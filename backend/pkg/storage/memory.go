@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+)
+
+// MemoryStore implements Store in process memory. It applies the same
+// retention as the Redis backend and is meant for tests, local development
+// and single-binary deployments where losing data on restart is acceptable.
+// Expired entries are evicted periodically until the store is closed.
+type MemoryStore struct {
+	mutex         sync.RWMutex
+	sessions      map[string]memoryEntry
+	conversations map[string]memoryEntry
+	webpages      map[string]memoryEntry
+	responses     map[string]memoryEntry
+	messages      map[string]*messageLog
+	usage         []models.UsageRecord
+	chunks        map[string]memoryEntry
+	attachments   map[string]memoryEntry
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// memoryEntry holds a JSON snapshot so callers never share mutable state
+// with the store, mirroring what the Redis backend does
+type memoryEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+type messageLog struct {
+	sequence  int
+	messages  []memoryEntry
+	expiresAt time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	store := &MemoryStore{
+		sessions:      make(map[string]memoryEntry),
+		conversations: make(map[string]memoryEntry),
+		webpages:      make(map[string]memoryEntry),
+		responses:     make(map[string]memoryEntry),
+		messages:      make(map[string]*messageLog),
+		chunks:        make(map[string]memoryEntry),
+		attachments:   make(map[string]memoryEntry),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go store.purgePeriodically(purgeInterval)
+	return store
+}
+
+func (s *MemoryStore) StoreSession(ctx context.Context, session *models.UserSession) error {
+	return s.put(s.sessions, session.ID, session, SessionTTL)
+}
+
+func (s *MemoryStore) GetSession(ctx context.Context, sessionID string) (*models.UserSession, error) {
+	var session models.UserSession
+	if err := s.get(s.sessions, sessionID, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *MemoryStore) DeleteSession(ctx context.Context, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+func (s *MemoryStore) StoreConversation(ctx context.Context, conversation *models.Conversation) error {
+	return s.put(s.conversations, conversation.ID, conversation, ConversationTTL)
+}
+
+func (s *MemoryStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	var conversation models.Conversation
+	if err := s.get(s.conversations, conversationID, &conversation); err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (s *MemoryStore) AppendMessage(ctx context.Context, message *models.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	entry, exists := s.conversations[message.ConversationID]
+	if !exists || now.After(entry.expiresAt) {
+		return ErrNotFound
+	}
+
+	var conversation models.Conversation
+	if err := json.Unmarshal(entry.data, &conversation); err != nil {
+		return fmt.Errorf("failed to unmarshal conversation: %w", err)
+	}
+
+	msgLog := s.messages[message.ConversationID]
+	if msgLog == nil || now.After(msgLog.expiresAt) {
+		msgLog = &messageLog{}
+		s.messages[message.ConversationID] = msgLog
+	}
+
+	message.SequenceNumber = msgLog.sequence + 1
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	conversation.AddMessage()
+	conversationJSON, err := json.Marshal(&conversation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation: %w", err)
+	}
+
+	expiresAt := now.Add(ConversationTTL)
+	msgLog.sequence = message.SequenceNumber
+	msgLog.messages = append(msgLog.messages, memoryEntry{data: messageJSON, expiresAt: expiresAt})
+	msgLog.expiresAt = expiresAt
+	s.conversations[conversation.ID] = memoryEntry{data: conversationJSON, expiresAt: expiresAt}
+
+	return nil
+}
+
+func (s *MemoryStore) GetConversationMessages(ctx context.Context, conversationID string, limit, offset int) ([]*models.Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	entries := s.liveMessages(conversationID)
+	if offset >= len(entries) {
+		return []*models.Message{}, nil
+	}
+
+	entries = entries[offset:]
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	return decodeMessages(entries)
+}
+
+func (s *MemoryStore) GetConversationMessagesAfter(ctx context.Context, conversationID string, afterSequence, limit int) ([]*models.Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages, err := decodeMessages(s.liveMessages(conversationID))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Message, 0)
+	for _, message := range messages {
+		if message.SequenceNumber <= afterSequence {
+			continue
+		}
+		result = append(result, message)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) CountConversationMessages(ctx context.Context, conversationID string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.liveMessages(conversationID)), nil
+}
+
+func (s *MemoryStore) StoreLLMResponse(ctx context.Context, response *models.LLMResponse) error {
+	return s.put(s.responses, response.ID, response, ConversationTTL)
+}
+
+func (s *MemoryStore) StoreWebpageContent(ctx context.Context, conversationID string, content *models.WebpageContent) error {
+	return s.put(s.webpages, conversationID, content, ConversationTTL)
+}
+
+func (s *MemoryStore) GetWebpageContent(ctx context.Context, conversationID string) (*models.WebpageContent, error) {
+	var content models.WebpageContent
+	if err := s.get(s.webpages, conversationID, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+func (s *MemoryStore) RecordUsage(ctx context.Context, record *models.UsageRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Only the current and the previous month can still be queried
+	cutoff := PeriodStart(UsagePeriodMonth, PeriodStart(UsagePeriodMonth, time.Now()).Add(-time.Hour))
+	kept := s.usage[:0]
+	for _, existing := range s.usage {
+		if !existing.CreatedAt.Before(cutoff) {
+			kept = append(kept, existing)
+		}
+	}
+	s.usage = append(kept, *record)
+	return nil
+}
+
+func (s *MemoryStore) GetUsage(ctx context.Context, scope UsageScope, id string, period UsagePeriod) (*models.UsageTotals, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	since := PeriodStart(period, time.Now())
+	totals := &models.UsageTotals{}
+	for i := range s.usage {
+		record := &s.usage[i]
+		if usageOwner(record, scope) == id && !record.CreatedAt.Before(since) {
+			totals.Add(record)
+		}
+	}
+	return totals, nil
+}
+
+func (s *MemoryStore) StorePageChunks(ctx context.Context, contentHash, model string, chunks []*models.PageChunk) error {
+	return s.put(s.chunks, chunkKey(contentHash, model), chunks, ConversationTTL)
+}
+
+func (s *MemoryStore) GetPageChunks(ctx context.Context, contentHash, model string) ([]*models.PageChunk, error) {
+	var chunks []*models.PageChunk
+	if err := s.get(s.chunks, chunkKey(contentHash, model), &chunks); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func (s *MemoryStore) StoreAttachment(ctx context.Context, attachment *models.Attachment) error {
+	return s.put(s.attachments, attachment.ID, attachment, ConversationTTL)
+}
+
+func (s *MemoryStore) GetAttachment(ctx context.Context, attachmentID string) (*models.Attachment, error) {
+	var attachment models.Attachment
+	if err := s.get(s.attachments, attachmentID, &attachment); err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// PurgeExpired evicts the entries whose retention has passed and returns how
+// many were removed. Reads already ignore them, so this only frees memory.
+func (s *MemoryStore) PurgeExpired(ctx context.Context) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var total int64
+	for _, table := range []map[string]memoryEntry{s.sessions, s.conversations, s.webpages, s.responses, s.chunks, s.attachments} {
+		for key, entry := range table {
+			if now.After(entry.expiresAt) {
+				delete(table, key)
+				total++
+			}
+		}
+	}
+
+	for conversationID, msgLog := range s.messages {
+		if now.After(msgLog.expiresAt) {
+			delete(s.messages, conversationID)
+			total += int64(len(msgLog.messages))
+			continue
+		}
+		kept := msgLog.messages[:0]
+		for _, entry := range msgLog.messages {
+			if now.Before(entry.expiresAt) {
+				kept = append(kept, entry)
+			}
+		}
+		total += int64(len(msgLog.messages) - len(kept))
+		msgLog.messages = kept
+	}
+	return total, nil
+}
+
+func (s *MemoryStore) purgePeriodically(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if n, _ := s.PurgeExpired(context.Background()); n > 0 {
+				log.Printf("Purged %d expired entries", n)
+			}
+		}
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+func (s *MemoryStore) put(table map[string]memoryEntry, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %T: %w", value, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	table[key] = memoryEntry{data: data, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryStore) get(table map[string]memoryEntry, key string, value interface{}) error {
+	s.mutex.RLock()
+	entry, exists := table[key]
+	s.mutex.RUnlock()
+
+	if !exists || time.Now().After(entry.expiresAt) {
+		return ErrNotFound
+	}
+
+	if err := json.Unmarshal(entry.data, value); err != nil {
+		return fmt.Errorf("failed to unmarshal %T: %w", value, err)
+	}
+	return nil
+}
+
+// liveMessages returns the unexpired message entries of a conversation in
+// sequence order. Callers must hold the lock.
+func (s *MemoryStore) liveMessages(conversationID string) []memoryEntry {
+	msgLog := s.messages[conversationID]
+	if msgLog == nil {
+		return nil
+	}
+
+	now := time.Now()
+	entries := make([]memoryEntry, 0, len(msgLog.messages))
+	for _, entry := range msgLog.messages {
+		if now.Before(entry.expiresAt) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// usageOwner returns the ID a record is attributed to within scope
+func usageOwner(record *models.UsageRecord, scope UsageScope) string {
+	if scope == UsageScopeUser {
+		return record.UserID
+	}
+	return record.SessionID
+}
+
+// chunkKey returns the key of the chunks of a page embedded with model
+func chunkKey(contentHash, model string) string {
+	return model + ":" + contentHash
+}
+
+func decodeMessages(entries []memoryEntry) ([]*models.Message, error) {
+	messages := make([]*models.Message, 0, len(entries))
+	for _, entry := range entries {
+		var message models.Message
+		if err := json.Unmarshal(entry.data, &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		messages = append(messages, &message)
+	}
+	return messages, nil
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating
+const migrationLockID = 7263540118
+
+// MigrateKnowledge applies the migrations of the pgvector knowledge index to
+// a PostgreSQL database, normally the pool of the store. They are kept apart
+// from the store's because they need the pgvector extension, and fail when
+// it is not available.
+func MigrateKnowledge(ctx context.Context, db *sql.DB) error {
+	store := &SQLStore{db: db, dialect: postgresDialect}
+	return store.migrate(ctx, "pgvector")
+}
+
+// migrate applies the pending migrations of a set, a directory under
+// migrations, in file name order and records each applied version in
+// schema_migrations. Versions of all sets share that table, so file names
+// must be unique across sets. Migrations run on a single connection, which
+// holds an advisory lock on PostgreSQL so that instances starting at once
+// apply each migration only once.
+func (s *SQLStore) migrate(ctx context.Context, set string) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open migration connection: %w", err)
+	}
+	defer conn.Close()
+
+	if s.dialect.advisoryLock {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    TEXT PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	dir := path.Join("migrations", set)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".sql") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(name, ".sql")
+
+		var applied int
+		err := conn.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("failed to check migration %s: %w", version, err)
+		}
+		if applied > 0 {
+			continue
+		}
+
+		script, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", version, err)
+		}
+
+		if err := s.applyMigration(ctx, conn, version, string(script)); err != nil {
+			return err
+		}
+		log.Printf("Applied %s migration %s", set, version)
+	}
+
+	return nil
+}
+
+func (s *SQLStore) applyMigration(ctx context.Context, conn *sql.Conn, version, script string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %s: %w", version, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("failed to apply migration %s: %w", version, err)
+	}
+
+	_, err = tx.ExecContext(ctx, s.rebind(`
+		INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)
+		ON CONFLICT (version) DO NOTHING`), version, now())
+	if err != nil {
+		return fmt.Errorf("failed to record migration %s: %w", version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %s: %w", version, err)
+	}
+	return nil
+}
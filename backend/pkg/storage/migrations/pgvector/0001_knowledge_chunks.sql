@@ -0,0 +1,22 @@
+-- Chunks of the pages saved to knowledge bases, for the pgvector index. The
+-- embedding column has no fixed dimension so models can be changed, which
+-- rules out an approximate index; searches are exact scans of one owner's
+-- entries of one model.
+CREATE EXTENSION IF NOT EXISTS vector;
+
+CREATE TABLE IF NOT EXISTS knowledge_chunks (
+    owner        TEXT NOT NULL,
+    page_id      TEXT NOT NULL,
+    chunk_index  INTEGER NOT NULL,
+    url          TEXT NOT NULL,
+    title        TEXT NOT NULL,
+    saved_at     TIMESTAMPTZ NOT NULL,
+    model        TEXT NOT NULL,
+    start_offset INTEGER NOT NULL,
+    end_offset   INTEGER NOT NULL,
+    text         TEXT NOT NULL,
+    embedding    vector NOT NULL,
+    PRIMARY KEY (owner, page_id, chunk_index)
+);
+
+CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_owner ON knowledge_chunks (owner, model, saved_at);
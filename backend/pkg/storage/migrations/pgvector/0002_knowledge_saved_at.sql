@@ -0,0 +1,2 @@
+-- Lets the pages saved before a time be deleted without scanning every chunk
+CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_saved_at ON knowledge_chunks (saved_at);
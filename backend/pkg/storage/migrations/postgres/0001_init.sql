@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL,
+    last_active TIMESTAMPTZ NOT NULL,
+    preferences JSONB NOT NULL DEFAULT '{}',
+    expires_at  TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS conversations (
+    id            TEXT PRIMARY KEY,
+    session_id    TEXT NOT NULL,
+    url           TEXT NOT NULL,
+    title         TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL,
+    updated_at    TIMESTAMPTZ NOT NULL,
+    message_count INTEGER NOT NULL DEFAULT 0,
+    is_active     BOOLEAN NOT NULL DEFAULT TRUE,
+    expires_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_session_id ON conversations (session_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id              TEXT PRIMARY KEY,
+    conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    type            TEXT NOT NULL,
+    content         TEXT NOT NULL,
+    timestamp       TIMESTAMPTZ NOT NULL,
+    sequence_number INTEGER NOT NULL,
+    metadata        JSONB NOT NULL DEFAULT '{}',
+    expires_at      TIMESTAMPTZ,
+    UNIQUE (conversation_id, sequence_number)
+);
+
+CREATE TABLE IF NOT EXISTS llm_responses (
+    id           TEXT PRIMARY KEY,
+    message_id   TEXT NOT NULL,
+    stream_id    TEXT NOT NULL,
+    content      TEXT NOT NULL,
+    is_complete  BOOLEAN NOT NULL DEFAULT FALSE,
+    tokens_used  INTEGER NOT NULL DEFAULT 0,
+    model_used   TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL,
+    completed_at TIMESTAMPTZ,
+    expires_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_responses_message_id ON llm_responses (message_id);
+
+CREATE TABLE IF NOT EXISTS webpage_contents (
+    conversation_id      TEXT PRIMARY KEY REFERENCES conversations (id) ON DELETE CASCADE,
+    id                   TEXT NOT NULL,
+    url                  TEXT NOT NULL,
+    title                TEXT NOT NULL,
+    extracted_text       TEXT NOT NULL,
+    extraction_timestamp TIMESTAMPTZ NOT NULL,
+    content_hash         TEXT NOT NULL,
+    metadata             JSONB NOT NULL DEFAULT '{}',
+    expires_at           TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webpage_contents_content_hash ON webpage_contents (content_hash);
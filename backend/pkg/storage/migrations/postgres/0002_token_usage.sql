@@ -0,0 +1,2 @@
+ALTER TABLE llm_responses ADD COLUMN IF NOT EXISTS prompt_tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE llm_responses ADD COLUMN IF NOT EXISTS completion_tokens INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS usage_records (
+    id                TEXT PRIMARY KEY,
+    session_id        TEXT NOT NULL,
+    user_id           TEXT NOT NULL DEFAULT '',
+    conversation_id   TEXT NOT NULL,
+    message_id        TEXT NOT NULL,
+    provider          TEXT NOT NULL,
+    model             TEXT NOT NULL,
+    prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    total_tokens      INTEGER NOT NULL DEFAULT 0,
+    cost              DOUBLE PRECISION NOT NULL DEFAULT 0,
+    created_at        TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_records_session_id ON usage_records (session_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_usage_records_user_id ON usage_records (user_id, created_at);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS page_chunks (
+    content_hash    TEXT NOT NULL,
+    embedding_model TEXT NOT NULL,
+    chunk_index     INTEGER NOT NULL,
+    start_offset    INTEGER NOT NULL,
+    end_offset      INTEGER NOT NULL,
+    text            TEXT NOT NULL,
+    embedding       TEXT NOT NULL,
+    expires_at      TIMESTAMPTZ,
+    PRIMARY KEY (content_hash, embedding_model, chunk_index)
+);
+
+CREATE INDEX IF NOT EXISTS idx_page_chunks_expires_at ON page_chunks (expires_at);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS attachments (
+    id              TEXT PRIMARY KEY,
+    conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    media_type      TEXT NOT NULL,
+    size            INTEGER NOT NULL,
+    data            BYTEA NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL,
+    expires_at      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_conversation_id ON attachments (conversation_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_expires_at ON attachments (expires_at);
@@ -0,0 +1 @@
+ALTER TABLE llm_responses ADD COLUMN IF NOT EXISTS reasoning TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE usage_records ADD COLUMN IF NOT EXISTS estimated BOOLEAN NOT NULL DEFAULT FALSE;
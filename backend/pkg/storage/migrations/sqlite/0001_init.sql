@@ -0,0 +1,70 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL,
+    last_active TIMESTAMP NOT NULL,
+    preferences TEXT NOT NULL DEFAULT '{}',
+    expires_at  TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS conversations (
+    id            TEXT PRIMARY KEY,
+    session_id    TEXT NOT NULL,
+    url           TEXT NOT NULL,
+    title         TEXT NOT NULL,
+    created_at    TIMESTAMP NOT NULL,
+    updated_at    TIMESTAMP NOT NULL,
+    message_count INTEGER NOT NULL DEFAULT 0,
+    is_active     BOOLEAN NOT NULL DEFAULT 1,
+    expires_at    TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_session_id ON conversations (session_id);
+CREATE INDEX IF NOT EXISTS idx_conversations_expires_at ON conversations (expires_at);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id              TEXT PRIMARY KEY,
+    conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    type            TEXT NOT NULL,
+    content         TEXT NOT NULL,
+    timestamp       TIMESTAMP NOT NULL,
+    sequence_number INTEGER NOT NULL,
+    metadata        TEXT NOT NULL DEFAULT '{}',
+    expires_at      TIMESTAMP,
+    UNIQUE (conversation_id, sequence_number)
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_expires_at ON messages (expires_at);
+
+CREATE TABLE IF NOT EXISTS llm_responses (
+    id           TEXT PRIMARY KEY,
+    message_id   TEXT NOT NULL,
+    stream_id    TEXT NOT NULL,
+    content      TEXT NOT NULL,
+    is_complete  BOOLEAN NOT NULL DEFAULT 0,
+    tokens_used  INTEGER NOT NULL DEFAULT 0,
+    model_used   TEXT NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP,
+    expires_at   TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_responses_message_id ON llm_responses (message_id);
+CREATE INDEX IF NOT EXISTS idx_llm_responses_expires_at ON llm_responses (expires_at);
+
+CREATE TABLE IF NOT EXISTS webpage_contents (
+    conversation_id      TEXT PRIMARY KEY REFERENCES conversations (id) ON DELETE CASCADE,
+    id                   TEXT NOT NULL,
+    url                  TEXT NOT NULL,
+    title                TEXT NOT NULL,
+    extracted_text       TEXT NOT NULL,
+    extraction_timestamp TIMESTAMP NOT NULL,
+    content_hash         TEXT NOT NULL,
+    metadata             TEXT NOT NULL DEFAULT '{}',
+    expires_at           TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webpage_contents_content_hash ON webpage_contents (content_hash);
+CREATE INDEX IF NOT EXISTS idx_webpage_contents_expires_at ON webpage_contents (expires_at);
@@ -0,0 +1,2 @@
+ALTER TABLE llm_responses ADD COLUMN prompt_tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE llm_responses ADD COLUMN completion_tokens INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE llm_responses ADD COLUMN reasoning TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
+)
+
+// RedisStore implements Store on top of the Redis session cache
+type RedisStore struct {
+	client *cache.RedisClient
+	cache  *cache.SessionCache
+}
+
+// NewRedisStore creates a store backed by the given Redis client
+func NewRedisStore(client *cache.RedisClient) *RedisStore {
+	return &RedisStore{
+		client: client,
+		cache:  cache.NewSessionCache(client),
+	}
+}
+
+func (s *RedisStore) StoreSession(ctx context.Context, session *models.UserSession) error {
+	return s.cache.StoreSession(ctx, session)
+}
+
+func (s *RedisStore) GetSession(ctx context.Context, sessionID string) (*models.UserSession, error) {
+	session, err := s.cache.GetSession(ctx, sessionID)
+	return session, translateRedisError(err)
+}
+
+func (s *RedisStore) DeleteSession(ctx context.Context, sessionID string) error {
+	return s.cache.DeleteSession(ctx, sessionID)
+}
+
+func (s *RedisStore) StoreConversation(ctx context.Context, conversation *models.Conversation) error {
+	return s.cache.StoreConversation(ctx, conversation)
+}
+
+func (s *RedisStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	conversation, err := s.cache.GetConversation(ctx, conversationID)
+	return conversation, translateRedisError(err)
+}
+
+func (s *RedisStore) AppendMessage(ctx context.Context, message *models.Message) error {
+	return translateRedisError(s.cache.AppendMessage(ctx, message))
+}
+
+func (s *RedisStore) GetConversationMessages(ctx context.Context, conversationID string, limit, offset int) ([]*models.Message, error) {
+	return s.cache.GetConversationMessages(ctx, conversationID, limit, offset)
+}
+
+func (s *RedisStore) GetConversationMessagesAfter(ctx context.Context, conversationID string, afterSequence, limit int) ([]*models.Message, error) {
+	return s.cache.GetConversationMessagesAfter(ctx, conversationID, afterSequence, limit)
+}
+
+func (s *RedisStore) CountConversationMessages(ctx context.Context, conversationID string) (int, error) {
+	return s.cache.CountConversationMessages(ctx, conversationID)
+}
+
+func (s *RedisStore) StoreLLMResponse(ctx context.Context, response *models.LLMResponse) error {
+	return s.cache.StoreLLMResponse(ctx, response)
+}
+
+func (s *RedisStore) StoreWebpageContent(ctx context.Context, conversationID string, content *models.WebpageContent) error {
+	return s.cache.StoreWebpageContent(ctx, conversationID, content)
+}
+
+func (s *RedisStore) GetWebpageContent(ctx context.Context, conversationID string) (*models.WebpageContent, error) {
+	content, err := s.cache.GetWebpageContent(ctx, conversationID)
+	return content, translateRedisError(err)
+}
+
+func (s *RedisStore) RecordUsage(ctx context.Context, record *models.UsageRecord) error {
+	return s.cache.RecordUsage(ctx, record)
+}
+
+func (s *RedisStore) GetUsage(ctx context.Context, scope UsageScope, id string, period UsagePeriod) (*models.UsageTotals, error) {
+	return s.cache.GetUsage(ctx, string(scope)+":"+id, string(period))
+}
+
+func (s *RedisStore) StorePageChunks(ctx context.Context, contentHash, model string, chunks []*models.PageChunk) error {
+	return s.cache.StorePageChunks(ctx, contentHash, model, chunks)
+}
+
+func (s *RedisStore) GetPageChunks(ctx context.Context, contentHash, model string) ([]*models.PageChunk, error) {
+	chunks, err := s.cache.GetPageChunks(ctx, contentHash, model)
+	return chunks, translateRedisError(err)
+}
+
+func (s *RedisStore) StoreAttachment(ctx context.Context, attachment *models.Attachment) error {
+	return s.cache.StoreAttachment(ctx, attachment)
+}
+
+func (s *RedisStore) GetAttachment(ctx context.Context, attachmentID string) (*models.Attachment, error) {
+	attachment, err := s.cache.GetAttachment(ctx, attachmentID)
+	return attachment, translateRedisError(err)
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// translateRedisError maps missing keys to ErrNotFound
+func translateRedisError(err error) error {
+	if errors.Is(err, redis.Nil) || errors.Is(err, cache.ErrConversationNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,601 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // PostgreSQL driver
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+)
+
+// sqlDialect captures the differences between the SQL databases we support
+type sqlDialect struct {
+	// name selects the driver and the set of migrations
+	name string
+	// numberedPlaceholders rewrites ? placeholders to $1, $2, ...
+	numberedPlaceholders bool
+	// expire applies the Redis retention to rows instead of keeping them forever
+	expire bool
+	// advisoryLock serializes migrations of instances starting together
+	advisoryLock bool
+}
+
+var postgresDialect = sqlDialect{
+	name:                 "postgres",
+	numberedPlaceholders: true,
+	advisoryLock:         true,
+}
+
+// SQLStore implements Store on a relational database. Queries are written
+// once with ? placeholders and adapted to the dialect.
+type SQLStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewPostgresStore connects to PostgreSQL, applies pending migrations and
+// returns a durable store
+func NewPostgresStore(url string, maxConnections, maxIdleConnections int) (*SQLStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	db.SetMaxOpenConns(maxConnections)
+	db.SetMaxIdleConns(maxIdleConnections)
+
+	return newSQLStore(db, postgresDialect)
+}
+
+func newSQLStore(db *sql.DB, dialect sqlDialect) (*SQLStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	store := &SQLStore{db: db, dialect: dialect}
+	if err := store.migrate(ctx, dialect.name); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *SQLStore) StoreSession(ctx context.Context, session *models.UserSession) error {
+	preferences, err := marshalJSONMap(session.Preferences)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session preferences: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO sessions (id, user_id, created_at, last_active, preferences, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			user_id = excluded.user_id,
+			last_active = excluded.last_active,
+			preferences = excluded.preferences,
+			expires_at = excluded.expires_at`),
+		session.ID, session.UserID, session.CreatedAt.UTC(), session.LastActive.UTC(), preferences, s.expiresAt(SessionTTL))
+	if err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetSession(ctx context.Context, sessionID string) (*models.UserSession, error) {
+	var session models.UserSession
+	var preferences []byte
+
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT id, user_id, created_at, last_active, preferences
+		FROM sessions
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		sessionID, now()).Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.LastActive, &preferences)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	if err := json.Unmarshal(preferences, &session.Preferences); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session preferences: %w", err)
+	}
+	return &session, nil
+}
+
+func (s *SQLStore) DeleteSession(ctx context.Context, sessionID string) error {
+	if _, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE id = ?`), sessionID); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) StoreConversation(ctx context.Context, conversation *models.Conversation) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO conversations (id, session_id, url, title, created_at, updated_at, message_count, is_active, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			url = excluded.url,
+			title = excluded.title,
+			updated_at = excluded.updated_at,
+			is_active = excluded.is_active,
+			expires_at = excluded.expires_at`),
+		conversation.ID, conversation.SessionID, conversation.URL, conversation.Title,
+		conversation.CreatedAt.UTC(), conversation.UpdatedAt.UTC(), conversation.MessageCount, conversation.IsActive,
+		s.expiresAt(ConversationTTL))
+	if err != nil {
+		return fmt.Errorf("failed to store conversation: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	var conversation models.Conversation
+
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT id, session_id, url, title, created_at, updated_at, message_count, is_active
+		FROM conversations
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		conversationID, now()).Scan(
+		&conversation.ID, &conversation.SessionID, &conversation.URL, &conversation.Title,
+		&conversation.CreatedAt, &conversation.UpdatedAt, &conversation.MessageCount, &conversation.IsActive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	return &conversation, nil
+}
+
+// AppendMessage bumps the conversation's message count and uses the new
+// count as the message's sequence number. The row lock taken by the update
+// serializes concurrent appends to the same conversation.
+func (s *SQLStore) AppendMessage(ctx context.Context, message *models.Message) error {
+	metadata, err := marshalJSONMap(message.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message metadata: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current := now()
+	expiresAt := s.expiresAt(ConversationTTL)
+
+	var sequence int
+	err = tx.QueryRowContext(ctx, s.rebind(`
+		UPDATE conversations
+		SET message_count = message_count + 1, updated_at = ?, expires_at = ?
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)
+		RETURNING message_count`),
+		current, expiresAt, message.ConversationID, current).Scan(&sequence)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, s.rebind(`
+		INSERT INTO messages (id, conversation_id, type, content, timestamp, sequence_number, metadata, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		message.ID, message.ConversationID, string(message.Type), message.Content,
+		message.Timestamp.UTC(), sequence, metadata, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit message: %w", err)
+	}
+
+	message.SequenceNumber = sequence
+	return nil
+}
+
+func (s *SQLStore) GetConversationMessages(ctx context.Context, conversationID string, limit, offset int) ([]*models.Message, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(`
+		SELECT id, conversation_id, type, content, timestamp, sequence_number, metadata
+		FROM messages
+		WHERE conversation_id = ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY sequence_number
+		LIMIT ? OFFSET ?`),
+		conversationID, now(), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	return scanMessages(rows)
+}
+
+func (s *SQLStore) GetConversationMessagesAfter(ctx context.Context, conversationID string, afterSequence, limit int) ([]*models.Message, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(`
+		SELECT id, conversation_id, type, content, timestamp, sequence_number, metadata
+		FROM messages
+		WHERE conversation_id = ? AND sequence_number > ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY sequence_number
+		LIMIT ?`),
+		conversationID, afterSequence, now(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	return scanMessages(rows)
+}
+
+func (s *SQLStore) CountConversationMessages(ctx context.Context, conversationID string) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT COUNT(*) FROM messages
+		WHERE conversation_id = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		conversationID, now()).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+	return count, nil
+}
+
+func (s *SQLStore) StoreLLMResponse(ctx context.Context, response *models.LLMResponse) error {
+	var completedAt interface{}
+	if !response.CompletedAt.IsZero() {
+		completedAt = response.CompletedAt.UTC()
+	}
+
+	_, err := s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO llm_responses (id, message_id, stream_id, content, reasoning, is_complete, tokens_used, prompt_tokens, completion_tokens, model_used, created_at, completed_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			content = excluded.content,
+			reasoning = excluded.reasoning,
+			is_complete = excluded.is_complete,
+			tokens_used = excluded.tokens_used,
+			prompt_tokens = excluded.prompt_tokens,
+			completion_tokens = excluded.completion_tokens,
+			completed_at = excluded.completed_at,
+			expires_at = excluded.expires_at`),
+		response.ID, response.MessageID, response.StreamID, response.Content, response.Reasoning, response.IsComplete,
+		response.TokensUsed, response.PromptTokens, response.CompletionTokens, response.ModelUsed,
+		response.CreatedAt.UTC(), completedAt, s.expiresAt(ConversationTTL))
+	if err != nil {
+		return fmt.Errorf("failed to store LLM response: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) StoreWebpageContent(ctx context.Context, conversationID string, content *models.WebpageContent) error {
+	metadata, err := marshalJSONMap(content.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webpage metadata: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO webpage_contents (conversation_id, id, url, title, extracted_text, extraction_timestamp, content_hash, metadata, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (conversation_id) DO UPDATE SET
+			id = excluded.id,
+			url = excluded.url,
+			title = excluded.title,
+			extracted_text = excluded.extracted_text,
+			extraction_timestamp = excluded.extraction_timestamp,
+			content_hash = excluded.content_hash,
+			metadata = excluded.metadata,
+			expires_at = excluded.expires_at`),
+		conversationID, content.ID, content.URL, content.Title, content.ExtractedText,
+		content.ExtractionTimestamp.UTC(), content.ContentHash, metadata, s.expiresAt(ConversationTTL))
+	if err != nil {
+		return fmt.Errorf("failed to store webpage content: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetWebpageContent(ctx context.Context, conversationID string) (*models.WebpageContent, error) {
+	var content models.WebpageContent
+	var metadata []byte
+
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT id, url, title, extracted_text, extraction_timestamp, content_hash, metadata
+		FROM webpage_contents
+		WHERE conversation_id = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		conversationID, now()).Scan(
+		&content.ID, &content.URL, &content.Title, &content.ExtractedText,
+		&content.ExtractionTimestamp, &content.ContentHash, &metadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webpage content: %w", err)
+	}
+
+	if err := json.Unmarshal(metadata, &content.Metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webpage metadata: %w", err)
+	}
+	return &content, nil
+}
+
+func (s *SQLStore) RecordUsage(ctx context.Context, record *models.UsageRecord) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO usage_records (id, session_id, user_id, conversation_id, message_id, provider, model,
+			prompt_tokens, completion_tokens, total_tokens, cost, estimated, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		record.ID, record.SessionID, record.UserID, record.ConversationID, record.MessageID, record.Provider, record.Model,
+		record.PromptTokens, record.CompletionTokens, record.TotalTokens, record.Cost, record.Estimated, record.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetUsage(ctx context.Context, scope UsageScope, id string, period UsagePeriod) (*models.UsageTotals, error) {
+	column := "session_id"
+	if scope == UsageScopeUser {
+		column = "user_id"
+	}
+
+	var totals models.UsageTotals
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0),
+			COALESCE(SUM(total_tokens), 0), COALESCE(SUM(cost), 0),
+			COALESCE(SUM(CASE WHEN estimated THEN total_tokens ELSE 0 END), 0)
+		FROM usage_records
+		WHERE `+column+` = ? AND created_at >= ?`),
+		id, PeriodStart(period, time.Now())).Scan(&totals.Requests, &totals.PromptTokens, &totals.CompletionTokens, &totals.TotalTokens, &totals.Cost, &totals.EstimatedTokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+	return &totals, nil
+}
+
+func (s *SQLStore) StorePageChunks(ctx context.Context, contentHash, model string, chunks []*models.PageChunk) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM page_chunks WHERE content_hash = ? AND embedding_model = ?`), contentHash, model)
+	if err != nil {
+		return fmt.Errorf("failed to replace page chunks: %w", err)
+	}
+
+	expiresAt := s.expiresAt(ConversationTTL)
+	for _, chunk := range chunks {
+		embedding, err := json.Marshal(chunk.Embedding)
+		if err != nil {
+			return fmt.Errorf("failed to marshal chunk embedding: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, s.rebind(`
+			INSERT INTO page_chunks (content_hash, embedding_model, chunk_index, start_offset, end_offset, text, embedding, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			contentHash, model, chunk.Index, chunk.Start, chunk.End, chunk.Text, string(embedding), expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert page chunk: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit page chunks: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetPageChunks(ctx context.Context, contentHash, model string) ([]*models.PageChunk, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`
+		SELECT chunk_index, start_offset, end_offset, text, embedding
+		FROM page_chunks
+		WHERE content_hash = ? AND embedding_model = ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY chunk_index`),
+		contentHash, model, now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []*models.PageChunk
+	for rows.Next() {
+		chunk := &models.PageChunk{ContentHash: contentHash}
+		var embedding []byte
+		if err := rows.Scan(&chunk.Index, &chunk.Start, &chunk.End, &chunk.Text, &embedding); err != nil {
+			return nil, fmt.Errorf("failed to scan page chunk: %w", err)
+		}
+		if err := json.Unmarshal(embedding, &chunk.Embedding); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chunk embedding: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read page chunks: %w", err)
+	}
+
+	if len(chunks) == 0 {
+		return nil, ErrNotFound
+	}
+	return chunks, nil
+}
+
+func (s *SQLStore) StoreAttachment(ctx context.Context, attachment *models.Attachment) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO attachments (id, conversation_id, media_type, size, data, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		attachment.ID, attachment.ConversationID, attachment.MediaType, attachment.Size, attachment.Data,
+		attachment.CreatedAt.UTC(), s.expiresAt(ConversationTTL))
+	if err != nil {
+		return fmt.Errorf("failed to store attachment: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetAttachment(ctx context.Context, attachmentID string) (*models.Attachment, error) {
+	attachment := models.Attachment{ID: attachmentID}
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT conversation_id, media_type, size, data, created_at
+		FROM attachments
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		attachmentID, now()).Scan(
+		&attachment.ConversationID, &attachment.MediaType, &attachment.Size, &attachment.Data, &attachment.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+	return &attachment, nil
+}
+
+// PurgeExpired deletes rows whose retention has passed and returns how many
+// were removed. Rows without an expiry are never purged.
+func (s *SQLStore) PurgeExpired(ctx context.Context) (int64, error) {
+	var total int64
+	// Children first so the counts do not depend on cascading deletes
+	for _, table := range []string{"messages", "webpage_contents", "attachments", "llm_responses", "conversations", "sessions", "page_chunks"} {
+		result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE expires_at IS NOT NULL AND expires_at <= ?`), now())
+		if err != nil {
+			return total, fmt.Errorf("failed to purge %s: %w", table, err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// startPurging runs PurgeExpired in the background until Close is called
+func (s *SQLStore) startPurging(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				if n, err := s.PurgeExpired(ctx); err != nil {
+					log.Printf("Failed to purge expired rows: %v", err)
+				} else if n > 0 {
+					log.Printf("Purged %d expired rows", n)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// DB returns the connection pool of the store so that indexes kept in the
+// same database can share it. Close closes it.
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLStore) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+	return s.db.Close()
+}
+
+// rebind adapts a query written with ? placeholders to the dialect
+func (s *SQLStore) rebind(query string) string {
+	if !s.dialect.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// expiresAt returns the expiry for a row written now, or nil when the dialect
+// keeps rows forever
+func (s *SQLStore) expiresAt(ttl time.Duration) interface{} {
+	if !s.dialect.expire {
+		return nil
+	}
+	return now().Add(ttl)
+}
+
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+func marshalJSONMap(m map[string]interface{}) (string, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func scanMessages(rows *sql.Rows) ([]*models.Message, error) {
+	defer rows.Close()
+
+	messages := make([]*models.Message, 0)
+	for rows.Next() {
+		var message models.Message
+		var messageType string
+		var metadata []byte
+
+		if err := rows.Scan(&message.ID, &message.ConversationID, &messageType, &message.Content,
+			&message.Timestamp, &message.SequenceNumber, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		message.Type = models.MessageType(messageType)
+		if err := json.Unmarshal(metadata, &message.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message metadata: %w", err)
+		}
+		messages = append(messages, &message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	return messages, nil
+}
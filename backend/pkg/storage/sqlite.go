@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver
+)
+
+// purgeInterval is how often expired SQLite rows and memory store entries
+// are deleted. Reads already ignore them, so this only reclaims space.
+const purgeInterval = time.Hour
+
+var sqliteDialect = sqlDialect{
+	name:   "sqlite",
+	expire: true,
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database file at path, applies
+// pending migrations and expires rows with the same retention as the Redis
+// cache. It is meant for single-user, self-hosted deployments.
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	// The sqlite time format sorts correctly as text, which the expiry checks rely on
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma":      []string{"foreign_keys(1)", "busy_timeout(5000)", "journal_mode(WAL)"},
+		"_time_format": []string{"sqlite"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite allows a single writer, serialize access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	store, err := newSQLStore(db, sqliteDialect)
+	if err != nil {
+		return nil, err
+	}
+
+	store.startPurging(purgeInterval)
+	return store, nil
+}
+
+// SQLitePath returns the database file referenced by a DATABASE_URL such as
+// "sqlite:///var/lib/chromllm.db", "file:chromllm.db" or a plain path
+func SQLitePath(databaseURL string) string {
+	path := databaseURL
+	for _, prefix := range []string{"sqlite://", "sqlite:", "file:"} {
+		if strings.HasPrefix(path, prefix) {
+			path = strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
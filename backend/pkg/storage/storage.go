@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+)
+
+// Retention applied by backends that expire data, matching the Redis cache
+const (
+	SessionTTL      = 24 * time.Hour
+	ConversationTTL = 30 * 24 * time.Hour
+)
+
+// ErrNotFound is returned when the requested record does not exist or has expired
+var ErrNotFound = errors.New("record not found")
+
+// SessionStore persists user sessions
+type SessionStore interface {
+	StoreSession(ctx context.Context, session *models.UserSession) error
+	GetSession(ctx context.Context, sessionID string) (*models.UserSession, error)
+	DeleteSession(ctx context.Context, sessionID string) error
+}
+
+// ConversationStore persists conversations
+type ConversationStore interface {
+	StoreConversation(ctx context.Context, conversation *models.Conversation) error
+	GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error)
+}
+
+// MessageStore persists the ordered messages of a conversation and the LLM
+// responses they were produced from
+type MessageStore interface {
+	// AppendMessage assigns the next sequence number of the conversation to the
+	// message, stores it and updates the conversation's message count atomically
+	AppendMessage(ctx context.Context, message *models.Message) error
+	// GetConversationMessages returns messages in sequence order. A limit of zero
+	// or less returns every message from offset onwards.
+	GetConversationMessages(ctx context.Context, conversationID string, limit, offset int) ([]*models.Message, error)
+	// GetConversationMessagesAfter returns up to limit messages whose sequence
+	// number is strictly greater than afterSequence
+	GetConversationMessagesAfter(ctx context.Context, conversationID string, afterSequence, limit int) ([]*models.Message, error)
+	CountConversationMessages(ctx context.Context, conversationID string) (int, error)
+	StoreLLMResponse(ctx context.Context, response *models.LLMResponse) error
+}
+
+// WebpageStore persists the page content attached to a conversation
+type WebpageStore interface {
+	StoreWebpageContent(ctx context.Context, conversationID string, content *models.WebpageContent) error
+	GetWebpageContent(ctx context.Context, conversationID string) (*models.WebpageContent, error)
+}
+
+// UsageScope selects whose usage is aggregated
+type UsageScope string
+
+const (
+	UsageScopeSession UsageScope = "session"
+	UsageScopeUser    UsageScope = "user"
+)
+
+// UsagePeriod is the calendar period usage is aggregated over, in UTC
+type UsagePeriod string
+
+const (
+	UsagePeriodDay   UsagePeriod = "day"
+	UsagePeriodMonth UsagePeriod = "month"
+)
+
+// PeriodStart returns the start of the UTC day or month containing t
+func PeriodStart(period UsagePeriod, t time.Time) time.Time {
+	t = t.UTC()
+	if period == UsagePeriodMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// UsageStore tracks token usage and cost for quotas and billing
+type UsageStore interface {
+	RecordUsage(ctx context.Context, record *models.UsageRecord) error
+	// GetUsage sums the usage of a session or user in the current period.
+	// Unknown IDs have zero usage rather than ErrNotFound.
+	GetUsage(ctx context.Context, scope UsageScope, id string, period UsagePeriod) (*models.UsageTotals, error)
+}
+
+// ChunkStore keeps the embedded chunks of page content by content hash and
+// embedding model, so a page is embedded once however many conversations
+// are about it
+type ChunkStore interface {
+	// StorePageChunks replaces the chunks stored for the content and model
+	StorePageChunks(ctx context.Context, contentHash, model string, chunks []*models.PageChunk) error
+	// GetPageChunks returns chunks in index order, or ErrNotFound when the
+	// content has not been embedded with the model
+	GetPageChunks(ctx context.Context, contentHash, model string) ([]*models.PageChunk, error)
+}
+
+// AttachmentStore keeps the images attached to questions for as long as
+// their conversation
+type AttachmentStore interface {
+	StoreAttachment(ctx context.Context, attachment *models.Attachment) error
+	GetAttachment(ctx context.Context, attachmentID string) (*models.Attachment, error)
+}
+
+// Store is the persistence layer used by the HTTP handlers
+type Store interface {
+	SessionStore
+	ConversationStore
+	MessageStore
+	WebpageStore
+	UsageStore
+	ChunkStore
+	AttachmentStore
+	Close() error
+}
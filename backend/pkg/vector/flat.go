@@ -0,0 +1,94 @@
+package vector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// FlatIndex keeps entries in process memory and searches by comparing the
+// query with every entry of the owner. It is exact and fast enough for a
+// personal knowledge base, but loses its data on restart.
+type FlatIndex struct {
+	mutex sync.RWMutex
+	pages map[string]map[string][]Entry
+}
+
+// NewFlatIndex creates an empty in-memory index
+func NewFlatIndex() *FlatIndex {
+	return &FlatIndex{pages: make(map[string]map[string][]Entry)}
+}
+
+func (i *FlatIndex) SavePage(ctx context.Context, entries []Entry) error {
+	if len(entries) == 0 {
+		return errors.New("a page needs at least one entry")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	owner := entries[0].Owner
+	if i.pages[owner] == nil {
+		i.pages[owner] = make(map[string][]Entry)
+	}
+	i.pages[owner][entries[0].PageID] = append([]Entry(nil), entries...)
+	return nil
+}
+
+func (i *FlatIndex) Search(ctx context.Context, query Query) ([]Match, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var entries []Entry
+	for _, page := range i.pages[query.Owner] {
+		entries = append(entries, page...)
+	}
+	return rank(query, entries), nil
+}
+
+func (i *FlatIndex) ListPages(ctx context.Context, owner string) ([]Page, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	pages := make([]Page, 0, len(i.pages[owner]))
+	for _, entries := range i.pages[owner] {
+		pages = append(pages, pageOf(entries))
+	}
+	sortPages(pages)
+	return pages, nil
+}
+
+func (i *FlatIndex) DeletePage(ctx context.Context, owner, pageID string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if _, exists := i.pages[owner][pageID]; !exists {
+		return ErrNotFound
+	}
+	delete(i.pages[owner], pageID)
+	return nil
+}
+
+func (i *FlatIndex) DeleteSavedBefore(ctx context.Context, before time.Time) (int64, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var removed int64
+	for owner, pages := range i.pages {
+		for pageID, entries := range pages {
+			if entries[0].SavedAt.Before(before) {
+				delete(pages, pageID)
+				removed++
+			}
+		}
+		if len(pages) == 0 {
+			delete(i.pages, owner)
+		}
+	}
+	return removed, nil
+}
+
+func (i *FlatIndex) Close() error {
+	return nil
+}
@@ -0,0 +1,172 @@
+package vector
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PgvectorIndex stores entries in PostgreSQL and lets the pgvector
+// extension compute distances
+type PgvectorIndex struct {
+	db *sql.DB
+}
+
+// NewPgvectorIndex keeps entries in a PostgreSQL database to which the
+// knowledge migrations have been applied, see storage.MigrateKnowledge. The
+// database belongs to the caller, normally it is the pool of the store. The
+// embedding column has no fixed dimension so models can be changed, which
+// rules out an approximate index; searches are exact scans of one owner's
+// entries of one model.
+func NewPgvectorIndex(db *sql.DB) *PgvectorIndex {
+	return &PgvectorIndex{db: db}
+}
+
+func (i *PgvectorIndex) SavePage(ctx context.Context, entries []Entry) error {
+	if len(entries) == 0 {
+		return errors.New("a page needs at least one entry")
+	}
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM knowledge_chunks WHERE owner = $1 AND page_id = $2`,
+		entries[0].Owner, entries[0].PageID); err != nil {
+		return fmt.Errorf("failed to replace page: %w", err)
+	}
+
+	for _, entry := range entries {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO knowledge_chunks (owner, page_id, chunk_index, url, title, saved_at, model,
+				start_offset, end_offset, text, embedding)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11::vector)`,
+			entry.Owner, entry.PageID, entry.Chunk, entry.URL, entry.Title, entry.SavedAt.UTC(), entry.Model,
+			entry.Start, entry.End, entry.Text, vectorLiteral(entry.Vector))
+		if err != nil {
+			return fmt.Errorf("failed to insert entry: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit page: %w", err)
+	}
+	return nil
+}
+
+func (i *PgvectorIndex) Search(ctx context.Context, query Query) ([]Match, error) {
+	since, until := query.Since, query.Until
+	if since.IsZero() {
+		since = time.Unix(0, 0)
+	}
+	if until.IsZero() {
+		until = time.Now().AddDate(100, 0, 0)
+	}
+	limit := query.TopK
+	if limit <= 0 {
+		limit = 10
+	}
+
+	// <=> is the cosine distance
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT owner, page_id, chunk_index, url, title, saved_at, model, start_offset, end_offset, text,
+			1 - (embedding <=> $1::vector)
+		FROM knowledge_chunks
+		WHERE owner = $2 AND model = $3 AND saved_at >= $4 AND saved_at <= $5
+		ORDER BY embedding <=> $1::vector
+		LIMIT $6`,
+		vectorLiteral(query.Vector), query.Owner, query.Model, since.UTC(), until.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search knowledge: %w", err)
+	}
+	defer rows.Close()
+
+	var matches []Match
+	for rows.Next() {
+		var match Match
+		if err := rows.Scan(&match.Owner, &match.PageID, &match.Chunk, &match.URL, &match.Title, &match.SavedAt,
+			&match.Model, &match.Start, &match.End, &match.Text, &match.Score); err != nil {
+			return nil, fmt.Errorf("failed to scan match: %w", err)
+		}
+		matches = append(matches, match)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read matches: %w", err)
+	}
+	return matches, nil
+}
+
+func (i *PgvectorIndex) ListPages(ctx context.Context, owner string) ([]Page, error) {
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT page_id, MIN(url), MIN(title), MAX(saved_at), COUNT(*)
+		FROM knowledge_chunks
+		WHERE owner = $1
+		GROUP BY page_id
+		ORDER BY MAX(saved_at) DESC`, owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pages: %w", err)
+	}
+	defer rows.Close()
+
+	pages := make([]Page, 0)
+	for rows.Next() {
+		var page Page
+		if err := rows.Scan(&page.ID, &page.URL, &page.Title, &page.SavedAt, &page.Chunks); err != nil {
+			return nil, fmt.Errorf("failed to scan page: %w", err)
+		}
+		pages = append(pages, page)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pages: %w", err)
+	}
+	return pages, nil
+}
+
+func (i *PgvectorIndex) DeletePage(ctx context.Context, owner, pageID string) error {
+	result, err := i.db.ExecContext(ctx, `DELETE FROM knowledge_chunks WHERE owner = $1 AND page_id = $2`, owner, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to delete page: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (i *PgvectorIndex) DeleteSavedBefore(ctx context.Context, before time.Time) (int64, error) {
+	var removed int64
+	err := i.db.QueryRowContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM knowledge_chunks WHERE saved_at < $1 RETURNING owner, page_id
+		)
+		SELECT COUNT(DISTINCT (owner, page_id)) FROM deleted`, before.UTC()).Scan(&removed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete pages: %w", err)
+	}
+	return removed, nil
+}
+
+// Close leaves the database open for its owner
+func (i *PgvectorIndex) Close() error {
+	return nil
+}
+
+// vectorLiteral formats a vector in the text form pgvector parses, e.g. [1,0.5]
+func vectorLiteral(v []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, x := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(x), 'f', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
@@ -0,0 +1,171 @@
+package vector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
+)
+
+// RedisIndex keeps each saved page's entries under one key and a hash of
+// the owner's pages next to them. Searches load the owner's pages and
+// compare every entry, like FlatIndex, so it needs no Redis modules. A
+// sorted set of all pages by the time they were saved lets old pages be
+// deleted without scanning keys.
+type RedisIndex struct {
+	client *cache.RedisClient
+}
+
+// NewRedisIndex creates an index stored in Redis. Saved pages never expire.
+func NewRedisIndex(client *cache.RedisClient) *RedisIndex {
+	return &RedisIndex{client: client}
+}
+
+func knowledgePagesKey(owner string) string {
+	return fmt.Sprintf("knowledge:%s:pages", owner)
+}
+
+func knowledgeEntriesKey(owner, pageID string) string {
+	return fmt.Sprintf("knowledge:%s:page:%s", owner, pageID)
+}
+
+// knowledgeSavedKey is the sorted set of the pages of all owners, scored by
+// the Unix time they were saved
+const knowledgeSavedKey = "knowledge:saved"
+
+// savedMember names a page in knowledgeSavedKey. Page IDs contain no
+// spaces, so the last one separates them from the owner.
+func savedMember(owner, pageID string) string {
+	return owner + " " + pageID
+}
+
+func (i *RedisIndex) SavePage(ctx context.Context, entries []Entry) error {
+	if len(entries) == 0 {
+		return errors.New("a page needs at least one entry")
+	}
+
+	owner, pageID := entries[0].Owner, entries[0].PageID
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entries: %w", err)
+	}
+	pageJSON, err := json.Marshal(pageOf(entries))
+	if err != nil {
+		return fmt.Errorf("failed to marshal page: %w", err)
+	}
+
+	return i.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, knowledgeEntriesKey(owner, pageID), entriesJSON, 0)
+		pipe.HSet(ctx, knowledgePagesKey(owner), pageID, pageJSON)
+		pipe.ZAdd(ctx, knowledgeSavedKey, &redis.Z{Score: float64(entries[0].SavedAt.Unix()), Member: savedMember(owner, pageID)})
+		return nil
+	})
+}
+
+func (i *RedisIndex) Search(ctx context.Context, query Query) ([]Match, error) {
+	pages, err := i.ListPages(ctx, query.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, page := range pages {
+		if query.inRange(page.SavedAt) {
+			keys = append(keys, knowledgeEntriesKey(query.Owner, page.ID))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	values, err := i.client.MGet(ctx, keys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load entries: %w", err)
+	}
+
+	var entries []Entry
+	for _, value := range values {
+		entriesJSON, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var page []Entry
+		if err := json.Unmarshal([]byte(entriesJSON), &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal entries: %w", err)
+		}
+		entries = append(entries, page...)
+	}
+	return rank(query, entries), nil
+}
+
+func (i *RedisIndex) ListPages(ctx context.Context, owner string) ([]Page, error) {
+	values, err := i.client.HGetAll(ctx, knowledgePagesKey(owner))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pages: %w", err)
+	}
+
+	pages := make([]Page, 0, len(values))
+	for _, pageJSON := range values {
+		var page Page
+		if err := json.Unmarshal([]byte(pageJSON), &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal page: %w", err)
+		}
+		pages = append(pages, page)
+	}
+	sortPages(pages)
+	return pages, nil
+}
+
+func (i *RedisIndex) DeletePage(ctx context.Context, owner, pageID string) error {
+	var removed *redis.IntCmd
+	err := i.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(ctx, knowledgePagesKey(owner), pageID)
+		pipe.Del(ctx, knowledgeEntriesKey(owner, pageID))
+		pipe.ZRem(ctx, knowledgeSavedKey, savedMember(owner, pageID))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete page: %w", err)
+	}
+	if removed.Val() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (i *RedisIndex) DeleteSavedBefore(ctx context.Context, before time.Time) (int64, error) {
+	members, err := i.client.ZRangeByScore(ctx, knowledgeSavedKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(before.Unix(), 10),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list old pages: %w", err)
+	}
+
+	var removed int64
+	for _, member := range members {
+		separator := strings.LastIndexByte(member, ' ')
+		if separator < 0 {
+			continue
+		}
+		err := i.DeletePage(ctx, member[:separator], member[separator+1:])
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (i *RedisIndex) Close() error {
+	return i.client.Close()
+}
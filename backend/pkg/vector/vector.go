@@ -0,0 +1,132 @@
+package vector
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrNotFound is returned when a saved page does not exist
+var ErrNotFound = errors.New("page not found")
+
+// Entry is an embedded chunk of a page saved to a knowledge base. Start and
+// End are character offsets into the page's extracted text.
+type Entry struct {
+	Owner   string    `json:"owner"`
+	PageID  string    `json:"page_id"`
+	URL     string    `json:"url"`
+	Title   string    `json:"title"`
+	SavedAt time.Time `json:"saved_at"`
+	Model   string    `json:"model"`
+	Chunk   int       `json:"chunk"`
+	Start   int       `json:"start"`
+	End     int       `json:"end"`
+	Text    string    `json:"text"`
+	Vector  []float32 `json:"vector,omitempty"`
+}
+
+// Page describes a saved page
+type Page struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Title   string    `json:"title"`
+	SavedAt time.Time `json:"saved_at"`
+	Chunks  int       `json:"chunks"`
+}
+
+// Query searches the knowledge base of one owner. Only entries embedded
+// with Model are compared, and zero times leave the range open.
+type Query struct {
+	Owner  string
+	Model  string
+	Vector []float32
+	TopK   int
+	Since  time.Time
+	Until  time.Time
+}
+
+// Match is an entry found by a query, with its cosine similarity
+type Match struct {
+	Entry
+	Score float64 `json:"score"`
+}
+
+// Index stores the embedded chunks of saved pages, grouped per owner
+type Index interface {
+	// SavePage replaces the entries of a page with the given ones, which
+	// must all belong to the same owner and page
+	SavePage(ctx context.Context, entries []Entry) error
+	Search(ctx context.Context, query Query) ([]Match, error)
+	// ListPages returns the owner's pages, most recently saved first
+	ListPages(ctx context.Context, owner string) ([]Page, error)
+	DeletePage(ctx context.Context, owner, pageID string) error
+	// DeleteSavedBefore removes the pages of every owner saved before a time
+	// and returns how many it removed
+	DeleteSavedBefore(ctx context.Context, before time.Time) (int64, error)
+	Close() error
+}
+
+// Cosine returns the cosine similarity of two vectors, zero when their
+// dimensions differ
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// inRange reports whether a page saved at t matches the query's time range
+func (q Query) inRange(t time.Time) bool {
+	return (q.Since.IsZero() || !t.Before(q.Since)) && (q.Until.IsZero() || !t.After(q.Until))
+}
+
+// rank scores entries against the query and keeps the TopK best, for
+// indexes that search by scanning
+func rank(query Query, entries []Entry) []Match {
+	var matches []Match
+	for _, entry := range entries {
+		if entry.Model != query.Model || !query.inRange(entry.SavedAt) {
+			continue
+		}
+		match := Match{Entry: entry, Score: Cosine(query.Vector, entry.Vector)}
+		match.Vector = nil
+		matches = append(matches, match)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if query.TopK > 0 && len(matches) > query.TopK {
+		matches = matches[:query.TopK]
+	}
+	return matches
+}
+
+// pageOf summarizes the entries of one page
+func pageOf(entries []Entry) Page {
+	return Page{
+		ID:      entries[0].PageID,
+		URL:     entries[0].URL,
+		Title:   entries[0].Title,
+		SavedAt: entries[0].SavedAt,
+		Chunks:  len(entries),
+	}
+}
+
+func sortPages(pages []Page) {
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].SavedAt.After(pages[j].SavedAt)
+	})
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/config"
+	"github.com/jzhang405/SmartChrome/backend/internal/handlers"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+// endless returns a body that starts with prefix and goes on for 64MB
+func endless(prefix string) *countingReader {
+	filler := io.LimitReader(strings.NewReader(strings.Repeat("A", 64<<20)), 64<<20)
+	return &countingReader{reader: io.MultiReader(strings.NewReader(prefix), filler)}
+}
+
+func TestAttachmentBodiesAreLimitedWhileReading(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStore()
+	conversation := models.NewConversation("session-1", "https://example.com", "Example")
+	if err := store.StoreConversation(context.Background(), conversation); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewHandlers(store, nil, llm.NewLLMClient(), config.QuotaConfig{},
+		config.AttachmentConfig{MaxBytes: 1000, MaxPerMessage: 2}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/conversations/:conversationId/attachments", h.UploadAttachment)
+	router.POST("/conversations/:conversationId/messages", h.SendMessage)
+
+	var header strings.Builder
+	writer := multipart.NewWriter(&header)
+	writer.CreateFormFile("file", "screenshot.png")
+
+	requests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        *countingReader
+	}{
+		{"json upload", "attachments", "application/json", endless(`{"data":"`)},
+		{"multipart upload", "attachments", writer.FormDataContentType(), endless(header.String())},
+		{"message", "messages", "application/json", endless(`{"content":"What is this?","type":"user_question","attachments":[{"data":"`)},
+	}
+
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/conversations/"+conversation.ID+"/"+request.path, request.body)
+		req.Header.Set("Content-Type", request.contentType)
+		router.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "ATTACHMENT_TOO_LARGE") {
+			t.Errorf("%s: expected 413 ATTACHMENT_TOO_LARGE, got %d %s", request.name, recorder.Code, recorder.Body.String())
+		}
+		if request.body.read > 4<<20 {
+			t.Errorf("%s: read %d bytes of an oversized body", request.name, request.body.read)
+		}
+	}
+}
+
+func TestSocketQuestionsReferenceUploadedAttachments(t *testing.T) {
+	store := storage.NewMemoryStore()
+	conversation := models.NewConversation("session-1", "https://example.com", "Example")
+	if err := store.StoreConversation(context.Background(), conversation); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewHandlers(store, nil, llm.NewLLMClient(), config.QuotaConfig{},
+		config.AttachmentConfig{MaxBytes: 1000, MaxPerMessage: 2}, nil, nil)
+
+	// Inline images would need frames far larger than the socket allows
+	_, err := h.AskQuestion(context.Background(), "session-1", "", conversation.ID,
+		json.RawMessage(`{"content":"What is this?","attachments":[{"data":"iVBORw0KGgo="}]}`))
+	var appErr *middleware.AppError
+	if !errors.As(err, &appErr) || appErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected inline attachments to be rejected with 400, got %v", err)
+	}
+}
+
+func TestAttachmentsRequireOwnedConversation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStore()
+	other := models.NewConversation("session-2", "https://example.org", "Other")
+	if err := store.StoreConversation(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	attachment := models.NewAttachment(other.ID, "image/png", []byte("\x89PNG\r\n\x1a\n"))
+	if err := store.StoreAttachment(context.Background(), attachment); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewHandlers(store, nil, llm.NewLLMClient(), config.QuotaConfig{},
+		config.AttachmentConfig{MaxBytes: 1000, MaxPerMessage: 2}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/conversations/:conversationId/attachments", h.UploadAttachment)
+	router.GET("/conversations/:conversationId/attachments/:attachmentId", h.GetAttachment)
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/conversations/"+other.ID+"/attachments", strings.NewReader(`{"data":"iVBORw0KGgo="}`)),
+		httptest.NewRequest(http.MethodGet, "/conversations/"+other.ID+"/attachments/"+attachment.ID, nil),
+	}
+	for _, request := range requests {
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404, got %d", request.Method, request.URL.Path, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/jzhang405/SmartChrome/backend/config"
+)
+
+func TestLoadNamedLLMProviders(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("LLM_PROVIDERS", "groq, azure-gpt4")
+	t.Setenv("GROQ_API_KEY", "groq-key")
+	t.Setenv("GROQ_BASE_URL", "https://api.groq.com/openai/v1")
+	t.Setenv("GROQ_MODEL", "llama-3.1-70b-versatile")
+	t.Setenv("AZURE_GPT4_API_TYPE", "azure")
+	t.Setenv("AZURE_GPT4_API_VERSION", "2024-02-01")
+	t.Setenv("LLM_DEFAULT_PROVIDER", "groq")
+
+	cfg := config.Load()
+
+	providers := map[string]config.LLMConfig{}
+	for _, llmConfig := range cfg.LLMs {
+		providers[llmConfig.Provider] = llmConfig
+	}
+
+	if _, ok := providers["openai"]; ok {
+		t.Errorf("openai should not be configured without an API key")
+	}
+
+	groq := providers["groq"]
+	if groq.Type != "openai" || groq.APIKey != "groq-key" || groq.Model != "llama-3.1-70b-versatile" || !groq.IsDefault {
+		t.Errorf("unexpected groq config: %+v", groq)
+	}
+
+	azure := providers["azure-gpt4"]
+	if azure.APIType != "azure" || azure.APIVersion != "2024-02-01" || azure.IsDefault {
+		t.Errorf("unexpected azure config: %+v", azure)
+	}
+}
+
+func TestLoadPrices(t *testing.T) {
+	t.Setenv("LLM_PRICES", "groq=0.59:0.79, openai/gpt-4o=5:15, broken")
+
+	quota := config.Load().Quota
+	if price := quota.Price("groq", "llama-3.1-70b-versatile"); price.Input != 0.59 || price.Output != 0.79 {
+		t.Errorf("provider-wide price not applied: %+v", price)
+	}
+	if cost := quota.Price("openai", "gpt-4o").Cost(1000000, 100000); cost != 6.5 {
+		t.Errorf("expected overridden gpt-4o cost 6.5, got %v", cost)
+	}
+	if price := quota.Price("ollama", "llama3.1"); price.Input != 0 || price.Output != 0 {
+		t.Errorf("unlisted models should be free: %+v", price)
+	}
+}
+
+func TestStorageBackendFromDatabaseURL(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "")
+	for url, backend := range map[string]string{
+		"":                                   "redis",
+		"postgres://localhost:5432/chromllm": "postgres",
+		"sqlite:///var/lib/chromllm.db":      "sqlite",
+		"chromllm.db":                        "sqlite",
+		"mysql://localhost:3306/chromllm":    "mysql",
+	} {
+		t.Setenv("DATABASE_URL", url)
+		if got := config.Load().Storage.Backend; got != backend {
+			t.Errorf("DATABASE_URL %q selected backend %q, expected %q", url, got, backend)
+		}
+	}
+}
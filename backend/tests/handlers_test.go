@@ -0,0 +1,318 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/config"
+	"github.com/jzhang405/SmartChrome/backend/internal/handlers"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/websocket"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+func TestSendMessageRequiresOwnedConversation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStore()
+	other := models.NewConversation("session-2", "https://example.org", "Other")
+	if err := store.StoreConversation(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewHandlers(store, nil, llm.NewLLMClient(), config.QuotaConfig{}, config.AttachmentConfig{}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/v1/conversations/:conversationId/messages", h.SendMessage)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/conversations/"+other.ID+"/messages",
+		strings.NewReader(`{"content":"What is this page about?","type":"user_question"}`)))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a conversation of another session, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	messages, _ := store.GetConversationMessages(context.Background(), other.ID, 0, 0)
+	if len(messages) != 0 {
+		t.Errorf("expected nothing stored, got %d messages", len(messages))
+	}
+}
+
+func TestExtractDataRequiresOwnedConversation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStore()
+	other := models.NewConversation("session-2", "https://example.org", "Other")
+	if err := store.StoreConversation(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewHandlers(store, nil, llm.NewLLMClient(), config.QuotaConfig{}, config.AttachmentConfig{}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/v1/conversations/:conversationId/extract", h.ExtractData)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/conversations/"+other.ID+"/extract",
+		strings.NewReader(`{"instructions":"List the prices","schema":{"type":"object"}}`)))
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), "NOT_FOUND") {
+		t.Errorf("expected 404 for a conversation of another session, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// laterMessageStore stores a message right before the history of a
+// conversation is read, as when another question is asked meanwhile
+type laterMessageStore struct {
+	storage.Store
+	later *models.Message
+}
+
+func (s *laterMessageStore) GetConversationMessages(ctx context.Context, conversationID string, limit, offset int) ([]*models.Message, error) {
+	if s.later != nil {
+		s.AppendMessage(ctx, s.later)
+		s.later = nil
+	}
+	return s.Store.GetConversationMessages(ctx, conversationID, limit, offset)
+}
+
+// stubChatServer answers every chat request with answer, passing the
+// messages of each request to requests
+func stubChatServer(answer string, requests chan<- []map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []map[string]interface{} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if requests != nil {
+			requests <- request.Messages
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", answer)
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":40,\"completion_tokens\":10,\"total_tokens\":50}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+}
+
+// stubLLMClient returns a client whose only provider is the stub server
+func stubLLMClient(t *testing.T, server *httptest.Server) *llm.LLMClient {
+	t.Helper()
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "openai", BaseURL: server.URL + "/v1", Model: "gpt-4o-mini", StreamUsage: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", provider)
+	return client
+}
+
+func TestAnswerHistoryHasOnlyEarlierTurns(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	memory := storage.NewMemoryStore()
+	conversation := models.NewConversation("session-1", "https://example.com", "Example")
+	if err := memory.StoreConversation(ctx, conversation); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []*models.Message{
+		models.NewMessage(conversation.ID, models.UserQuestion, "First question", 0),
+		models.NewMessage(conversation.ID, models.LLMReply, "First answer", 0),
+		models.NewMessage(conversation.ID, "page_note", "A note on the page", 0),
+	} {
+		if err := memory.AppendMessage(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &laterMessageStore{Store: memory, later: models.NewMessage(conversation.ID, models.UserQuestion, "A later question", 0)}
+
+	requests := make(chan []map[string]interface{}, 1)
+	server := stubChatServer("Second answer", requests)
+	defer server.Close()
+	h := handlers.NewHandlers(store, nil, stubLLMClient(t, server), config.QuotaConfig{}, config.AttachmentConfig{}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/v1/conversations/:conversationId/messages", h.SendMessage)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/conversations/"+conversation.ID+"/messages",
+		strings.NewReader(`{"content":"Second question","type":"user_question"}`)))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	var messages []map[string]interface{}
+	select {
+	case messages = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the question was not sent to the model")
+	}
+
+	var turns []string
+	for _, message := range messages {
+		content, _ := message["content"].(string)
+		if strings.Contains(content, "A note on the page") || strings.Contains(content, "A later question") {
+			t.Errorf("unexpected %s message in the prompt: %q", message["role"], content)
+		}
+		if message["role"] != "system" {
+			turns = append(turns, fmt.Sprintf("%s", message["role"]))
+		}
+	}
+	if strings.Join(turns, ",") != "user,assistant,user" {
+		t.Errorf("expected the earlier turn and the question, got %v", turns)
+	}
+}
+
+// responseStore keeps the LLM responses stored through it
+type responseStore struct {
+	storage.Store
+	mutex     sync.Mutex
+	responses []*models.LLMResponse
+}
+
+func (s *responseStore) StoreLLMResponse(ctx context.Context, response *models.LLMResponse) error {
+	s.mutex.Lock()
+	s.responses = append(s.responses, response)
+	s.mutex.Unlock()
+	return s.Store.StoreLLMResponse(ctx, response)
+}
+
+func TestSendMessageStreamsAndStoresAnswer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := &responseStore{Store: storage.NewMemoryStore()}
+	conversation := models.NewConversation("session-1", "https://example.com", "Example")
+	if err := store.StoreConversation(ctx, conversation); err != nil {
+		t.Fatal(err)
+	}
+	server := stubChatServer("The page is about Go.", nil)
+	defer server.Close()
+	h := handlers.NewHandlers(store, nil, stubLLMClient(t, server), config.QuotaConfig{}, config.AttachmentConfig{}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/v1/conversations/:conversationId/messages", h.SendMessage)
+	router.GET("/v1/stream/events", h.StreamEventsHandler)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/conversations/"+conversation.ID+"/messages",
+		strings.NewReader(`{"content":"What is this page about?","type":"user_question"}`)))
+	var question models.Message
+	if err := json.Unmarshal(recorder.Body.Bytes(), &question); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// The stream ends after its final event
+	streamCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		"/v1/stream/events?conversationId="+conversation.ID+"&messageId="+question.ID, nil).WithContext(streamCtx))
+
+	var content strings.Builder
+	var final websocket.StreamMessage
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &final); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+			content.WriteString(final.Content)
+		}
+	}
+	data, _ := final.Data.(map[string]interface{})
+	if content.String() != "The page is about Go." || data["is_complete"] != true {
+		t.Fatalf("unexpected stream %q ending with %+v", content.String(), final)
+	}
+
+	if len(store.responses) != 1 || store.responses[0].Content != "The page is about Go." || store.responses[0].TokensUsed != 50 {
+		t.Errorf("unexpected stored responses %+v", store.responses)
+	}
+
+	messages, err := store.GetConversationMessages(ctx, conversation.ID, 0, 0)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("expected the question and its reply, got %d messages (%v)", len(messages), err)
+	}
+	reply := messages[1]
+	if questionID, _ := reply.GetMetadata("question_id"); reply.Type != models.LLMReply || questionID != question.ID {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if reply.Content != "The page is about Go." || data["reply_id"] != reply.ID {
+		t.Errorf("reply %s %q does not match the stream's %v", reply.ID, reply.Content, data["reply_id"])
+	}
+
+	usage, err := store.GetUsage(ctx, storage.UsageScopeSession, "session-1", storage.UsagePeriodDay)
+	if err != nil || usage.TotalTokens != 50 {
+		t.Errorf("expected the answer's usage to be recorded, got %+v (%v)", usage, err)
+	}
+}
+
+func TestQuestionsOverQuotaAreRejectedOrDowngraded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	conversation := models.NewConversation("session-1", "https://example.com", "Example")
+	if err := store.StoreConversation(ctx, conversation); err != nil {
+		t.Fatal(err)
+	}
+	// The session has used up its daily budget
+	if err := store.RecordUsage(ctx, models.NewUsageRecord("session-1", "", conversation.ID, "", "openai", "gpt-4o-mini", 15, 5, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	paid := stubChatServer("A paid answer", nil)
+	defer paid.Close()
+	requests := make(chan []map[string]interface{}, 1)
+	local := stubChatServer("A local answer", requests)
+	defer local.Close()
+	client := stubLLMClient(t, paid)
+	localProvider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "local", BaseURL: local.URL + "/v1", Model: "local-model"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RegisterProvider("local", localProvider)
+
+	ask := func(quota config.QuotaConfig) *httptest.ResponseRecorder {
+		h := handlers.NewHandlers(store, nil, client, quota, config.AttachmentConfig{}, nil, nil)
+		router := gin.New()
+		router.Use(middleware.ErrorMiddleware())
+		router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+		router.POST("/v1/conversations/:conversationId/messages", h.SendMessage)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/conversations/"+conversation.ID+"/messages",
+			strings.NewReader(`{"content":"What is this page about?","type":"user_question","provider":"openai"}`)))
+		return recorder
+	}
+
+	recorder := ask(config.QuotaConfig{SessionDailyTokens: 10})
+	if recorder.Code != http.StatusTooManyRequests || !strings.Contains(recorder.Body.String(), "QUOTA_EXCEEDED") {
+		t.Errorf("expected 429 QUOTA_EXCEEDED, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = ask(config.QuotaConfig{SessionDailyTokens: 10, DowngradeProvider: "local"})
+	var question models.Message
+	if err := json.Unmarshal(recorder.Body.Bytes(), &question); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("expected the question to be downgraded, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if downgraded, _ := question.GetMetadata("downgraded_to"); downgraded != "local" {
+		t.Errorf("expected the question to record the downgrade, got %v", question.Metadata)
+	}
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Error("the downgraded question was not sent to the downgrade provider")
+	}
+}
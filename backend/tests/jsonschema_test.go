@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jzhang405/SmartChrome/backend/pkg/jsonschema"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := jsonschema.Parse([]byte(`{
+		"type": "object",
+		"required": ["rows"],
+		"additionalProperties": false,
+		"properties": {
+			"rows": {
+				"type": "array",
+				"minItems": 1,
+				"items": {
+					"type": "object",
+					"required": ["email"],
+					"properties": {
+						"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+						"age": {"type": "integer", "minimum": 0},
+						"role": {"enum": ["admin", "user"]}
+					}
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	tests := []struct {
+		value    string
+		problems []string
+	}{
+		{`{"rows":[{"email":"a@example.com","age":30,"role":"admin"}]}`, nil},
+		{`{"rows":[]}`, []string{"$.rows: expected at least 1 items"}},
+		{`{"rows":[{"age":1.5}],"extra":true}`, []string{
+			`$: unexpected property "extra"`,
+			`$.rows[0]: missing required property "email"`,
+			"$.rows[0].age: expected integer, got number",
+		}},
+		{`{"rows":[{"email":"nobody","role":"guest"}]}`, []string{"$.rows[0].email: does not match", "$.rows[0].role: must be one of"}},
+		{`[]`, []string{"$: expected object, got array"}},
+	}
+
+	for _, test := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(test.value), &value); err != nil {
+			t.Fatal(err)
+		}
+
+		err := schema.Validate(value)
+		if len(test.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.value, err)
+			}
+			continue
+		}
+
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) || len(validationErr.Problems) != len(test.problems) {
+			t.Errorf("%s: expected %d problems, got %v", test.value, len(test.problems), err)
+			continue
+		}
+		for i, problem := range test.problems {
+			if !strings.HasPrefix(validationErr.Problems[i], problem) {
+				t.Errorf("%s: expected %q, got %q", test.value, problem, validationErr.Problems[i])
+			}
+		}
+	}
+
+	if _, err := jsonschema.Parse([]byte(`{"type":"text"}`)); !errors.Is(err, jsonschema.ErrInvalidSchema) {
+		t.Errorf("expected an unknown type to be rejected, got %v", err)
+	}
+}
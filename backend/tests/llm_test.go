@@ -0,0 +1,735 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+// collect drains a response stream into the generated text and the final chunk
+func collect(t *testing.T, stream <-chan llm.StreamResponse) (string, llm.StreamResponse) {
+	t.Helper()
+
+	var text strings.Builder
+	var last llm.StreamResponse
+	for chunk := range stream {
+		if chunk.Error != nil {
+			t.Fatalf("stream error: %v", chunk.Error)
+		}
+		text.WriteString(chunk.Content)
+		last = chunk
+	}
+	return text.String(), last
+}
+
+func TestAnthropicProviderStream(t *testing.T) {
+	var request map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "test-key" {
+			http.Error(w, `{"type":"error","error":{"type":"authentication_error","message":"bad request"}}`, http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := []string{
+			`{"type":"message_start","message":{"usage":{"input_tokens":12,"output_tokens":1}}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+			`{"type":"ping"}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+			`{"type":"message_stop"}`,
+		}
+		for _, event := range events {
+			var typed struct{ Type string }
+			json.Unmarshal([]byte(event), &typed)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typed.Type, event)
+		}
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewAnthropicProvider("test-key", server.URL, "claude-test")
+	if err != nil {
+		t.Fatalf("NewAnthropicProvider: %v", err)
+	}
+	provider.SetDefaults(2048, 0.2)
+
+	stream, err := provider.Chat(context.Background(), []llm.ChatMessage{
+		{Role: llm.RoleSystem, Content: "Be brief."},
+		{Role: llm.RoleUser, Content: "Hi"},
+	}, llm.WithStop([]string{"END"}))
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	text, last := collect(t, stream)
+	if text != "Hello, world" {
+		t.Errorf("unexpected text %q", text)
+	}
+	if !last.Done || last.FinishReason != "end_turn" {
+		t.Errorf("unexpected final chunk: %+v", last)
+	}
+	if last.Usage.PromptTokens != 12 || last.Usage.CompletionTokens != 5 || last.Usage.TotalTokens != 17 {
+		t.Errorf("unexpected usage: %+v", last.Usage)
+	}
+
+	if request["system"] != "Be brief." {
+		t.Errorf("system prompt not sent separately: %v", request["system"])
+	}
+	if stop, ok := request["stop_sequences"].([]interface{}); !ok || len(stop) != 1 || stop[0] != "END" {
+		t.Errorf("stop sequences not sent: %v", request["stop_sequences"])
+	}
+	if request["max_tokens"] != 2048.0 || request["temperature"] != 0.2 {
+		t.Errorf("configured defaults not sent: max_tokens %v, temperature %v", request["max_tokens"], request["temperature"])
+	}
+}
+
+func TestOllamaProviderStream(t *testing.T) {
+	var request map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not found"}`)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"model":"llama3.1","message":{"role":"assistant","content":"Local"},"done":false}`)
+		fmt.Fprintln(w, `{"model":"llama3.1","message":{"role":"assistant","content":" answer"},"done":false}`)
+		fmt.Fprintln(w, `{"model":"llama3.1","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":20,"eval_count":2}`)
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOllamaProvider(server.URL, "llama3.1")
+	if err != nil {
+		t.Fatalf("NewOllamaProvider: %v", err)
+	}
+
+	stream, err := provider.Chat(context.Background(), []llm.ChatMessage{
+		{Role: llm.RoleSystem, Content: "Page context"},
+		{Role: llm.RoleUser, Content: "Question"},
+	}, llm.WithMaxTokens(64))
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	text, last := collect(t, stream)
+	if text != "Local answer" {
+		t.Errorf("unexpected text %q", text)
+	}
+	if !last.Done || last.FinishReason != "stop" || last.Usage.TotalTokens != 22 {
+		t.Errorf("unexpected final chunk: %+v", last)
+	}
+
+	messages, _ := request["messages"].([]interface{})
+	if len(messages) != 2 || request["stream"] != true {
+		t.Errorf("unexpected request: %v", request)
+	}
+	if options, _ := request["options"].(map[string]interface{}); options["num_predict"] != float64(64) {
+		t.Errorf("max tokens not sent as num_predict: %v", request["options"])
+	}
+}
+
+func TestOllamaProviderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":"model \"missing\" not found, try pulling it first"}`)
+	}))
+	defer server.Close()
+
+	provider, _ := llm.NewOllamaProvider(server.URL, "missing")
+	_, err := provider.Chat(context.Background(), []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}})
+
+	var ollamaErr *llm.OllamaError
+	if !errors.As(err, &ollamaErr) || ollamaErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected OllamaError with status 404, got %v", err)
+	}
+}
+
+func TestOpenAICompatibleProviderStream(t *testing.T) {
+	var request map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"From\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\" llama.cpp\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":9,\"completion_tokens\":3,\"total_tokens\":12}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{
+		Name:        "llamacpp",
+		BaseURL:     server.URL + "/v1",
+		Model:       "local-model",
+		StreamUsage: true,
+	})
+	if err != nil {
+		t.Fatalf("NewOpenAICompatibleProvider: %v", err)
+	}
+	if provider.GetProvider() != "llamacpp" {
+		t.Errorf("unexpected provider name %q", provider.GetProvider())
+	}
+
+	stream, err := provider.Chat(context.Background(), []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	text, last := collect(t, stream)
+	if text != "From llama.cpp" {
+		t.Errorf("unexpected text %q", text)
+	}
+	if !last.Done || last.FinishReason != "stop" {
+		t.Errorf("unexpected final chunk: %+v", last)
+	}
+	if last.Usage.PromptTokens != 9 || last.Usage.CompletionTokens != 3 || last.Usage.Estimated {
+		t.Errorf("reported usage not used: %+v", last.Usage)
+	}
+	if options, _ := request["stream_options"].(map[string]interface{}); options["include_usage"] != true {
+		t.Errorf("usage not requested: %v", request["stream_options"])
+	}
+
+	// Servers that reject stream_options do not get it, and usage is estimated
+	request = nil
+	plain, _ := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "llamacpp", BaseURL: server.URL + "/v1", Model: "local-model"})
+	stream, err = plain.Chat(context.Background(), []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	collect(t, stream)
+	if _, sent := request["stream_options"]; sent {
+		t.Errorf("stream_options sent without StreamUsage: %v", request["stream_options"])
+	}
+}
+
+func TestEstimateUsage(t *testing.T) {
+	if n := llm.EstimateTokens("Hello, world"); n != 3 {
+		t.Errorf("expected 3 tokens for Latin text, got %d", n)
+	}
+	if n := llm.EstimateTokens("这个页面讲什么"); n != 7 {
+		t.Errorf("expected one token per CJK character, got %d", n)
+	}
+
+	usage := llm.EstimateUsage([]llm.ChatMessage{{Role: llm.RoleUser, Content: "Hello, world"}}, "Hi")
+	if usage.PromptTokens != 7 || usage.CompletionTokens != 1 || usage.TotalTokens != 8 || !usage.Estimated {
+		t.Errorf("unexpected estimate: %+v", usage)
+	}
+}
+
+func TestLLMClientFallback(t *testing.T) {
+	var primaryCalls int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"message":"overloaded","type":"server_error"}}`)
+	}))
+	defer primary.Close()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Fallback answer"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`)
+	}))
+	defer local.Close()
+
+	openaiProvider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "openai", BaseURL: primary.URL, Model: "gpt-test"})
+	if err != nil {
+		t.Fatalf("NewOpenAICompatibleProvider: %v", err)
+	}
+	ollamaProvider, _ := llm.NewOllamaProvider(local.URL, "llama3.1")
+
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", openaiProvider)
+	client.RegisterProvider("ollama", ollamaProvider)
+	client.SetFallbacks("openai", []string{"ollama"})
+
+	stream, err := client.Chat(context.Background(), "openai", []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	text, last := collect(t, stream)
+	if text != "Fallback answer" || primaryCalls != 1 {
+		t.Errorf("unexpected text %q after %d primary calls", text, primaryCalls)
+	}
+	if last.Provider != "ollama" || last.Model != "llama3.1" {
+		t.Errorf("answering provider not recorded: %+v", last)
+	}
+
+	// Client errors are not retried elsewhere
+	if llm.IsRetryable(&llm.OllamaError{StatusCode: http.StatusBadRequest}) {
+		t.Errorf("400 should not trigger a fallback")
+	}
+}
+
+func TestLLMClientFallsBackAfterFirstTokenTimeout(t *testing.T) {
+	// The primary accepts the request and never answers
+	hung := make(chan struct{}, 1)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is read so the server notices the client going away
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+		hung <- struct{}{}
+	}))
+	defer primary.Close()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Fallback answer"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`)
+	}))
+	defer local.Close()
+
+	openaiProvider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "openai", BaseURL: primary.URL, Model: "gpt-test"})
+	if err != nil {
+		t.Fatalf("NewOpenAICompatibleProvider: %v", err)
+	}
+	ollamaProvider, _ := llm.NewOllamaProvider(local.URL, "llama3.1")
+
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", openaiProvider)
+	client.RegisterProvider("ollama", ollamaProvider)
+	client.SetFallbacks("openai", []string{"ollama"})
+	client.SetFirstTokenTimeout(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Chat(ctx, "openai", []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	text, last := collect(t, stream)
+	if text != "Fallback answer" || last.Provider != "ollama" {
+		t.Errorf("expected the fallback to answer, got %q from %q", text, last.Provider)
+	}
+	select {
+	case <-hung:
+	case <-time.After(time.Second):
+		t.Errorf("the request to the hung provider was not cancelled")
+	}
+}
+
+func TestResilientProviderRetryAndBreaker(t *testing.T) {
+	var calls int
+	failures := 1
+	retryAfter := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":"loading model"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Recovered"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`)
+	}))
+	defer server.Close()
+
+	ollamaProvider, _ := llm.NewOllamaProvider(server.URL, "llama3.1")
+	policy := llm.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	breaker := llm.NewCircuitBreaker(2, time.Minute)
+	provider := llm.NewResilientProvider(ollamaProvider, policy, breaker)
+	messages := []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}}
+
+	// A transient failure is retried transparently
+	stream, err := provider.Chat(context.Background(), messages)
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	if text, _ := collect(t, stream); text != "Recovered" || calls != 2 {
+		t.Errorf("unexpected text %q after %d calls", text, calls)
+	}
+	if breaker.State() != llm.BreakerClosed {
+		t.Errorf("breaker should be closed after a success, got %s", breaker.State())
+	}
+
+	// A Retry-After beyond the policy's maximum delay is not waited for
+	calls, failures, retryAfter = 0, 10, "120"
+	_, err = provider.Chat(context.Background(), messages)
+	var retryErr *llm.RetryAfterError
+	if !errors.As(err, &retryErr) || retryErr.RetryAfter != 2*time.Minute || calls != 1 {
+		t.Fatalf("expected a single attempt with Retry-After, got %v after %d calls", err, calls)
+	}
+
+	// Repeated failures open the circuit, which then rejects requests without calling the server
+	retryAfter = ""
+	_, err = provider.Chat(context.Background(), messages)
+	var circuitErr *llm.CircuitOpenError
+	if !errors.As(err, &circuitErr) || breaker.State() != llm.BreakerOpen {
+		t.Fatalf("expected open circuit, got %v (state %s)", err, breaker.State())
+	}
+	callsWhenOpened := calls
+	if _, err := provider.Chat(context.Background(), messages); !errors.As(err, &circuitErr) || calls != callsWhenOpened {
+		t.Errorf("open circuit should not reach the server, got %v", err)
+	}
+}
+
+func TestResilientProviderIgnoresCallerCancellation(t *testing.T) {
+	// The server never answers
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ollamaProvider, _ := llm.NewOllamaProvider(server.URL, "llama3.1")
+	policy := llm.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	breaker := llm.NewCircuitBreaker(2, 0)
+	provider := llm.NewResilientProvider(ollamaProvider, policy, breaker)
+	messages := []llm.ChatMessage{{Role: llm.RoleUser, Content: "Hi"}}
+
+	chat := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := provider.Chat(ctx, messages); err == nil {
+			t.Fatal("expected the cancelled request to fail")
+		}
+	}
+
+	// A cancelled request does not reset earlier failures
+	breaker.Failure()
+	chat()
+	if breaker.Failures() != 1 || breaker.State() != llm.BreakerClosed {
+		t.Errorf("cancellation changed the breaker: %d failures, %s", breaker.Failures(), breaker.State())
+	}
+
+	// A cancelled half-open trial neither closes the circuit nor blocks the next trial
+	breaker.Failure()
+	chat()
+	if breaker.State() != llm.BreakerHalfOpen || !breaker.Allow() {
+		t.Errorf("expected another trial to be allowed, state %s", breaker.State())
+	}
+}
+
+func TestLLMClientEmbedBatches(t *testing.T) {
+	var batches []int
+	var dimensions float64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Input      []string `json:"input"`
+			Model      string   `json:"model"`
+			Dimensions float64  `json:"dimensions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		batches = append(batches, len(req.Input))
+		dimensions = req.Dimensions
+
+		var data []map[string]interface{}
+		for i := range req.Input {
+			data = append(data, map[string]interface{}{"object": "embedding", "index": i, "embedding": []float32{float32(i), 1, 0}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   data,
+			"model":  req.Model,
+			"usage":  map[string]int{"prompt_tokens": 2 * len(req.Input), "total_tokens": 2 * len(req.Input)},
+		})
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{
+		Name:           "openai",
+		BaseURL:        server.URL + "/v1",
+		Model:          "gpt-4o-mini",
+		EmbeddingModel: "text-embedding-3-small",
+	})
+	if err != nil {
+		t.Fatalf("NewOpenAICompatibleProvider: %v", err)
+	}
+
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", provider)
+
+	texts := make([]string, 100)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("text %d", i)
+	}
+
+	embeddings, err := client.Embed(context.Background(), "", texts, llm.WithDimensions(3))
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if len(batches) != 2 || batches[0]+batches[1] != 100 || dimensions != 3 {
+		t.Errorf("unexpected batches %v with dimensions %v", batches, dimensions)
+	}
+	if len(embeddings.Vectors) != 100 || embeddings.Dimensions != 3 || embeddings.Model != "text-embedding-3-small" {
+		t.Errorf("unexpected embeddings: %d vectors of %d dimensions from %s", len(embeddings.Vectors), embeddings.Dimensions, embeddings.Model)
+	}
+	if embeddings.Vectors[70][0] != float32(70-batches[0]) {
+		t.Errorf("vectors out of order: %v", embeddings.Vectors[70])
+	}
+	if embeddings.Usage.PromptTokens != 200 || embeddings.Usage.Estimated {
+		t.Errorf("unexpected usage: %+v", embeddings.Usage)
+	}
+
+	anthropic, _ := llm.NewAnthropicProvider("key", server.URL, "claude-3-5-sonnet-latest")
+	client.RegisterProvider("anthropic", anthropic)
+	if _, err := client.Embed(context.Background(), "anthropic", texts); !errors.Is(err, llm.ErrEmbeddingsNotSupported) {
+		t.Errorf("expected ErrEmbeddingsNotSupported, got %v", err)
+	}
+}
+
+func TestLLMClientChatJSONReasks(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		// The first answer misses a required property, the second is fenced
+		content := `{"name":"Widget"}`
+		if len(requests) > 1 {
+			content = "```json\n{\"name\":\"Widget\",\"price\":9.5}\n```"
+		}
+		encoded, _ := json.Marshal(content)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintf(w, `{"message":{"role":"assistant","content":%s},"done":false}`+"\n", encoded)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":20,"eval_count":5}`)
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOllamaProvider(server.URL, "llama3.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("ollama", provider)
+
+	schema := json.RawMessage(`{"type":"object","required":["name","price"],"properties":{"name":{"type":"string"},"price":{"type":"number","minimum":0}}}`)
+	result, err := client.ChatJSON(context.Background(), "ollama", []llm.ChatMessage{
+		{Role: llm.RoleSystem, Content: "Page context"},
+		{Role: llm.RoleUser, Content: "Extract the product"},
+	}, llm.ResponseFormat{Name: "product", Schema: schema})
+	if err != nil {
+		t.Fatalf("ChatJSON: %v", err)
+	}
+
+	product, _ := result.Value.(map[string]interface{})
+	if product["price"] != 9.5 || result.Attempts != 2 || result.Usage.TotalTokens != 50 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if _, ok := requests[0]["format"].(map[string]interface{}); !ok {
+		t.Errorf("schema not sent as the format: %v", requests[0]["format"])
+	}
+	if messages, _ := requests[1]["messages"].([]interface{}); len(messages) != 4 {
+		t.Errorf("expected the invalid output and the problems to be sent back, got %d messages", len(messages))
+	}
+}
+
+func TestLLMClientChatJSONKeepsUsageOfFailedAttempts(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/event-stream")
+		if requests == 1 {
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"not json\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":30,\"completion_tokens\":5,\"total_tokens\":35}}\n\n")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		// The connection drops part way through the second answer
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"{\\\"name\\\":\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "openai", BaseURL: server.URL + "/v1", Model: "gpt-4o-mini", StreamUsage: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", provider)
+
+	result, err := client.ChatJSON(context.Background(), "openai", []llm.ChatMessage{{Role: llm.RoleUser, Content: "Extract the name"}},
+		llm.ResponseFormat{Schema: json.RawMessage(`{"type":"object"}`)})
+	if err == nil {
+		t.Fatalf("expected the dropped stream to fail")
+	}
+	if result == nil || result.Attempts != 2 || result.Usage.PromptTokens <= 30 || !result.Usage.Estimated {
+		t.Errorf("expected the usage of both attempts, got %+v", result)
+	}
+}
+
+func TestLLMClientChatJSONObjectModeOnlyForObjectSchemas(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		content := `{"name":"Widget"}`
+		if format, _ := request["response_format"].(map[string]interface{}); format == nil {
+			content = `[{"name":"Widget","price":9.5},{"name":"Gadget","price":12}]`
+		}
+		encoded, _ := json.Marshal(content)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%s}}]}\n\n", encoded)
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{
+		Name:     "deepseek",
+		BaseURL:  server.URL,
+		Model:    "deepseek-chat",
+		JSONMode: llm.JSONModeObject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("deepseek", provider)
+	messages := []llm.ChatMessage{{Role: llm.RoleUser, Content: "Extract the table"}}
+
+	// A table is a list of rows, which JSON object mode cannot produce
+	rows := json.RawMessage(`{"type":"array","items":{"type":"object","required":["name","price"],"properties":{"name":{"type":"string"},"price":{"type":"number"}}}}`)
+	result, err := client.ChatJSON(context.Background(), "deepseek", messages, llm.ResponseFormat{Name: "rows", Schema: rows})
+	if err != nil {
+		t.Fatalf("ChatJSON: %v", err)
+	}
+	if values, _ := result.Value.([]interface{}); len(values) != 2 || result.Attempts != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if format, exists := requests[0]["response_format"]; exists {
+		t.Errorf("expected no response_format for an array schema, got %v", format)
+	}
+
+	object := json.RawMessage(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`)
+	if _, err := client.ChatJSON(context.Background(), "deepseek", messages, llm.ResponseFormat{Name: "product", Schema: object}); err != nil {
+		t.Fatalf("ChatJSON: %v", err)
+	}
+	if format, _ := requests[1]["response_format"].(map[string]interface{}); format["type"] != "json_object" {
+		t.Errorf("expected json_object for an object schema, got %v", requests[1]["response_format"])
+	}
+}
+
+func TestLLMClientChatSendsImagesToVisionProviders(t *testing.T) {
+	var textCalls int
+	text := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		textCalls++
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Text answer"},"done":true}`)
+	}))
+	defer text.Close()
+
+	var request struct {
+		Messages []struct {
+			Images []string `json:"images"`
+		} `json:"messages"`
+	}
+	vision := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"A chart"},"done":true}`)
+	}))
+	defer vision.Close()
+
+	textProvider, _ := llm.NewOllamaProvider(text.URL, "llama3.1")
+	visionProvider, _ := llm.NewOllamaProvider(vision.URL, "llava")
+
+	client := llm.NewLLMClient()
+	client.RegisterProvider("local", textProvider)
+	client.RegisterProvider("llava", visionProvider)
+	client.SetFallbacks("local", []string{"llava"})
+	client.SetVision("llava", true)
+
+	if client.SupportsVision("local") || !client.SupportsVision("llava") {
+		t.Errorf("unexpected vision support")
+	}
+
+	// Only the fallback that accepts images is asked
+	image := llm.Image{MediaType: "image/png", Data: []byte("\x89PNG")}
+	stream, err := client.Chat(context.Background(), "local", []llm.ChatMessage{{Role: llm.RoleUser, Content: "What is this?", Images: []llm.Image{image}}})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	answer, last := collect(t, stream)
+	if answer != "A chart" || last.Provider != "llava" || textCalls != 0 {
+		t.Errorf("unexpected answer %q from %s after %d text model calls", answer, last.Provider, textCalls)
+	}
+	if len(request.Messages) != 1 || len(request.Messages[0].Images) != 1 || request.Messages[0].Images[0] != "iVBORw==" {
+		t.Errorf("image not sent: %+v", request.Messages)
+	}
+
+	client.SetFallbacks("local", nil)
+	_, err = client.Chat(context.Background(), "local", []llm.ChatMessage{{Role: llm.RoleUser, Content: "What is this?", Images: []llm.Image{image}}})
+	var unsupported *llm.VisionNotSupportedError
+	if !errors.As(err, &unsupported) || unsupported.ProviderName != "local" {
+		t.Errorf("expected a vision error, got %v", err)
+	}
+}
+
+func TestOpenAICompatibleProviderStreamsReasoning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"reasoning_content\":\"The page says\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"reasoning_content\":\" 42.\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"42\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "deepseek", BaseURL: server.URL, Model: "deepseek-reasoner"})
+	if err != nil {
+		t.Fatalf("NewOpenAICompatibleProvider: %v", err)
+	}
+	stream, err := provider.Chat(context.Background(), []llm.ChatMessage{{Role: llm.RoleUser, Content: "What is the answer?"}})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	var reasoning strings.Builder
+	for chunk := range stream {
+		reasoning.WriteString(chunk.Reasoning)
+		if chunk.Reasoning != "" && chunk.Content != "" {
+			t.Errorf("reasoning and answer mixed in one chunk: %+v", chunk)
+		}
+	}
+	if reasoning.String() != "The page says 42." {
+		t.Errorf("unexpected reasoning %q", reasoning.String())
+	}
+
+	// The answer alone is the content
+	stream, _ = provider.Chat(context.Background(), []llm.ChatMessage{{Role: llm.RoleUser, Content: "What is the answer?"}})
+	if text, last := collect(t, stream); text != "42" || last.Usage.CompletionTokens == 0 {
+		t.Errorf("unexpected answer %q, usage %+v", text, last.Usage)
+	}
+}
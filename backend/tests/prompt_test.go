@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/prompt"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+func TestBuildFitsContextWindow(t *testing.T) {
+	var paragraphs []string
+	for i := 0; i < 200; i++ {
+		paragraphs = append(paragraphs, fmt.Sprintf("Paragraph %d talks about gardening and the weather in general terms, nothing more.", i))
+	}
+	paragraphs[150] = "The warranty covers battery replacement for three years after purchase."
+	page := prompt.Page{Title: "Manual", URL: "https://example.com/manual", Text: strings.Join(paragraphs, "\n\n")}
+
+	var history []llm.ChatMessage
+	for i := 0; i < 40; i++ {
+		history = append(history,
+			llm.ChatMessage{Role: llm.RoleUser, Content: fmt.Sprintf("Question number %d about the manual?", i)},
+			llm.ChatMessage{Role: llm.RoleAssistant, Content: strings.Repeat("A long answer. ", 30)},
+		)
+	}
+
+	req := prompt.Request{
+		Instructions: "Answer questions about the page.",
+		Page:         page,
+		History:      history,
+		Question:     "How long does the warranty cover the battery?",
+		Budget:       prompt.Budget{ContextWindow: 2048, AnswerTokens: 256},
+	}
+	messages, _ := prompt.Build(req)
+
+	if usage := llm.EstimateUsage(messages, ""); usage.PromptTokens > 2048-256 {
+		t.Fatalf("prompt of %d tokens does not leave room for the answer", usage.PromptTokens)
+	}
+
+	system := messages[0].Content
+	if !strings.Contains(system, "The warranty covers battery replacement") {
+		t.Errorf("the section relevant to the question was trimmed away")
+	}
+	if !strings.Contains(system, "Paragraph 0 ") || !strings.Contains(system, "[...]") {
+		t.Errorf("expected the start of the page and an omission marker")
+	}
+	if strings.Contains(system, "Paragraph 100 ") {
+		t.Errorf("irrelevant page content should have been dropped")
+	}
+	if !strings.Contains(system, "Earlier in this conversation") {
+		t.Errorf("expected dropped turns to be summarized")
+	}
+
+	if messages[1].Role != llm.RoleUser || len(messages) >= len(history)+2 {
+		t.Errorf("expected only the most recent turns, starting with a user turn")
+	}
+	if last := messages[len(messages)-1]; last.Content != req.Question || messages[len(messages)-2].Content != history[len(history)-1].Content {
+		t.Errorf("expected the latest turn followed by the question")
+	}
+
+	req.Budget.ContextWindow = 200000
+	if messages, _ := prompt.Build(req); len(messages) != len(history)+2 || !strings.Contains(messages[0].Content, "Paragraph 100 ") {
+		t.Errorf("everything should be sent when it fits")
+	}
+}
+
+func TestCitationsResolveToPassages(t *testing.T) {
+	text := "  Setup\n\nPair the device with a phone.\n\n" + strings.Repeat("Filler text about nothing in particular. ", 60) +
+		"\n\nThe warranty covers battery replacement for three years."
+
+	messages, passages := prompt.Build(prompt.Request{
+		Page:     prompt.Page{Title: "Manual", Text: text},
+		Question: "What does the warranty cover?",
+	})
+	if len(passages) < 2 || !strings.Contains(messages[0].Content, "[1] Setup") {
+		t.Fatalf("expected numbered passages, got %d", len(passages))
+	}
+	for _, passage := range passages {
+		if !strings.HasPrefix(passage.Text, text[passage.Start:passage.Start+10]) {
+			t.Errorf("passage %d offsets do not point at its text", passage.Number)
+		}
+	}
+
+	last := passages[len(passages)-1]
+	answer := fmt.Sprintf("Three years [%d]. Pair it first [1, %d] [99].", last.Number, last.Number)
+	citations := prompt.Citations(answer, passages)
+	if len(citations) != 2 || citations[0].Number != last.Number || citations[1].Number != 1 {
+		t.Fatalf("expected the last passage then the first, got %+v", citations)
+	}
+	if !strings.HasSuffix(text[citations[0].Start:citations[0].End], "The warranty covers battery replacement for three years.") {
+		t.Errorf("unexpected citation offsets %d-%d", citations[0].Start, citations[0].End)
+	}
+}
+
+func TestCitationOffsetsCountCharacters(t *testing.T) {
+	text := "说明书\n\n" + strings.Repeat("这是一段关于设备的说明文字。", 40) + "\n\n保修期为三年，包括更换电池。"
+	runes := []rune(text)
+
+	_, passages := prompt.Build(prompt.Request{
+		Page:     prompt.Page{Title: "Manual", Text: text},
+		Question: "保修期多长？",
+	})
+	if len(passages) < 2 {
+		t.Fatalf("expected several passages, got %d", len(passages))
+	}
+	for _, passage := range passages {
+		if string(runes[passage.Start:passage.End]) != passage.Text {
+			t.Errorf("passage %d offsets %d-%d do not count characters", passage.Number, passage.Start, passage.End)
+		}
+	}
+
+	// Excerpts of retrieved chunks are labelled with character offsets too
+	excerpt := "保修期为三年，包括更换电池。"
+	_, passages = prompt.Build(prompt.Request{
+		Page: prompt.Page{Excerpts: []prompt.Excerpt{{
+			Offset: retrieval.CharOffset(text, strings.Index(text, excerpt)),
+			Text:   excerpt,
+		}}},
+		Question: "保修期多长？",
+	})
+	citations := prompt.Citations("三年 [1]", passages)
+	if len(citations) != 1 || string(runes[citations[0].Start:citations[0].End]) != excerpt {
+		t.Fatalf("unexpected citations %+v", citations)
+	}
+}
@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jzhang405/SmartChrome/backend/config"
+	"github.com/jzhang405/SmartChrome/backend/internal/handlers"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/retrieval"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+	"github.com/jzhang405/SmartChrome/backend/pkg/vector"
+)
+
+func TestChunkOverlap(t *testing.T) {
+	var sentences []string
+	for i := 0; i < 100; i++ {
+		sentences = append(sentences, fmt.Sprintf("Sentence number %d of the page.", i))
+	}
+	text := strings.Join(sentences, " ")
+
+	chunks := retrieval.Chunk(text, 50, 10)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if text[chunk.Start:chunk.End] != chunk.Text {
+			t.Fatalf("chunk %d offsets do not match its text", i)
+		}
+		if i > 0 && chunk.Start >= chunks[i-1].End {
+			t.Errorf("chunk %d does not overlap the previous one", i)
+		}
+	}
+	if last := chunks[len(chunks)-1]; last.End != len(text) {
+		t.Errorf("the end of the text is not covered")
+	}
+}
+
+// newTopicEmbedder returns a client whose Ollama provider embeds texts
+// about warranties and everything else along different dimensions, and the
+// number of embedding requests it received
+func newTopicEmbedder(t *testing.T) (*llm.LLMClient, *int) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var req struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		// One dimension per topic is enough to tell the chunks apart
+		var embeddings [][]float32
+		for _, input := range req.Input {
+			if strings.Contains(strings.ToLower(input), "warranty") {
+				embeddings = append(embeddings, []float32{1, 0.1})
+			} else {
+				embeddings = append(embeddings, []float32{0.1, 1})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"model": req.Model, "embeddings": embeddings})
+	}))
+	t.Cleanup(server.Close)
+
+	provider, err := llm.NewOllamaProvider(server.URL, "llama3.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.SetEmbeddingModel("nomic-embed-text")
+	client := llm.NewLLMClient()
+	client.RegisterProvider("ollama", provider)
+	return client, &requests
+}
+
+func TestRetrieverTopChunks(t *testing.T) {
+	client, requests := newTopicEmbedder(t)
+
+	var paragraphs []string
+	for i := 0; i < 60; i++ {
+		paragraphs = append(paragraphs, fmt.Sprintf("Section %d explains how to set up the device and pair it with a phone.", i))
+	}
+	paragraphs[42] = "The warranty covers battery replacement for three years."
+	page := models.NewWebpageContent("https://example.com/manual", "Manual", strings.Join(paragraphs, "\n\n"))
+
+	retriever := retrieval.NewRetriever(client, storage.NewMemoryStore(), vector.NewFlatIndex(), config.RetrievalConfig{
+		EmbeddingProvider: "ollama",
+		MinPageTokens:     100,
+		ChunkTokens:       40,
+		ChunkOverlap:      10,
+		TopK:              2,
+	})
+
+	for attempt := 0; attempt < 2; attempt++ {
+		chunks, err := retriever.Retrieve(context.Background(), nil, page, "What does the warranty cover?")
+		if err != nil {
+			t.Fatalf("retrieve failed: %v", err)
+		}
+		if len(chunks) != 2 || !strings.Contains(chunks[0].Text, "The warranty covers battery replacement") {
+			t.Fatalf("expected the warranty chunk first, got %+v", chunks)
+		}
+	}
+
+	// The page is embedded once, later questions only embed themselves
+	if *requests != 3 {
+		t.Errorf("expected 3 embedding requests, got %d", *requests)
+	}
+}
+
+func TestRetrieverSearchesSavedPages(t *testing.T) {
+	client, _ := newTopicEmbedder(t)
+	retriever := retrieval.NewRetriever(client, storage.NewMemoryStore(), vector.NewFlatIndex(), config.RetrievalConfig{
+		EmbeddingProvider: "ollama",
+		ChunkTokens:       40,
+		ChunkOverlap:      10,
+		KnowledgeTopK:     1,
+	})
+	ctx := context.Background()
+
+	pages := []*models.WebpageContent{
+		models.NewWebpageContent("https://example.com/setup", "Setup", "Pair the device with a phone over Bluetooth."),
+		models.NewWebpageContent("https://example.com/warranty", "Warranty", "The warranty covers battery replacement for three years."),
+	}
+	for _, page := range pages {
+		if _, err := retriever.SavePage(ctx, nil, "session:a", page); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	matches, err := retriever.Search(ctx, nil, "session:a", "What does the warranty cover?", retrieval.SearchOptions{})
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	if len(matches) != 1 || matches[0].URL != "https://example.com/warranty" {
+		t.Fatalf("expected the warranty page, got %+v", matches)
+	}
+
+	// Other owners do not see the pages
+	if matches, _ := retriever.Search(ctx, nil, "session:b", "warranty", retrieval.SearchOptions{}); len(matches) != 0 {
+		t.Errorf("expected no matches for another owner, got %d", len(matches))
+	}
+
+	saved, err := retriever.ListPages(ctx, "session:a")
+	if err != nil || len(saved) != 2 {
+		t.Fatalf("expected 2 saved pages, got %d (%v)", len(saved), err)
+	}
+	if err := retriever.DeletePage(ctx, "session:a", saved[0].ID); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := retriever.DeletePage(ctx, "session:a", saved[0].ID); !errors.Is(err, vector.ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+func TestSessionPagesAreDeletedWithTheSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client, _ := newTopicEmbedder(t)
+	store := storage.NewMemoryStore()
+	index := vector.NewFlatIndex()
+	retriever := retrieval.NewRetriever(client, store, index, config.RetrievalConfig{EmbeddingProvider: "ollama"})
+	h := handlers.NewHandlers(store, nil, client, config.QuotaConfig{}, config.AttachmentConfig{}, retriever, nil)
+	ctx := context.Background()
+
+	page := models.NewWebpageContent("https://example.com/setup", "Setup", "Pair the device with a phone over Bluetooth.")
+	for _, owner := range []string{"session:session-1", "session:session-2"} {
+		if _, err := retriever.SavePage(ctx, nil, owner, page); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.DELETE("/sessions/:sessionId", h.DeleteSession)
+	deleteSession := func(id string) int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/sessions/"+id, nil))
+		return recorder.Code
+	}
+
+	if code := deleteSession("session-2"); code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting another session, got %d", code)
+	}
+	if code := deleteSession("session-1"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if pages, _ := retriever.ListPages(ctx, "session:session-1"); len(pages) != 0 {
+		t.Errorf("expected the session's pages to be deleted, got %+v", pages)
+	}
+	if pages, _ := retriever.ListPages(ctx, "session:session-2"); len(pages) != 1 {
+		t.Errorf("expected the other session's page to be kept, got %+v", pages)
+	}
+
+	// Pages saved longer ago than a token lasts can no longer be reached
+	expired := vector.Entry{Owner: "session:session-3", PageID: "expired", SavedAt: time.Now().Add(-middleware.TokenLifetime - time.Minute),
+		Model: "m", Text: "expired", Vector: []float32{1, 0}}
+	if err := index.SavePage(ctx, []vector.Entry{expired}); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := h.PurgeExpiredKnowledge(ctx)
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 expired page to be purged, got %d (%v)", removed, err)
+	}
+	if pages, _ := retriever.ListPages(ctx, "session:session-2"); len(pages) != 1 {
+		t.Errorf("expected the live page to be kept, got %+v", pages)
+	}
+}
+
+func TestKnowledgeSearchCountsAgainstQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client, _ := newTopicEmbedder(t)
+	store := storage.NewMemoryStore()
+	retriever := retrieval.NewRetriever(client, store, vector.NewFlatIndex(), config.RetrievalConfig{
+		EmbeddingProvider: "ollama",
+		KnowledgeTopK:     1,
+	})
+	h := handlers.NewHandlers(store, nil, client, config.QuotaConfig{SessionDailyTokens: 10},
+		config.AttachmentConfig{}, retriever, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware(), func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.POST("/knowledge/search", h.SearchKnowledge)
+	search := func() int {
+		recorder := httptest.NewRecorder()
+		body := strings.NewReader(`{"query":"What does the warranty cover for the battery of the device?"}`)
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/knowledge/search", body))
+		return recorder.Code
+	}
+
+	if code := search(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	totals, err := store.GetUsage(context.Background(), storage.UsageScopeSession, "session-1", storage.UsagePeriodDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals.TotalTokens == 0 || totals.Requests != 1 {
+		t.Fatalf("expected the query embedding to be recorded, got %+v", totals)
+	}
+
+	// The embedded query used up the session's budget
+	if code := search(); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over quota, got %d", code)
+	}
+}
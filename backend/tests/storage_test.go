@@ -0,0 +1,323 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+// stores returns a fresh instance of every backend that runs without
+// external services
+func stores(t *testing.T) map[string]storage.Store {
+	t.Helper()
+
+	sqliteStore, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "chromllm.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+
+	return map[string]storage.Store{
+		"memory": storage.NewMemoryStore(),
+		"sqlite": sqliteStore,
+	}
+}
+
+func TestStoreAppendMessage(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testAppendMessage(t, store)
+		})
+	}
+}
+
+// TestRedisStoreAppendMessage needs a Redis server at TEST_REDIS_ADDR
+func TestRedisStoreAppendMessage(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client, err := cache.NewRedisClient(addr, "", 0)
+	if err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	defer client.Close()
+
+	testAppendMessage(t, storage.NewRedisStore(client))
+}
+
+func TestStorePagination(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testPagination(t, store)
+		})
+	}
+}
+
+func TestStoreNotFound(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testNotFound(t, store)
+		})
+	}
+}
+
+func TestStoreUsage(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testUsage(t, store)
+		})
+	}
+}
+
+func TestStorePageChunks(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			testPageChunks(t, store)
+		})
+	}
+}
+
+func testAppendMessage(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	conversation := models.NewConversation("session", "https://example.com", "Example")
+	if err := store.StoreConversation(ctx, conversation); err != nil {
+		t.Fatalf("StoreConversation: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			message := models.NewMessage(conversation.ID, models.UserQuestion, "question", 0)
+			if err := store.AppendMessage(ctx, message); err != nil {
+				t.Errorf("AppendMessage: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages, err := store.GetConversationMessages(ctx, conversation.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if len(messages) != 10 {
+		t.Fatalf("expected 10 messages, got %d", len(messages))
+	}
+	for i, message := range messages {
+		if message.SequenceNumber != i+1 {
+			t.Errorf("message %d has sequence number %d", i, message.SequenceNumber)
+		}
+	}
+
+	stored, err := store.GetConversation(ctx, conversation.ID)
+	if err != nil {
+		t.Fatalf("GetConversation: %v", err)
+	}
+	if stored.MessageCount != 10 {
+		t.Errorf("expected message count 10, got %d", stored.MessageCount)
+	}
+}
+
+func testPagination(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	conversation := models.NewConversation("session", "https://example.com", "Example")
+	if err := store.StoreConversation(ctx, conversation); err != nil {
+		t.Fatalf("StoreConversation: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		message := models.NewMessage(conversation.ID, models.UserQuestion, "question", 0)
+		if err := store.AppendMessage(ctx, message); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+
+	page, err := store.GetConversationMessages(ctx, conversation.ID, 2, 1)
+	if err != nil {
+		t.Fatalf("GetConversationMessages: %v", err)
+	}
+	if len(page) != 2 || page[0].SequenceNumber != 2 || page[1].SequenceNumber != 3 {
+		t.Errorf("unexpected offset page: %+v", page)
+	}
+
+	after, err := store.GetConversationMessagesAfter(ctx, conversation.ID, 3, 10)
+	if err != nil {
+		t.Fatalf("GetConversationMessagesAfter: %v", err)
+	}
+	if len(after) != 2 || after[0].SequenceNumber != 4 {
+		t.Errorf("unexpected cursor page: %+v", after)
+	}
+}
+
+func testNotFound(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	if _, err := store.GetSession(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for session, got %v", err)
+	}
+
+	message := models.NewMessage("missing", models.UserQuestion, "question", 0)
+	if err := store.AppendMessage(ctx, message); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for unknown conversation, got %v", err)
+	}
+}
+
+func testUsage(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	records := []*models.UsageRecord{
+		models.NewUsageRecord("session", "user", "conversation", "m1", "openai", "gpt-4o", 1000, 500, 0.0075),
+		models.NewUsageRecord("session", "", "conversation", "m2", "ollama", "llama3.1", 200, 100, 0),
+		models.NewUsageRecord("other", "user", "conversation", "m3", "openai", "gpt-4o", 10, 10, 0.000125),
+	}
+	for _, record := range records {
+		if err := store.RecordUsage(ctx, record); err != nil {
+			t.Fatalf("RecordUsage: %v", err)
+		}
+	}
+
+	session, err := store.GetUsage(ctx, storage.UsageScopeSession, "session", storage.UsagePeriodDay)
+	if err != nil {
+		t.Fatalf("GetUsage: %v", err)
+	}
+	if session.Requests != 2 || session.PromptTokens != 1200 || session.TotalTokens != 1800 || session.Cost != 0.0075 {
+		t.Errorf("unexpected session usage: %+v", session)
+	}
+
+	user, err := store.GetUsage(ctx, storage.UsageScopeUser, "user", storage.UsagePeriodMonth)
+	if err != nil {
+		t.Fatalf("GetUsage: %v", err)
+	}
+	if user.Requests != 2 || user.TotalTokens != 1520 {
+		t.Errorf("unexpected user usage: %+v", user)
+	}
+
+	if none, err := store.GetUsage(ctx, storage.UsageScopeSession, "missing", storage.UsagePeriodDay); err != nil || none.Requests != 0 {
+		t.Errorf("expected no usage for unknown session, got %+v, %v", none, err)
+	}
+}
+
+func testPageChunks(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	if _, err := store.GetPageChunks(ctx, "hash", "model"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before embedding, got %v", err)
+	}
+
+	chunks := []*models.PageChunk{
+		{ContentHash: "hash", Index: 0, Start: 0, End: 5, Text: "first", Embedding: []float32{0.5, -1}},
+		{ContentHash: "hash", Index: 1, Start: 3, End: 9, Text: "second", Embedding: []float32{1, 0.25}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.StorePageChunks(ctx, "hash", "model", chunks); err != nil {
+			t.Fatalf("StorePageChunks: %v", err)
+		}
+	}
+
+	stored, err := store.GetPageChunks(ctx, "hash", "model")
+	if err != nil {
+		t.Fatalf("GetPageChunks: %v", err)
+	}
+	if len(stored) != 2 || stored[1].Text != "second" || stored[1].Start != 3 || stored[1].Embedding[1] != 0.25 {
+		t.Errorf("unexpected chunks: %+v", stored)
+	}
+
+	if _, err := store.GetPageChunks(ctx, "hash", "other-model"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("chunks of another embedding model should not be returned, got %v", err)
+	}
+}
+
+func TestSQLiteStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "chromllm.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	session := models.NewUserSession("user")
+	session.SetPreference("language", "en")
+	if err := store.StoreSession(ctx, session); err != nil {
+		t.Fatalf("StoreSession: %v", err)
+	}
+
+	loaded, err := store.GetSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if loaded.UserID != "user" || loaded.Preferences["language"] != "en" || !loaded.CreatedAt.Equal(session.CreatedAt) {
+		t.Errorf("unexpected session: %+v", loaded)
+	}
+
+	conversation := models.NewConversation(session.ID, "https://example.com", "Example")
+	if err := store.StoreConversation(ctx, conversation); err != nil {
+		t.Fatalf("StoreConversation: %v", err)
+	}
+
+	webpage := models.NewWebpageContent("https://example.com", "Example", "Page text")
+	if err := store.StoreWebpageContent(ctx, conversation.ID, webpage); err != nil {
+		t.Fatalf("StoreWebpageContent: %v", err)
+	}
+
+	loadedPage, err := store.GetWebpageContent(ctx, conversation.ID)
+	if err != nil {
+		t.Fatalf("GetWebpageContent: %v", err)
+	}
+	if loadedPage.ContentHash != webpage.ContentHash || loadedPage.ExtractedText != "Page text" {
+		t.Errorf("unexpected webpage content: %+v", loadedPage)
+	}
+
+	attachment := models.NewAttachment(conversation.ID, "image/png", []byte("\x89PNG\r\n\x1a\n"))
+	if err := store.StoreAttachment(ctx, attachment); err != nil {
+		t.Fatalf("StoreAttachment: %v", err)
+	}
+	loadedAttachment, err := store.GetAttachment(ctx, attachment.ID)
+	if err != nil {
+		t.Fatalf("GetAttachment: %v", err)
+	}
+	if loadedAttachment.ConversationID != conversation.ID || loadedAttachment.Size != 8 || string(loadedAttachment.Data) != string(attachment.Data) {
+		t.Errorf("unexpected attachment: %+v", loadedAttachment)
+	}
+
+	if n, err := store.PurgeExpired(ctx); err != nil || n != 0 {
+		t.Errorf("PurgeExpired removed %d rows, err %v", n, err)
+	}
+}
+
+func TestMemoryStorePurgeKeepsLiveEntries(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	defer store.Close()
+
+	session := models.NewUserSession("user")
+	if err := store.StoreSession(ctx, session); err != nil {
+		t.Fatalf("StoreSession: %v", err)
+	}
+	conversation := models.NewConversation(session.ID, "https://example.com", "Example")
+	if err := store.StoreConversation(ctx, conversation); err != nil {
+		t.Fatalf("StoreConversation: %v", err)
+	}
+	if err := store.AppendMessage(ctx, models.NewMessage(conversation.ID, models.UserQuestion, "question", 0)); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+
+	if n, err := store.PurgeExpired(ctx); err != nil || n != 0 {
+		t.Errorf("PurgeExpired removed %d entries, err %v", n, err)
+	}
+	if _, err := store.GetSession(ctx, session.ID); err != nil {
+		t.Errorf("GetSession after purge: %v", err)
+	}
+	if count, err := store.CountConversationMessages(ctx, conversation.ID); err != nil || count != 1 {
+		t.Errorf("expected the message to be kept, got %d (%v)", count, err)
+	}
+}
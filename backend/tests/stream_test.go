@@ -0,0 +1,309 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/jzhang405/SmartChrome/backend/config"
+	"github.com/jzhang405/SmartChrome/backend/internal/handlers"
+	"github.com/jzhang405/SmartChrome/backend/internal/middleware"
+	"github.com/jzhang405/SmartChrome/backend/internal/models"
+	"github.com/jzhang405/SmartChrome/backend/internal/websocket"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+)
+
+func TestSSEStreamResumes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manager := websocket.NewStreamManager()
+	router := gin.New()
+	router.GET("/v1/stream/events", manager.HandleSSE)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// Events sent before the client connects are kept for it
+	ctx := context.Background()
+	manager.SendThinking(ctx, "conv", "msg", "Reading the page")
+	manager.SendStreamResponse(ctx, "conv", "msg", "Hello", false)
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/stream/events?conversationId=conv&messageId=msg", nil)
+	request.Header.Set("Last-Event-ID", "1")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", response.Header.Get("Content-Type"))
+	}
+
+	manager.SendStreamResponse(ctx, "conv", "msg", " world", false)
+	manager.SendStreamResponse(ctx, "conv", "msg", "", true)
+
+	var ids []string
+	var content strings.Builder
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, id)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var message websocket.StreamMessage
+			if err := json.Unmarshal([]byte(data), &message); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+			content.WriteString(message.Content)
+		}
+	}
+
+	if strings.Join(ids, ",") != "2,3,4" || content.String() != "Hello world" {
+		t.Errorf("unexpected events %v with content %q", ids, content.String())
+	}
+
+	// A finished stream that was fully delivered tells the client to stop
+	request.Header.Set("Last-Event-ID", "4")
+	again, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	again.Body.Close()
+	if again.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 after the last event, got %d", again.StatusCode)
+	}
+}
+
+func TestSSEStreamDeliversFinalEventPastTheCap(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manager := websocket.NewStreamManager()
+	router := gin.New()
+	router.GET("/v1/stream/events", manager.HandleSSE)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// A long answer streamed one token at a time outgrows the buffer
+	ctx := context.Background()
+	const chunks = 10050
+	for i := 0; i < chunks; i++ {
+		manager.SendStreamResponse(ctx, "conv", "msg", "token ", false)
+	}
+	manager.SendStreamResponse(ctx, "conv", "msg", "", true)
+
+	response, err := http.Get(server.URL + "/v1/stream/events?conversationId=conv&messageId=msg")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer response.Body.Close()
+
+	var events int
+	var last websocket.StreamMessage
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events++
+			if err := json.Unmarshal([]byte(data), &last); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+		}
+	}
+
+	complete, _ := last.Data.(map[string]interface{})["is_complete"].(bool)
+	if !complete || last.ID != chunks+1 {
+		t.Fatalf("expected the final event %d, got %+v", chunks+1, last)
+	}
+	if events != 10000 {
+		t.Errorf("expected the last 10000 events to be kept, got %d", events)
+	}
+}
+
+func TestStreamEventsRequireOwnedOpenStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStore()
+	conversation := models.NewConversation("session-1", "https://example.com", "Example")
+	other := models.NewConversation("session-2", "https://example.org", "Other")
+	for _, c := range []*models.Conversation{conversation, other} {
+		if err := store.StoreConversation(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := handlers.NewHandlers(store, nil, llm.NewLLMClient(), config.QuotaConfig{}, config.AttachmentConfig{}, nil, nil)
+
+	router := gin.New()
+	router.Use(middleware.ErrorMiddleware())
+	router.Use(func(c *gin.Context) { c.Set("session_id", "session-1") })
+	router.GET("/v1/stream/events", h.StreamEventsHandler)
+	router.POST("/v1/conversations/:conversationId/messages", h.SendMessage)
+
+	requests := []struct {
+		name  string
+		query string
+	}{
+		{"conversation of another session", "conversationId=" + other.ID + "&messageId=msg"},
+		{"stream never opened", "conversationId=" + conversation.ID + "&messageId=msg"},
+	}
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/stream/events?"+request.query, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d %s", request.name, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// The stream of a question is open as soon as the question is stored
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/conversations/"+conversation.ID+"/messages",
+		strings.NewReader(`{"content":"What is this page about?","type":"user_question"}`)))
+	var question models.Message
+	if err := json.Unmarshal(recorder.Body.Bytes(), &question); err != nil || question.ID == "" {
+		t.Fatalf("unexpected question %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/stream/events?conversationId="+conversation.ID+"&messageId="+question.ID, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected the stream of the question, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// sessionHandler answers questions of the conversation "conv" only
+type sessionHandler struct {
+	manager   *websocket.StreamManager
+	cancelled chan string
+}
+
+func (h *sessionHandler) AuthorizeConversation(ctx context.Context, sessionID, conversationID string) error {
+	if sessionID != "session" || conversationID != "conv" {
+		return middleware.NewAppError(http.StatusNotFound, "NOT_FOUND", "Conversation not found")
+	}
+	return nil
+}
+
+func (h *sessionHandler) AskQuestion(ctx context.Context, sessionID, userID, conversationID string, request json.RawMessage) (*models.Message, error) {
+	var body struct {
+		Content string `json:"content"`
+	}
+	json.Unmarshal(request, &body)
+	message := models.NewMessage(conversationID, models.UserQuestion, body.Content, 1)
+	// The answer starts before the ack is written
+	h.manager.SendStreamResponse(ctx, conversationID, message.ID, "Hello", false)
+	return message, nil
+}
+
+func (h *sessionHandler) CancelGeneration(sessionID, messageID string) error {
+	h.cancelled <- messageID
+	h.manager.SendCancelled(context.Background(), "conv", messageID)
+	return nil
+}
+
+func TestSessionSocketProtocol(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manager := websocket.NewStreamManager()
+	handler := &sessionHandler{manager: manager, cancelled: make(chan string, 1)}
+	router := gin.New()
+	router.GET("/v1/ws", func(c *gin.Context) {
+		c.Set("session_id", "session")
+		manager.HandleSession(c, handler, 0)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// A stream that finished before subscribing is not replayed
+	manager.SendStreamResponse(context.Background(), "conv", "old", "", true)
+
+	conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() websocket.ServerFrame {
+		t.Helper()
+		var frame websocket.ServerFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		return frame
+	}
+
+	conn.WriteJSON(websocket.ClientFrame{Type: websocket.FrameSubscribe, ID: "1", ConversationID: "other"})
+	if frame := read(); frame.Type != websocket.FrameError || frame.ID != "1" || frame.Code != "NOT_FOUND" {
+		t.Errorf("expected subscribing to another session's conversation to fail, got %+v", frame)
+	}
+
+	conn.WriteJSON(websocket.ClientFrame{Type: websocket.FrameAsk, ID: "2", ConversationID: "conv",
+		Message: json.RawMessage(`{"content":"Hi"}`)})
+	ack := read()
+	if ack.Type != websocket.FrameAck || ack.ID != "2" || ack.MessageID == "" {
+		t.Fatalf("expected an ack with the question ID, got %+v", ack)
+	}
+	if frame := read(); frame.Type != websocket.FrameStream || frame.MessageID != ack.MessageID || frame.Content != "Hello" || frame.EventID != 1 {
+		t.Errorf("unexpected stream frame %+v", frame)
+	}
+
+	conn.WriteJSON(websocket.ClientFrame{Type: websocket.FrameCancel, ID: "3", MessageID: ack.MessageID})
+	if cancelled := <-handler.cancelled; cancelled != ack.MessageID {
+		t.Errorf("cancelled %q", cancelled)
+	}
+	// The ack and the end of the stream may arrive in either order
+	var types []string
+	for i := 0; i < 2; i++ {
+		types = append(types, read().Type)
+	}
+	if !(types[0] == websocket.FrameAck && types[1] == websocket.FrameComplete) && !(types[0] == websocket.FrameComplete && types[1] == websocket.FrameAck) {
+		t.Errorf("expected an ack and a complete frame, got %v", types)
+	}
+
+	conn.WriteJSON(websocket.ClientFrame{Type: websocket.FramePing, ID: "4"})
+	if frame := read(); frame.Type != websocket.FramePong || frame.ID != "4" {
+		t.Errorf("expected pong, got %+v", frame)
+	}
+}
+
+func TestSessionSocketChecksOrigin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manager := websocket.NewStreamManager()
+	manager.SetAllowedOrigins([]string{"chrome-extension://extension-id"})
+	handler := &sessionHandler{manager: manager, cancelled: make(chan string, 1)}
+	router := gin.New()
+	router.GET("/v1/ws", func(c *gin.Context) {
+		c.Set("session_id", "session")
+		manager.HandleSession(c, handler, 0)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	origins := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{server.URL, true},
+		{"chrome-extension://extension-id", true},
+		{"https://evil.example", false},
+		{"chrome-extension://other-id", false},
+	}
+	for _, test := range origins {
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Origin", test.origin)
+		}
+		conn, response, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws", header)
+		if conn != nil {
+			conn.Close()
+		}
+		if test.allowed && err != nil {
+			t.Errorf("origin %q: expected the socket to open, got %v", test.origin, err)
+		}
+		if !test.allowed && (err == nil || response == nil || response.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q: expected 403, got %v", test.origin, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jzhang405/SmartChrome/backend/internal/prompt"
+	"github.com/jzhang405/SmartChrome/backend/internal/tools"
+	"github.com/jzhang405/SmartChrome/backend/pkg/llm"
+)
+
+func TestRegistryRunExecutesToolCalls(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		// The first reply streams a tool call in fragments, the second answers
+		w.Header().Set("Content-Type", "text/event-stream")
+		if len(requests) == 1 {
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"get_tab_content\",\"arguments\":\"\"}}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"tab_id\\\":\"}}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"tab-2\\\"}\"}}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":30,\"completion_tokens\":10,\"total_tokens\":40}}\n\n")
+		} else {
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"The other tab is about Go.\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":50,\"completion_tokens\":8,\"total_tokens\":58}}\n\n")
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{
+		Name:    "openai",
+		BaseURL: server.URL + "/v1",
+		Model:   "gpt-4o-mini",
+		Tools:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", provider)
+
+	var called string
+	registry := tools.NewRegistry()
+	registry.Register(llm.Tool{Name: "get_tab_content", Description: "Read another tab"},
+		func(ctx context.Context, invocation tools.Invocation, arguments json.RawMessage) (string, error) {
+			called = string(arguments)
+			return "A page about Go", nil
+		})
+
+	var streamed strings.Builder
+	result, err := registry.Run(context.Background(), client, "openai", []llm.ChatMessage{
+		{Role: llm.RoleUser, Content: "What is my other tab about?"},
+	}, tools.Invocation{SessionID: "session-1", OpenTabs: []string{"tab-2"}}, tools.Stream{Content: func(content string) {
+		streamed.WriteString(content)
+	}})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if called != `{"tab_id":"tab-2"}` {
+		t.Errorf("tool called with %q", called)
+	}
+	if result.Content != "The other tab is about Go." || streamed.String() != result.Content {
+		t.Errorf("unexpected answer %q, streamed %q", result.Content, streamed.String())
+	}
+	if result.Usage.TotalTokens != 98 || len(result.Calls) != 1 || result.Calls[0].Name != "get_tab_content" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if offered, _ := requests[0]["tools"].([]interface{}); len(offered) != 1 {
+		t.Errorf("tools not offered: %v", requests[0]["tools"])
+	}
+
+	// The second request carries the call and its result
+	messages, _ := requests[1]["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("expected the tool call and its result to be sent back, got %d messages", len(messages))
+	}
+	if result, _ := messages[2].(map[string]interface{}); result["role"] != "tool" || result["tool_call_id"] != "call_1" || result["content"] != "A page about Go" {
+		t.Errorf("unexpected tool message %v", messages[2])
+	}
+}
+
+func TestRegistryRunReportsUsageOfCancelledAnswer(t *testing.T) {
+	// The server streams part of an answer, then stalls until the test ends
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"A partial answer\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "openai", BaseURL: server.URL + "/v1", Model: "gpt-4o-mini"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result, err := tools.NewRegistry().Run(ctx, client, "openai", []llm.ChatMessage{
+		{Role: llm.RoleUser, Content: "Tell me a long story"},
+	}, tools.Invocation{}, tools.Stream{Content: func(string) { cancel() }})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation, got %v", err)
+	}
+	if result == nil || result.Content != "A partial answer" {
+		t.Fatalf("expected the partial answer, got %+v", result)
+	}
+	if !result.Usage.Estimated || result.Usage.PromptTokens == 0 || result.Usage.CompletionTokens == 0 {
+		t.Errorf("expected estimated usage of the interrupted request, got %+v", result.Usage)
+	}
+}
+
+func TestRegistryRunFitsToolResultsToContextWindow(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if len(requests) == 1 {
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"get_tab_content\",\"arguments\":\"{}\"}},{\"index\":1,\"id\":\"call_2\",\"type\":\"function\",\"function\":{\"name\":\"get_tab_content\",\"arguments\":\"{}\"}}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n")
+		} else {
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Both tabs are long.\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider, err := llm.NewOpenAICompatibleProvider(llm.OpenAICompatibleConfig{Name: "openai", BaseURL: server.URL + "/v1", Model: "gpt-4o-mini", Tools: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := llm.NewLLMClient()
+	client.RegisterProvider("openai", provider)
+	limits := llm.Limits{ContextWindow: 4096, MaxOutputTokens: 512}
+	client.SetLimits("openai", limits)
+
+	registry := tools.NewRegistry()
+	registry.Register(llm.Tool{Name: "get_tab_content", Description: "Read another tab"},
+		func(ctx context.Context, invocation tools.Invocation, arguments json.RawMessage) (string, error) {
+			return strings.Repeat("A very long tab. ", 5000), nil
+		})
+
+	// The prompt leaves room for the tools, which their results then fill
+	budget := prompt.Budget{ContextWindow: limits.ContextWindow, AnswerTokens: limits.MaxOutputTokens, ToolTokens: registry.Reserve(limits.ContextWindow)}
+	if budget.ToolTokens <= 0 {
+		t.Fatalf("expected tokens to be reserved for tools")
+	}
+	messages, _ := prompt.Build(prompt.Request{
+		Page:     prompt.Page{Text: strings.Repeat("Page text about nothing in particular. ", 2000)},
+		Question: "What are my other tabs about?",
+		Budget:   budget,
+	})
+	if used := llm.EstimateUsage(messages, "").PromptTokens; used > budget.Capacity()-budget.ToolTokens {
+		t.Fatalf("prompt of %d tokens does not leave room for tools", used)
+	}
+
+	if _, err := registry.Run(context.Background(), client, "openai", messages, tools.Invocation{}, tools.Stream{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	sent, _ := requests[1]["messages"].([]interface{})
+	var total int
+	for _, message := range sent {
+		content, _ := message.(map[string]interface{})["content"].(string)
+		total += llm.EstimateTokens(content)
+	}
+	if total > budget.Capacity() {
+		t.Errorf("tool results overflow the context window: %d tokens of %d", total, budget.Capacity())
+	}
+	for _, message := range sent[len(sent)-2:] {
+		content, _ := message.(map[string]interface{})["content"].(string)
+		if !strings.HasSuffix(content, "[truncated]") || llm.EstimateTokens(content) < 100 {
+			t.Errorf("expected each tool result cut to its share of the window, got %d tokens", llm.EstimateTokens(content))
+		}
+	}
+}
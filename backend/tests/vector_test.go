@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jzhang405/SmartChrome/backend/pkg/cache"
+	"github.com/jzhang405/SmartChrome/backend/pkg/storage"
+	"github.com/jzhang405/SmartChrome/backend/pkg/vector"
+)
+
+func TestFlatIndexSearchFilters(t *testing.T) {
+	testIndexSearchFilters(t, vector.NewFlatIndex(), "a")
+}
+
+// TestRedisIndexSearchFilters needs a Redis server at TEST_REDIS_ADDR
+func TestRedisIndexSearchFilters(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client, err := cache.NewRedisClient(addr, "", 0)
+	if err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	index := vector.NewRedisIndex(client)
+	defer index.Close()
+
+	testIndexSearchFilters(t, index, fmt.Sprintf("test:%d", time.Now().UnixNano()))
+}
+
+// TestPgvectorIndexSearchFilters needs a PostgreSQL database with the
+// pgvector extension at TEST_PGVECTOR_URL
+func TestPgvectorIndexSearchFilters(t *testing.T) {
+	url := os.Getenv("TEST_PGVECTOR_URL")
+	if url == "" {
+		t.Skip("TEST_PGVECTOR_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	if err := storage.MigrateKnowledge(context.Background(), db); err != nil {
+		t.Skipf("pgvector is not available: %v", err)
+	}
+	index := vector.NewPgvectorIndex(db)
+
+	testIndexSearchFilters(t, index, fmt.Sprintf("test:%d", time.Now().UnixNano()))
+}
+
+// testIndexSearchFilters saves pages for owner, which must have none yet,
+// and deletes them again
+func testIndexSearchFilters(t *testing.T, index vector.Index, owner string) {
+	ctx := context.Background()
+	lastWeek := time.Now().AddDate(0, 0, -7)
+	lastMonth := time.Now().AddDate(0, -1, 0)
+
+	pages := [][]vector.Entry{
+		{{Owner: owner, PageID: "recent", SavedAt: lastWeek, Model: "m1", Text: "recent", Vector: []float32{1, 0}}},
+		{{Owner: owner, PageID: "old", SavedAt: lastMonth, Model: "m1", Text: "old", Vector: []float32{1, 0}}},
+		{{Owner: owner, PageID: "other-model", SavedAt: lastWeek, Model: "m2", Text: "other model", Vector: []float32{1, 0}}},
+		{{Owner: owner, PageID: "unrelated", SavedAt: lastWeek, Model: "m1", Text: "unrelated", Vector: []float32{0, 1}}},
+	}
+	for _, entries := range pages {
+		if err := index.SavePage(ctx, entries); err != nil {
+			t.Fatal(err)
+		}
+		defer index.DeletePage(ctx, owner, entries[0].PageID)
+	}
+
+	matches, err := index.Search(ctx, vector.Query{
+		Owner:  owner,
+		Model:  "m1",
+		Vector: []float32{1, 0},
+		TopK:   10,
+		Since:  time.Now().AddDate(0, 0, -14),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].PageID != "recent" || matches[1].PageID != "unrelated" {
+		t.Fatalf("expected the recent page before the unrelated one, got %+v", matches)
+	}
+	if matches[0].Score < 0.99 || matches[0].Vector != nil {
+		t.Errorf("unexpected match %+v", matches[0])
+	}
+
+	listed, _ := index.ListPages(ctx, owner)
+	if len(listed) != 4 || listed[len(listed)-1].ID != "old" {
+		t.Errorf("expected the oldest page last, got %+v", listed)
+	}
+
+	// Other owners may have old pages in a shared index too
+	removed, err := index.DeleteSavedBefore(ctx, time.Now().AddDate(0, 0, -14))
+	if err != nil || removed < 1 {
+		t.Fatalf("expected the old page to be deleted, got %d (%v)", removed, err)
+	}
+	listed, _ = index.ListPages(ctx, owner)
+	if len(listed) != 3 || listed[len(listed)-1].ID == "old" {
+		t.Errorf("expected the newer pages to be kept, got %+v", listed)
+	}
+}